@@ -24,6 +24,8 @@ type APITestSuite struct {
 	suite.Suite
 	router *gin.Engine
 	p      proxy.TargetsManagerMock
+	cache  proxy.TokenCacheControlMock
+	keys   proxy.APIKeyControlMock
 	serv   *httptest.Server
 }
 
@@ -31,7 +33,9 @@ func (suite *APITestSuite) SetupSuite() {
 	log.SetLevel(log.DebugLevel)
 	suite.p = proxy.TargetsManagerMock{}
 	p := NewProxyAPI(&suite.p)
-	c := NewControlAPI()
+	suite.cache = proxy.TokenCacheControlMock{}
+	suite.keys = proxy.APIKeyControlMock{}
+	c := NewControlAPI(&suite.p, &suite.cache, &suite.keys)
 	suite.router = gin.New()
 	p.AddRoutes(suite.router)
 	c.AddRoutes(suite.router)
@@ -49,6 +53,24 @@ func (suite *APITestSuite) TestHealth() {
 	a.Equal(http.StatusOK, res.StatusCode)
 }
 
+func (suite *APITestSuite) TestTargetsHealth() {
+	a := assert.New(suite.T())
+	h := map[string][]proxy.MemberHealth{
+		"pool": []proxy.MemberHealth{
+			proxy.MemberHealth{ID: "m1", URL: "http://m1:8080", State: proxy.HealthUp},
+			proxy.MemberHealth{ID: "m2", URL: "http://m2:8080", State: proxy.HealthDown},
+		},
+	}
+	suite.p.On("Health").Return(h).Once()
+	res, err := http.Get(fmt.Sprintf("%s%s", suite.serv.URL, "/health/targets"))
+	a.NoError(err)
+	a.Equal(http.StatusOK, res.StatusCode)
+	var body map[string][]proxy.MemberHealth
+	a.NoError(json.NewDecoder(res.Body).Decode(&body))
+	a.Len(body["pool"], 2)
+	a.Equal(proxy.HealthDown, body["pool"][1].State)
+}
+
 func (suite *APITestSuite) TestVersion() {
 	a := assert.New(suite.T())
 	config.Ver = config.Version{Version: "0.1.0"}
@@ -57,6 +79,110 @@ func (suite *APITestSuite) TestVersion() {
 	a.Equal(http.StatusOK, res.StatusCode)
 }
 
+func (suite *APITestSuite) TestTokenCache() {
+	a := assert.New(suite.T())
+	suite.cache.On("CacheStats").Return(proxy.CacheStats{Enabled: true, Entries: 2, Hits: 3, Misses: 1, HitRate: 0.75}).Once()
+	res, err := http.Get(fmt.Sprintf("%s%s", suite.serv.URL, "/auth/cache"))
+	a.NoError(err)
+	a.Equal(http.StatusOK, res.StatusCode)
+	var stats proxy.CacheStats
+	a.NoError(json.NewDecoder(res.Body).Decode(&stats))
+	a.Equal(0.75, stats.HitRate)
+	a.Equal(2, stats.Entries)
+
+	suite.cache.On("InvalidateAll").Return(2).Once()
+	req, _ := http.NewRequest(http.MethodDelete, fmt.Sprintf("%s%s", suite.serv.URL, "/auth/cache"), nil)
+	res, err = http.DefaultClient.Do(req)
+	a.NoError(err)
+	a.Equal(http.StatusOK, res.StatusCode)
+
+	url := fmt.Sprintf("%s%s", suite.serv.URL, "/auth/cache/invalidate")
+	res, err = http.Post(url, "application/json", bytes.NewReader([]byte(`{}`)))
+	a.NoError(err)
+	a.Equal(http.StatusBadRequest, res.StatusCode)
+	suite.cache.On("Invalidate", "cached").Return(true).Once()
+	res, err = http.Post(url, "application/json", bytes.NewReader([]byte(`{"token":"cached"}`)))
+	a.NoError(err)
+	a.Equal(http.StatusOK, res.StatusCode)
+	suite.cache.On("Invalidate", "unknown").Return(false).Once()
+	res, err = http.Post(url, "application/json", bytes.NewReader([]byte(`{"token":"unknown"}`)))
+	a.NoError(err)
+	a.Equal(http.StatusNotFound, res.StatusCode)
+	suite.cache.AssertExpectations(suite.T())
+}
+
+func (suite *APITestSuite) TestAPIKeys() {
+	a := assert.New(suite.T())
+	url := fmt.Sprintf("%s%s", suite.serv.URL, "/auth/keys")
+	suite.keys.On("Keys").Return([]proxy.APIKey{proxy.APIKey{ID: "cron", Permissions: 10}}).Once()
+	res, err := http.Get(url)
+	a.NoError(err)
+	a.Equal(http.StatusOK, res.StatusCode)
+	var keys []proxy.APIKey
+	a.NoError(json.NewDecoder(res.Body).Decode(&keys))
+	a.Len(keys, 1)
+	a.Equal("cron", keys[0].ID)
+
+	res, err = http.Post(url, "application/json", bytes.NewReader([]byte(`{"id":`)))
+	a.NoError(err)
+	a.Equal(http.StatusBadRequest, res.StatusCode)
+	suite.keys.On("AddKey", proxy.APIKey{ID: "svc", Permissions: 5}).Return(proxy.APIKey{ID: "svc", Key: "generated", Hash: "abc", Permissions: 5}, nil).Once()
+	res, err = http.Post(url, "application/json", bytes.NewReader([]byte(`{"id":"svc","permissions":5}`)))
+	a.NoError(err)
+	a.Equal(http.StatusOK, res.StatusCode)
+	var key proxy.APIKey
+	a.NoError(json.NewDecoder(res.Body).Decode(&key))
+	a.Equal("generated", key.Key)
+	a.Empty(key.Hash)
+	// plain keys sent by the client are not echoed back
+	suite.keys.On("AddKey", proxy.APIKey{ID: "own", Key: "secret"}).Return(proxy.APIKey{ID: "own", Key: "secret", Hash: "abc"}, nil).Once()
+	res, err = http.Post(url, "application/json", bytes.NewReader([]byte(`{"id":"own","key":"secret"}`)))
+	a.NoError(err)
+	a.Equal(http.StatusOK, res.StatusCode)
+	key = proxy.APIKey{}
+	a.NoError(json.NewDecoder(res.Body).Decode(&key))
+	a.Empty(key.Key)
+	suite.keys.On("AddKey", proxy.APIKey{ID: "own", Key: "secret"}).Return(proxy.APIKey{}, goerr.NewError("exists", proxy.Conflict)).Once()
+	res, err = http.Post(url, "application/json", bytes.NewReader([]byte(`{"id":"own","key":"secret"}`)))
+	a.NoError(err)
+	a.Equal(http.StatusConflict, res.StatusCode)
+
+	suite.keys.On("RemoveKey", "svc").Return(true).Once()
+	req, _ := http.NewRequest(http.MethodDelete, url+"/svc", nil)
+	res, err = http.DefaultClient.Do(req)
+	a.NoError(err)
+	a.Equal(http.StatusOK, res.StatusCode)
+	suite.keys.On("RemoveKey", "svc").Return(false).Once()
+	req, _ = http.NewRequest(http.MethodDelete, url+"/svc", nil)
+	res, err = http.DefaultClient.Do(req)
+	a.NoError(err)
+	a.Equal(http.StatusNotFound, res.StatusCode)
+	suite.keys.AssertExpectations(suite.T())
+}
+
+func (suite *APITestSuite) TestExplain() {
+	a := assert.New(suite.T())
+	url := fmt.Sprintf("%s%s", suite.serv.URL, "/authz/explain")
+	res, err := http.Post(url, "application/json", bytes.NewReader([]byte(`{"target":"users"}`)))
+	a.NoError(err)
+	a.Equal(http.StatusBadRequest, res.StatusCode)
+	e := &proxy.Explanation{Target: "users", Method: http.MethodDelete, Path: "/users/12", RuleIndex: 1, Decision: proxy.PolicyDeny,
+		Status: http.StatusForbidden, Error: "Insufficient privileges", Identity: &proxy.Identity{Username: "john", Permissions: 3}}
+	suite.p.On("Explain", "users", http.MethodDelete, "/users/12", "Bearer abc", "").Return(e, nil).Once()
+	res, err = http.Post(url, "application/json", bytes.NewReader([]byte(`{"target":"users","method":"delete","path":"users/12","token":"Bearer abc"}`)))
+	a.NoError(err)
+	a.Equal(http.StatusOK, res.StatusCode)
+	var body proxy.Explanation
+	a.NoError(json.NewDecoder(res.Body).Decode(&body))
+	a.Equal(proxy.PolicyDeny, body.Decision)
+	a.Equal(1, body.RuleIndex)
+	a.Equal(3, body.Identity.Permissions)
+	suite.p.On("Explain", "unknown", http.MethodGet, "/", "", "").Return(nil, goerr.NewError("Target not found", goerr.NotFound)).Once()
+	res, err = http.Post(url, "application/json", bytes.NewReader([]byte(`{"target":"unknown","method":"GET","path":"/"}`)))
+	a.NoError(err)
+	a.Equal(http.StatusNotFound, res.StatusCode)
+}
+
 func (suite *APITestSuite) TestCreatePool() {
 	a := assert.New(suite.T())
 	// test no body (parse error)
@@ -84,6 +210,145 @@ func (suite *APITestSuite) TestCreatePool() {
 	a.Equal(http.StatusOK, res.StatusCode)
 }
 
+func (suite *APITestSuite) TestDeletePool() {
+	a := assert.New(suite.T())
+	suite.p.On("DeletePool", "missing").Return(goerr.NewError("Pool not found", goerr.NotFound)).Once()
+	suite.p.On("DeletePool", "single").Return(goerr.NewError("Invalid target type", proxy.InvalidType)).Once()
+	suite.p.On("DeletePool", "broken").Return(errors.New("dummy")).Once()
+	suite.p.On("DeletePool", "test").Return(nil).Once()
+	for ID, status := range map[string]int{"missing": http.StatusNotFound, "single": http.StatusConflict, "broken": http.StatusInternalServerError, "test": http.StatusOK} {
+		req, _ := http.NewRequest(http.MethodDelete, fmt.Sprintf("%s/pool/%s", suite.serv.URL, ID), nil)
+		res, err := http.DefaultClient.Do(req)
+		a.NoError(err)
+		a.Equal(status, res.StatusCode)
+	}
+}
+
+func (suite *APITestSuite) TestAddToPool() {
+	a := assert.New(suite.T())
+	suite.p.On("AddToPool", "missing", "m1", "http://m1:8080", 1).Return(goerr.NewError("Pool not found", goerr.NotFound)).Once()
+	suite.p.On("AddToPool", "single", "m1", "http://m1:8080", 1).Return(goerr.NewError("Invalid target type", proxy.InvalidType)).Once()
+	suite.p.On("AddToPool", "invalid", "m1", "http://m1:8080", 1).Return(goerr.NewError("Invalid member URL", goerr.BadRequest)).Once()
+	suite.p.On("AddToPool", "broken", "m1", "http://m1:8080", 1).Return(errors.New("dummy")).Once()
+	suite.p.On("AddToPool", "test", "m1", "http://m1:8080", 1).Return(nil).Once()
+	for ID, status := range map[string]int{"missing": http.StatusNotFound, "single": http.StatusConflict, "invalid": http.StatusBadRequest, "broken": http.StatusInternalServerError, "test": http.StatusOK} {
+		b, _ := json.Marshal(map[string]interface{}{"id": ID, "targetId": "m1", "targetUri": "http://m1:8080", "weight": 1})
+		res, err := http.Post(fmt.Sprintf("%s/pool/%s", suite.serv.URL, ID), "application/json", bytes.NewReader(b))
+		a.NoError(err)
+		a.Equal(status, res.StatusCode)
+	}
+}
+
+func (suite *APITestSuite) TestDeleteFromPool() {
+	a := assert.New(suite.T())
+	suite.p.On("RemoveFromPool", "test", "missing").Return(goerr.NewError("Pool member not found", goerr.NotFound)).Once()
+	suite.p.On("RemoveFromPool", "test", "m1").Return(nil).Once()
+	for ID, status := range map[string]int{"missing": http.StatusNotFound, "m1": http.StatusOK} {
+		req, _ := http.NewRequest(http.MethodDelete, fmt.Sprintf("%s/pool/test/%s", suite.serv.URL, ID), nil)
+		res, err := http.DefaultClient.Do(req)
+		a.NoError(err)
+		a.Equal(status, res.StatusCode)
+	}
+}
+
+func (suite *APITestSuite) TestListTargets() {
+	a := assert.New(suite.T())
+	targets := []proxy.TargetConfig{
+		proxy.TargetConfig{TID: "p1", TargetType: proxy.TypePool, TargetProtocol: proxy.ProtocolHTTP},
+		proxy.TargetConfig{TID: "s1", TargetType: proxy.TypeSingle, TargetProtocol: proxy.ProtocolWebsocket, URL: "http://s1:8080", UpdatesToken: true, Privileges: &proxy.Privileges{Default: 3}},
+	}
+	suite.p.On("Targets").Return(targets).Once()
+	res, err := http.Get(fmt.Sprintf("%s%s", suite.serv.URL, "/targets"))
+	a.NoError(err)
+	a.Equal(http.StatusOK, res.StatusCode)
+	var body []proxy.TargetConfig
+	a.NoError(json.NewDecoder(res.Body).Decode(&body))
+	a.Len(body, 2)
+	a.Equal("http://s1:8080", body[1].URL)
+	a.Equal(3, body[1].Privileges.Default)
+	a.True(body[1].UpdatesToken)
+}
+
+func (suite *APITestSuite) TestGetTarget() {
+	a := assert.New(suite.T())
+	suite.p.On("Target", "missing").Return(proxy.TargetConfig{}, goerr.NewError("Target not found", goerr.NotFound)).Once()
+	suite.p.On("Target", "s1").Return(proxy.TargetConfig{TID: "s1", TargetType: proxy.TypeSingle}, nil).Once()
+	res, err := http.Get(fmt.Sprintf("%s%s", suite.serv.URL, "/targets/missing"))
+	a.NoError(err)
+	a.Equal(http.StatusNotFound, res.StatusCode)
+	res, err = http.Get(fmt.Sprintf("%s%s", suite.serv.URL, "/targets/s1"))
+	a.NoError(err)
+	a.Equal(http.StatusOK, res.StatusCode)
+	var body proxy.TargetConfig
+	a.NoError(json.NewDecoder(res.Body).Decode(&body))
+	a.Equal(proxy.TypeSingle, body.TargetType)
+}
+
+func (suite *APITestSuite) TestPoolMembers() {
+	a := assert.New(suite.T())
+	members := []proxy.MemberInfo{
+		proxy.MemberInfo{ID: "m1", URL: "http://m1:8080", Weight: 1, Active: 2, Requests: 10, Health: proxy.MemberHealth{State: proxy.HealthUp}},
+	}
+	suite.p.On("PoolMembers", "s1").Return([]proxy.MemberInfo(nil), goerr.NewError("Invalid target type", proxy.InvalidType)).Once()
+	suite.p.On("PoolMembers", "p1").Return(members, nil).Once()
+	res, err := http.Get(fmt.Sprintf("%s%s", suite.serv.URL, "/pool/s1/members"))
+	a.NoError(err)
+	a.Equal(http.StatusConflict, res.StatusCode)
+	res, err = http.Get(fmt.Sprintf("%s%s", suite.serv.URL, "/pool/p1/members"))
+	a.NoError(err)
+	a.Equal(http.StatusOK, res.StatusCode)
+	var body []proxy.MemberInfo
+	a.NoError(json.NewDecoder(res.Body).Decode(&body))
+	a.Len(body, 1)
+	a.Equal(uint64(10), body[0].Requests)
+	a.Equal(proxy.HealthUp, body[0].Health.State)
+}
+
+func (suite *APITestSuite) TestCreateTarget() {
+	a := assert.New(suite.T())
+	res, err := http.Post(fmt.Sprintf("%s%s", suite.serv.URL, "/targets"), "application/json", nil)
+	a.NoError(err)
+	a.Equal(http.StatusBadRequest, res.StatusCode)
+	b, _ := json.Marshal(&proxy.TargetConfig{TID: "s1", TargetType: proxy.TypeSingle, TargetProtocol: proxy.ProtocolHTTP, URL: "http://s1:8080"})
+	suite.p.On("CreateTarget", mock.AnythingOfType("*proxy.TargetConfig")).Return(goerr.NewError("invalid url", goerr.BadRequest)).Once()
+	res, err = http.Post(fmt.Sprintf("%s%s", suite.serv.URL, "/targets"), "application/json", bytes.NewReader(b))
+	a.NoError(err)
+	a.Equal(http.StatusBadRequest, res.StatusCode)
+	suite.p.On("CreateTarget", mock.AnythingOfType("*proxy.TargetConfig")).Return(goerr.NewError("Target already exists", proxy.Conflict)).Once()
+	res, err = http.Post(fmt.Sprintf("%s%s", suite.serv.URL, "/targets"), "application/json", bytes.NewReader(b))
+	a.NoError(err)
+	a.Equal(http.StatusConflict, res.StatusCode)
+	suite.p.On("CreateTarget", mock.AnythingOfType("*proxy.TargetConfig")).Return(nil).Once()
+	res, err = http.Post(fmt.Sprintf("%s%s", suite.serv.URL, "/targets"), "application/json", bytes.NewReader(b))
+	a.NoError(err)
+	a.Equal(http.StatusOK, res.StatusCode)
+}
+
+func (suite *APITestSuite) TestReplaceTarget() {
+	a := assert.New(suite.T())
+	b, _ := json.Marshal(&proxy.TargetConfig{TargetType: proxy.TypeSingle, TargetProtocol: proxy.ProtocolHTTP, URL: "http://s1:8080"})
+	suite.p.On("ReplaceTarget", "missing", mock.AnythingOfType("*proxy.TargetConfig")).Return(goerr.NewError("Target not found", goerr.NotFound)).Once()
+	suite.p.On("ReplaceTarget", "s1", mock.AnythingOfType("*proxy.TargetConfig")).Return(nil).Once()
+	for ID, status := range map[string]int{"missing": http.StatusNotFound, "s1": http.StatusOK} {
+		req, _ := http.NewRequest(http.MethodPut, fmt.Sprintf("%s/targets/%s", suite.serv.URL, ID), bytes.NewReader(b))
+		res, err := http.DefaultClient.Do(req)
+		a.NoError(err)
+		a.Equal(status, res.StatusCode)
+	}
+}
+
+func (suite *APITestSuite) TestDeleteTarget() {
+	a := assert.New(suite.T())
+	suite.p.On("DeleteTarget", "missing").Return(goerr.NewError("Target not found", goerr.NotFound)).Once()
+	suite.p.On("DeleteTarget", "s1").Return(nil).Once()
+	for ID, status := range map[string]int{"missing": http.StatusNotFound, "s1": http.StatusOK} {
+		req, _ := http.NewRequest(http.MethodDelete, fmt.Sprintf("%s/targets/%s", suite.serv.URL, ID), nil)
+		res, err := http.DefaultClient.Do(req)
+		a.NoError(err)
+		a.Equal(status, res.StatusCode)
+	}
+}
+
 func TestAPITestSuite(t *testing.T) {
 	suite.Run(t, new(APITestSuite))
 }
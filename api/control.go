@@ -2,26 +2,53 @@ package api
 
 import (
 	"net/http"
+	"strings"
 
+	"github.com/mklimuk/api-proxy/proxy"
 	"github.com/mklimuk/auth/config"
+	"github.com/mklimuk/goerr"
 	"github.com/mklimuk/husar/rest"
 
+	log "github.com/Sirupsen/logrus"
 	"github.com/gin-gonic/gin"
 )
 
 //NewControlAPI is a control constructor
-func NewControlAPI() rest.API {
-	c := controlAPI{}
+func NewControlAPI(manager proxy.TargetsManager, cache proxy.TokenCacheControl, keys proxy.APIKeyControl) rest.API {
+	c := controlAPI{manager, cache, keys}
 	return rest.API(&c)
 }
 
 type controlAPI struct {
+	manager proxy.TargetsManager
+	cache   proxy.TokenCacheControl
+	keys    proxy.APIKeyControl
+}
+
+type invalidateToken struct {
+	Token string `json:"token"`
+}
+
+type explainRequest struct {
+	Target string `json:"target"`
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	Token  string `json:"token,omitempty"`
+	APIKey string `json:"apiKey,omitempty"`
 }
 
 //AddRoutes initializes and returns all catalog API routes
 func (c *controlAPI) AddRoutes(router *gin.Engine) {
 	router.GET("/health", c.CheckHealth)
+	router.GET("/health/targets", c.TargetsHealth)
 	router.GET("/version", c.VersionInfo)
+	router.GET("/auth/cache", c.CacheStats)
+	router.DELETE("/auth/cache", c.ClearCache)
+	router.POST("/auth/cache/invalidate", c.InvalidateToken)
+	router.GET("/auth/keys", c.APIKeys)
+	router.POST("/auth/keys", c.AddAPIKey)
+	router.DELETE("/auth/keys/:keyId", c.RemoveAPIKey)
+	router.POST("/authz/explain", c.Explain)
 }
 
 func (c *controlAPI) CheckHealth(ctx *gin.Context) {
@@ -29,7 +56,113 @@ func (c *controlAPI) CheckHealth(ctx *gin.Context) {
 	ctx.JSON(http.StatusOK, gin.H{"status": "OK"})
 }
 
+func (c *controlAPI) TargetsHealth(ctx *gin.Context) {
+	defer rest.ErrorHandler(ctx)
+	ctx.JSON(http.StatusOK, c.manager.Health())
+}
+
 func (c *controlAPI) VersionInfo(ctx *gin.Context) {
 	defer rest.ErrorHandler(ctx)
 	ctx.JSON(http.StatusOK, config.Ver)
 }
+
+func (c *controlAPI) CacheStats(ctx *gin.Context) {
+	defer rest.ErrorHandler(ctx)
+	ctx.JSON(http.StatusOK, c.cache.CacheStats())
+}
+
+func (c *controlAPI) ClearCache(ctx *gin.Context) {
+	defer rest.ErrorHandler(ctx)
+	ctx.JSON(http.StatusOK, gin.H{"invalidated": c.cache.InvalidateAll()})
+}
+
+//InvalidateToken removes a single token from the cache; the token is passed in the body so that it does not end up in access logs
+func (c *controlAPI) InvalidateToken(ctx *gin.Context) {
+	defer rest.ErrorHandler(ctx)
+	req := new(invalidateToken)
+	if err := ctx.BindJSON(req); err != nil || req.Token == "" {
+		log.WithFields(log.Fields{"logger": "proxy.api", "method": "InvalidateToken"}).
+			Warn("Could not parse request")
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Could not parse input", "details": "token is required"})
+		return
+	}
+	if !c.cache.Invalidate(req.Token) {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "Token not cached"})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"invalidated": 1})
+}
+
+func (c *controlAPI) APIKeys(ctx *gin.Context) {
+	defer rest.ErrorHandler(ctx)
+	ctx.JSON(http.StatusOK, c.keys.Keys())
+}
+
+//AddAPIKey registers a key; the plain key is only part of the response if it was generated by the proxy
+func (c *controlAPI) AddAPIKey(ctx *gin.Context) {
+	defer rest.ErrorHandler(ctx)
+	req := new(proxy.APIKey)
+	var err error
+	if err = ctx.BindJSON(req); err != nil {
+		log.WithFields(log.Fields{"logger": "proxy.api", "method": "AddAPIKey", "error": err}).
+			Warn("Could not parse request")
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Could not parse input", "details": err.Error()})
+		return
+	}
+	provided := req.Key != ""
+	var key proxy.APIKey
+	if key, err = c.keys.AddKey(*req); err != nil {
+		switch goerr.GetType(err) {
+		case goerr.BadRequest:
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid API key", "details": err.Error()})
+		case proxy.Conflict:
+			ctx.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		default:
+			log.WithFields(log.Fields{"logger": "proxy.api", "method": "AddAPIKey", "error": err}).
+				WithError(err).Error("Error processing request")
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Internal error occured", "details": err.Error()})
+		}
+		return
+	}
+	key.Hash = ""
+	if provided {
+		key.Key = ""
+	}
+	ctx.JSON(http.StatusOK, key)
+}
+
+func (c *controlAPI) RemoveAPIKey(ctx *gin.Context) {
+	defer rest.ErrorHandler(ctx)
+	if !c.keys.RemoveKey(ctx.Param("keyId")) {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+		return
+	}
+	ctx.AbortWithStatus(http.StatusOK)
+}
+
+//Explain shows how a request would be authorized without proxying it; credentials are passed in the body so that they do not end up in access logs
+func (c *controlAPI) Explain(ctx *gin.Context) {
+	defer rest.ErrorHandler(ctx)
+	req := new(explainRequest)
+	if err := ctx.BindJSON(req); err != nil || req.Target == "" || req.Method == "" || req.Path == "" {
+		log.WithFields(log.Fields{"logger": "proxy.api", "method": "Explain"}).
+			Warn("Could not parse request")
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Could not parse input", "details": "target, method and path are required"})
+		return
+	}
+	if !strings.HasPrefix(req.Path, "/") {
+		req.Path = "/" + req.Path
+	}
+	e, err := c.manager.Explain(req.Target, strings.ToUpper(req.Method), req.Path, req.Token, req.APIKey)
+	if err != nil {
+		if goerr.GetType(err) == goerr.NotFound {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		log.WithFields(log.Fields{"logger": "proxy.api", "method": "Explain", "error": err}).
+			WithError(err).Error("Error processing request")
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Internal error occured", "details": err.Error()})
+		return
+	}
+	ctx.JSON(http.StatusOK, e)
+}
@@ -19,6 +19,7 @@ type addToPool struct {
 	PoolID    string `json:"id"`
 	TargetID  string `json:"targetId,opitempty"`
 	TargetURI string `json:"targetUri,omitempty"`
+	Weight    int    `json:"weight,omitempty"`
 }
 
 //NewProxyAPI is the proxy proxy API constructor
@@ -33,6 +34,12 @@ func (p *proxyAPI) AddRoutes(router *gin.Engine) {
 	router.DELETE("/pool/:poolId", p.deletePool)
 	router.POST("/pool/:poolId", p.addToPool)
 	router.DELETE("/pool/:poolId/:endpointId", p.deleteFromPool)
+	router.GET("/pool/:poolId/members", p.poolMembers)
+	router.GET("/targets", p.listTargets)
+	router.GET("/targets/:id", p.getTarget)
+	router.POST("/targets", p.createTarget)
+	router.PUT("/targets/:id", p.replaceTarget)
+	router.DELETE("/targets/:id", p.deleteTarget)
 	router.Any("/api/:id/*path", p.proxy)
 	router.GET("/ws/:id/*path", p.proxy)
 }
@@ -52,6 +59,9 @@ func (p *proxyAPI) createPool(ctx *gin.Context) {
 		case proxy.Conflict:
 			ctx.JSON(http.StatusConflict, gin.H{"error": "Pool with this id already exists"})
 			return
+		case goerr.BadRequest:
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid pool configuration", "details": err.Error()})
+			return
 		default:
 			log.WithFields(log.Fields{"logger": "proxy.api", "method": "createPool", "error": err}).
 				WithError(err).Error("Error processing request")
@@ -72,34 +82,44 @@ func (p *proxyAPI) addToPool(ctx *gin.Context) {
 		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Could not parse input", "details": err.Error()})
 		return
 	}
-	if err = p.manager.AddToPool(u.PoolID, u.TargetID, u.TargetURI); err != nil {
-		switch goerr.GetType(err) {
-		case goerr.NotFound:
-			ctx.JSON(http.StatusNotFound, goerr.GetCtx(err))
-			return
-		case proxy.Conflict:
-			ctx.JSON(http.StatusConflict, goerr.GetCtx(err))
-			return
-		default:
-			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Internal error occured", "details": err.Error()})
-			return
-		}
+	if err = p.manager.AddToPool(u.PoolID, u.TargetID, u.TargetURI, u.Weight); err != nil {
+		p.managerError(ctx, "addToPool", err)
+		return
 	}
 	ctx.AbortWithStatus(http.StatusOK)
 }
 
 func (p *proxyAPI) deletePool(ctx *gin.Context) {
 	defer rest.ErrorHandler(ctx)
-	//var err error
-
-	ctx.JSON(http.StatusOK, gin.H{"token": "abc"})
+	if err := p.manager.DeletePool(ctx.Param("poolId")); err != nil {
+		p.managerError(ctx, "deletePool", err)
+		return
+	}
+	ctx.AbortWithStatus(http.StatusOK)
 }
 
 func (p *proxyAPI) deleteFromPool(ctx *gin.Context) {
 	defer rest.ErrorHandler(ctx)
-	//var err error
+	if err := p.manager.RemoveFromPool(ctx.Param("poolId"), ctx.Param("endpointId")); err != nil {
+		p.managerError(ctx, "deleteFromPool", err)
+		return
+	}
+	ctx.AbortWithStatus(http.StatusOK)
+}
 
-	ctx.JSON(http.StatusOK, gin.H{"token": "abc"})
+func (p *proxyAPI) managerError(ctx *gin.Context, method string, err error) {
+	switch goerr.GetType(err) {
+	case goerr.NotFound:
+		ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case goerr.BadRequest:
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid target configuration", "details": err.Error()})
+	case proxy.Conflict, proxy.InvalidType:
+		ctx.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		log.WithFields(log.Fields{"logger": "proxy.api", "method": method, "error": err}).
+			WithError(err).Error("Error processing request")
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Internal error occured", "details": err.Error()})
+	}
 }
 
 func (p *proxyAPI) proxy(ctx *gin.Context) {
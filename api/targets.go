@@ -0,0 +1,81 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/mklimuk/api-proxy/proxy"
+	"github.com/mklimuk/husar/rest"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+)
+
+func (p *proxyAPI) listTargets(ctx *gin.Context) {
+	defer rest.ErrorHandler(ctx)
+	ctx.JSON(http.StatusOK, p.manager.Targets())
+}
+
+func (p *proxyAPI) getTarget(ctx *gin.Context) {
+	defer rest.ErrorHandler(ctx)
+	var t proxy.TargetConfig
+	var err error
+	if t, err = p.manager.Target(ctx.Param("id")); err != nil {
+		p.managerError(ctx, "getTarget", err)
+		return
+	}
+	ctx.JSON(http.StatusOK, t)
+}
+
+func (p *proxyAPI) poolMembers(ctx *gin.Context) {
+	defer rest.ErrorHandler(ctx)
+	var m []proxy.MemberInfo
+	var err error
+	if m, err = p.manager.PoolMembers(ctx.Param("poolId")); err != nil {
+		p.managerError(ctx, "poolMembers", err)
+		return
+	}
+	ctx.JSON(http.StatusOK, m)
+}
+
+func (p *proxyAPI) createTarget(ctx *gin.Context) {
+	defer rest.ErrorHandler(ctx)
+	var err error
+	t := new(proxy.TargetConfig)
+	if err = ctx.BindJSON(t); err != nil {
+		log.WithFields(log.Fields{"logger": "proxy.api", "method": "createTarget", "error": err}).
+			Warn("Could not parse request")
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Could not parse input", "details": err.Error()})
+		return
+	}
+	if err = p.manager.CreateTarget(t); err != nil {
+		p.managerError(ctx, "createTarget", err)
+		return
+	}
+	ctx.JSON(http.StatusOK, t)
+}
+
+func (p *proxyAPI) replaceTarget(ctx *gin.Context) {
+	defer rest.ErrorHandler(ctx)
+	var err error
+	t := new(proxy.TargetConfig)
+	if err = ctx.BindJSON(t); err != nil {
+		log.WithFields(log.Fields{"logger": "proxy.api", "method": "replaceTarget", "error": err}).
+			Warn("Could not parse request")
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Could not parse input", "details": err.Error()})
+		return
+	}
+	if err = p.manager.ReplaceTarget(ctx.Param("id"), t); err != nil {
+		p.managerError(ctx, "replaceTarget", err)
+		return
+	}
+	ctx.JSON(http.StatusOK, t)
+}
+
+func (p *proxyAPI) deleteTarget(ctx *gin.Context) {
+	defer rest.ErrorHandler(ctx)
+	if err := p.manager.DeleteTarget(ctx.Param("id")); err != nil {
+		p.managerError(ctx, "deleteTarget", err)
+		return
+	}
+	ctx.AbortWithStatus(http.StatusOK)
+}
@@ -11,6 +11,15 @@ Configuration is a struct containing different configuration options
 */
 type Configuration struct {
 	Targets []*proxy.TargetConfig `yaml:"targets"`
+	// Auth selects how tokens are checked; tokens are checked by the auth service if omitted
+	Auth *proxy.AuthConfig `yaml:"auth"`
+	// TokenCache enables caching of token check results; results are not cached if omitted
+	TokenCache *proxy.TokenCache `yaml:"tokenCache"`
+	// APIKeys are accepted by targets with apiKey settings in place of bearer tokens; they are loaded once at startup
+	// and are not reloaded with the configuration file, keys can be changed at runtime through the control API
+	APIKeys []*proxy.APIKey `yaml:"apiKeys"`
+	// DenyUnprotected makes targets without privileges and without a default policy reject all requests with 403
+	DenyUnprotected bool `yaml:"denyUnprotected"`
 }
 
 //Timezone is a reference timezone for the system
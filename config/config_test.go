@@ -3,6 +3,8 @@ package config
 import (
 	"testing"
 
+	"github.com/mklimuk/api-proxy/proxy"
+
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
 )
@@ -15,8 +17,37 @@ func (suite *ConfigTestSuite) TestParseConfig() {
 	a := assert.New(suite.T())
 	Parse("test/config.yml")
 	a.Len(Config.Targets, 1)
-	a.Len(Config.Targets[0].Methods, 1)
-	a.Equal("GET", Config.Targets[0].Methods[0])
+	a.Len(Config.Targets[0].Privileges.Paths, 3)
+	a.Equal(proxy.Methods("GET"), Config.Targets[0].Privileges.Paths[0].Method)
+	a.Equal(proxy.NewMethods("POST", "PUT", "DELETE"), Config.Targets[0].Privileges.Paths[1].Method)
+	a.Equal(proxy.AccessDeny, Config.Targets[0].Privileges.Paths[2].Access)
+	a.True(Config.DenyUnprotected)
+	a.Equal("/legacy", Config.Targets[0].Rewrite.StripPrefix)
+	a.Equal("/previews/$1", Config.Targets[0].Rewrite.Replace[0].Replacement)
+	a.Equal("30s", Config.TokenCache.TTL)
+	a.Equal(1000, Config.TokenCache.MaxEntries)
+	a.Equal("2s", Config.Auth.Timeout)
+	a.Equal(3, Config.Auth.Retry.Attempts)
+	a.Equal("X-Service-Key", Config.Targets[0].APIKey.Header)
+	a.Len(Config.APIKeys, 1)
+	a.Equal(proxy.HashAPIKey("cron-key"), Config.APIKeys[0].Hash)
+	a.Panics(func() { Parse("test/invalid.yml") })
+}
+
+func (suite *ConfigTestSuite) TestValidate() {
+	a := assert.New(suite.T())
+	c, _, err := Load("test/invalid.yml")
+	a.NoError(err)
+	problems := Validate(c)
+	a.Len(problems.Errors(), 6)
+	fields := make([]string, 0, len(problems))
+	for _, p := range problems.Errors() {
+		fields = append(fields, p.Field)
+	}
+	a.Equal([]string{"targets[0].type", "targets[0].protocol", "targets[1].url", "targets[1].privileges.paths[0].regex", "targets[1].id", "tokenCache.ttl"}, fields)
+	a.Equal("generator", problems[0].Target)
+	_, _, err = Load("test/missing.yml")
+	a.Error(err)
 }
 
 func TestConfigTestSuite(t *testing.T) {
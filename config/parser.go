@@ -28,15 +28,49 @@ func Parse(path string) string {
 			"details": err.Error(),
 		}).Panicln("Could not read the configuration file")
 	}
-	if err = yaml.Unmarshal(file, &Config); err != nil {
+	var conf *Configuration
+	if conf, err = parse(file); err != nil {
 		log.WithFields(log.Fields{
 			"file":    path,
 			"details": err.Error(),
 		}).Panicln("Could not parse the configuration file")
 	}
+	problems := Validate(conf)
+	logProblems(path, problems)
+	if errs := problems.Errors(); len(errs) > 0 {
+		log.WithFields(log.Fields{
+			"file":    path,
+			"details": errs.Error(),
+		}).Panicln("Invalid configuration file")
+	}
+	Config = *conf
 	return string(file)
 }
 
+/*
+Load reads and parses the configuration file without modifying Config
+*/
+func Load(path string) (*Configuration, []byte, error) {
+	var file []byte
+	var err error
+	if file, err = ioutil.ReadFile(path); err != nil {
+		return nil, nil, err
+	}
+	var conf *Configuration
+	if conf, err = parse(file); err != nil {
+		return nil, file, err
+	}
+	return conf, file, nil
+}
+
+func parse(file []byte) (*Configuration, error) {
+	conf := new(Configuration)
+	if err := yaml.Unmarshal(file, conf); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
 /*
 ParseVer parses the version file into Ver
 */
@@ -0,0 +1,27 @@
+package config
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/mklimuk/api-proxy/proxy"
+)
+
+/*
+Validate checks the configuration and returns all problems found
+*/
+func Validate(conf *Configuration) proxy.Problems {
+	problems := proxy.ValidateTargets(conf.Targets, "targets")
+	problems = append(problems, proxy.ValidateAuth(conf.Auth, "auth")...)
+	problems = append(problems, proxy.ValidateAPIKeys(conf.APIKeys, "apiKeys")...)
+	return append(problems, proxy.ValidateTokenCache(conf.TokenCache, "tokenCache")...)
+}
+
+func logProblems(path string, problems proxy.Problems) {
+	for _, p := range problems {
+		clog := log.WithFields(log.Fields{"logger": "api-proxy.config", "file": path, "target": p.Target, "field": p.Field})
+		if p.Warning {
+			clog.Warn(p.Message)
+			continue
+		}
+		clog.Error(p.Message)
+	}
+}
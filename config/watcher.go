@@ -0,0 +1,96 @@
+package config
+
+import (
+	"bytes"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+//ReloadFunc applies a freshly parsed configuration; an error keeps the previous configuration active
+type ReloadFunc func(conf *Configuration) error
+
+//Watcher reloads the configuration file when its content changes or SIGHUP is received
+type Watcher struct {
+	path     string
+	interval time.Duration
+	apply    ReloadFunc
+	mu       sync.Mutex
+	// content of the last configuration file that was applied or rejected
+	last []byte
+	stop chan struct{}
+	once sync.Once
+}
+
+//NewWatcher is the configuration watcher constructor; content is the currently active configuration file
+func NewWatcher(path string, content []byte, interval time.Duration, apply ReloadFunc) *Watcher {
+	return &Watcher{path: path, interval: interval, apply: apply, last: content, stop: make(chan struct{})}
+}
+
+//Start polls the configuration file and listens for SIGHUP in the background
+func (w *Watcher) Start() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hup)
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				w.check(false)
+			case <-hup:
+				log.WithFields(log.Fields{"logger": "api-proxy.config", "file": w.path}).Info("Got SIGHUP, reloading configuration")
+				w.check(true)
+			case <-w.stop:
+				return
+			}
+		}
+	}()
+}
+
+//Stop stops watching the configuration file
+func (w *Watcher) Stop() {
+	w.once.Do(func() { close(w.stop) })
+}
+
+//Reload forces reloading of the configuration file
+func (w *Watcher) Reload() error {
+	return w.check(true)
+}
+
+func (w *Watcher) check(force bool) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	clog := log.WithFields(log.Fields{"logger": "api-proxy.config", "file": w.path})
+	conf, file, err := Load(w.path)
+	if file == nil && err != nil {
+		clog.WithError(err).Error("Could not read the configuration file, keeping the previous configuration")
+		return err
+	}
+	if !force && bytes.Equal(file, w.last) {
+		return nil
+	}
+	w.last = file
+	if err != nil {
+		clog.WithError(err).Error("Could not parse the configuration file, keeping the previous configuration")
+		return err
+	}
+	problems := Validate(conf)
+	logProblems(w.path, problems)
+	if errs := problems.Errors(); len(errs) > 0 {
+		clog.WithField("problems", len(errs)).Error("Invalid configuration file, keeping the previous configuration")
+		return errs
+	}
+	if err = w.apply(conf); err != nil {
+		clog.WithError(err).Error("Configuration rejected, keeping the previous configuration")
+		return err
+	}
+	Config = *conf
+	clog.Info("Configuration reloaded")
+	return nil
+}
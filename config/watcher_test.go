@@ -0,0 +1,83 @@
+package config
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+const reloaded = `targets:
+  -
+    type: single
+    id: generator
+    url: http://generator:8080
+    protocol: HTTP
+  -
+    type: pool
+    id: players
+    protocol: WS
+`
+
+type WatcherTestSuite struct {
+	suite.Suite
+	dir string
+}
+
+func (suite *WatcherTestSuite) SetupTest() {
+	suite.dir, _ = ioutil.TempDir("", "api-proxy")
+}
+
+func (suite *WatcherTestSuite) TearDownTest() {
+	os.RemoveAll(suite.dir)
+}
+
+func (suite *WatcherTestSuite) TestReload() {
+	a := assert.New(suite.T())
+	path := filepath.Join(suite.dir, "config.yml")
+	initial, _ := ioutil.ReadFile("test/config.yml")
+	a.NoError(ioutil.WriteFile(path, initial, 0644))
+	var applied *Configuration
+	reject := false
+	w := NewWatcher(path, initial, 0, func(c *Configuration) error {
+		if reject {
+			return errors.New("rejected")
+		}
+		applied = c
+		return nil
+	})
+	// unchanged file is not applied
+	a.NoError(w.check(false))
+	a.Nil(applied)
+	a.NoError(ioutil.WriteFile(path, []byte(reloaded), 0644))
+	a.NoError(w.check(false))
+	a.NotNil(applied)
+	a.Len(applied.Targets, 2)
+	a.Len(Config.Targets, 2)
+	// invalid files keep the previous configuration
+	applied = nil
+	a.NoError(ioutil.WriteFile(path, []byte("targets: [\n"), 0644))
+	a.Error(w.check(false))
+	a.Nil(applied)
+	a.Len(Config.Targets, 2)
+	// rejected configurations are not retried until the file changes again
+	reject = true
+	a.NoError(ioutil.WriteFile(path, initial, 0644))
+	a.Error(w.check(false))
+	a.NoError(w.check(false))
+	a.Len(Config.Targets, 2)
+	// forced reloads are always applied
+	reject = false
+	a.NoError(w.Reload())
+	a.Len(applied.Targets, 1)
+	os.Remove(path)
+	a.Error(w.Reload())
+}
+
+func TestWatcherTestSuite(t *testing.T) {
+	suite.Run(t, new(WatcherTestSuite))
+}
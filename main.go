@@ -3,7 +3,8 @@ package main
 import (
 	"fmt"
 	"net/http"
-	"net/url"
+	"os"
+	"time"
 
 	"github.com/mklimuk/api-proxy/api"
 	"github.com/mklimuk/api-proxy/config"
@@ -16,8 +17,9 @@ import (
 )
 
 const (
-	defaultLogLevel = "warn"
-	defaultConfig   = "/etc/husar/config.yml"
+	defaultLogLevel    = "warn"
+	defaultConfig      = "/etc/husar/config.yml"
+	configPollInterval = 5 * time.Second
 )
 
 func main() {
@@ -26,6 +28,14 @@ func main() {
 
 	level := util.GetEnv("LOG", defaultLogLevel)
 	conf := util.GetEnv("CONFIG", defaultConfig)
+	state := util.GetEnv("STATE", "")
+
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		if len(os.Args) > 2 {
+			conf = os.Args[2]
+		}
+		os.Exit(validate(conf))
+	}
 
 	var err error
 	var l log.Level
@@ -40,18 +50,61 @@ func main() {
 	clog.Info("Initializing services")
 	router := gin.New()
 
-	var authURL *url.URL
-
-	if authURL, err = url.Parse("http://auth:8080"); err != nil {
-		panic(err)
+	var keeper proxy.CachingGatekeeper
+	if keeper, err = proxy.NewRemoteGatekeeper(config.Config.Auth, config.Config.TokenCache); err != nil {
+		clog.WithError(err).Panic("Could not initialize auth service client")
+	}
+	if a := config.Config.Auth; a != nil && a.Mode == proxy.AuthModeJWT {
+		if keeper, err = proxy.NewLocalGatekeeper(a.JWT, keeper); err != nil {
+			clog.WithError(err).Panic("Could not initialize local token verification")
+		}
+	}
+	var keys proxy.APIKeyStore
+	if keys, err = proxy.NewAPIKeyStore(config.Config.APIKeys); err != nil {
+		clog.WithError(err).Panic("Could not load API keys")
+	}
+	keeper = keys.Wrap(keeper)
+	proxy.DenyUnprotected(config.Config.DenyUnprotected)
+	var rp proxy.TargetsManager
+	if state != "" {
+		rp = proxy.NewPersistentTargetsManager(config.Config.Targets, keeper, proxy.NewFileStore(state))
+	} else {
+		rp = proxy.NewTargetsManager(config.Config.Targets, keeper)
 	}
-	keeper := proxy.NewGatekeeper(authURL)
-	rp := proxy.NewTargetsManager(config.Config.Targets, keeper)
+
+	// only targets and the default policy are reloaded; the gatekeeper settings and API keys are loaded once at startup
+	watcher := config.NewWatcher(conf, []byte(rawConf), configPollInterval, func(c *config.Configuration) error {
+		if err := rp.Reload(c.Targets); err != nil {
+			return err
+		}
+		proxy.DenyUnprotected(c.DenyUnprotected)
+		return nil
+	})
+	watcher.Start()
 
 	clog.Info("Initializing REST router...")
 	p := api.NewProxyAPI(rp)
-	c := api.NewControlAPI()
+	c := api.NewControlAPI(rp, keeper, keys)
 	p.AddRoutes(router)
 	c.AddRoutes(router)
 	clog.Fatal(http.ListenAndServe(":8080", router))
 }
+
+//validate checks the configuration file, prints all problems found and returns the process exit code
+func validate(path string) int {
+	c, _, err := config.Load(path)
+	if err != nil {
+		fmt.Printf("%s: %s\n", path, err.Error())
+		return 1
+	}
+	problems := config.Validate(c)
+	for _, p := range problems {
+		fmt.Println(p.String())
+	}
+	if len(problems.Errors()) > 0 {
+		fmt.Printf("%s: %d error(s), %d warning(s)\n", path, len(problems.Errors()), len(problems.Warnings()))
+		return 1
+	}
+	fmt.Printf("%s: configuration is valid\n", path)
+	return 0
+}
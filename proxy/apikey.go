@@ -0,0 +1,239 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/mklimuk/goerr"
+)
+
+const (
+	defaultAPIKeyHeader = "X-API-Key"
+	generatedKeyBytes   = 32
+)
+
+//APIKeyAuth enables API key authentication for a target. Keys are read from Header or the Query parameter;
+//the X-API-Key header is used if neither is set. Requests without a key are checked with the bearer token.
+type APIKeyAuth struct {
+	Header string `yaml:"header" json:"header,omitempty"`
+	Query  string `yaml:"query" json:"query,omitempty"`
+}
+
+func (a *APIKeyAuth) header() string {
+	if a.Header == "" && a.Query == "" {
+		return defaultAPIKeyHeader
+	}
+	return a.Header
+}
+
+//extract returns the API key sent with the request; an empty string if there is none or API keys are disabled
+func (a *APIKeyAuth) extract(r *http.Request) string {
+	if a == nil {
+		return ""
+	}
+	if h := a.header(); h != "" {
+		if key := r.Header.Get(h); key != "" {
+			return key
+		}
+	}
+	if a.Query != "" {
+		return r.URL.Query().Get(a.Query)
+	}
+	return ""
+}
+
+//strip removes the API key from the request so that it is not passed to the upstream
+func (a *APIKeyAuth) strip(r *http.Request) {
+	if a == nil {
+		return
+	}
+	if h := a.header(); h != "" {
+		r.Header.Del(h)
+	}
+	if a.Query != "" {
+		q := r.URL.Query()
+		if _, present := q[a.Query]; present {
+			q.Del(a.Query)
+			r.URL.RawQuery = q.Encode()
+		}
+	}
+}
+
+//APIKey grants its bearer the permissions, roles and scopes of a token. Only the SHA-256 hash of the key is stored.
+type APIKey struct {
+	ID   string `yaml:"id" json:"id"`
+	Hash string `yaml:"hash" json:"hash,omitempty"`
+	// Key is the plain key; it is only accepted and returned by the control API when the key is added
+	Key         string   `yaml:"-" json:"key,omitempty"`
+	Permissions int      `yaml:"permissions" json:"permissions"`
+	Roles       []string `yaml:"roles" json:"roles,omitempty"`
+	Scopes      []string `yaml:"scopes" json:"scopes,omitempty"`
+	// Targets restricts the key to the given targets; the key is valid for all targets using API keys if empty
+	Targets []string `yaml:"targets" json:"targets,omitempty"`
+}
+
+//HashAPIKey returns the hex encoded SHA-256 hash of a key as expected in the configuration
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func validHash(hash string) bool {
+	b, err := hex.DecodeString(hash)
+	return err == nil && len(b) == sha256.Size
+}
+
+func (k *APIKey) allows(target string) bool {
+	if len(k.Targets) == 0 {
+		return true
+	}
+	for _, t := range k.Targets {
+		if t == target {
+			return true
+		}
+	}
+	return false
+}
+
+func (k *APIKey) identity() *Identity {
+	return &Identity{Username: k.ID, Permissions: k.Permissions, Roles: k.Roles, Scopes: k.Scopes}
+}
+
+//APIKeyControl manages API keys at runtime; keys added this way are kept in memory only
+type APIKeyControl interface {
+	//Keys lists all keys without their hashes
+	Keys() []APIKey
+	//AddKey registers a key given as a plain key or a hash; a random key is generated if neither is set and returned in the Key field
+	AddKey(key APIKey) (APIKey, error)
+	//RemoveKey removes a key and reports whether it existed
+	RemoveKey(ID string) bool
+}
+
+//APIKeyStore holds API keys and checks them on behalf of targets
+type APIKeyStore interface {
+	APIKeyControl
+	//Wrap adds API key checks to a gatekeeper
+	Wrap(next CachingGatekeeper) CachingGatekeeper
+}
+
+type apiKeyStore struct {
+	mu     sync.RWMutex
+	byID   map[string]*APIKey
+	byHash map[string]*APIKey
+}
+
+//NewAPIKeyStore creates a key store with the configured keys
+func NewAPIKeyStore(keys []*APIKey) (APIKeyStore, error) {
+	s := &apiKeyStore{byID: make(map[string]*APIKey), byHash: make(map[string]*APIKey)}
+	for _, k := range keys {
+		if k == nil {
+			continue
+		}
+		if _, err := s.AddKey(*k); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *apiKeyStore) Keys() []APIKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ids := make([]string, 0, len(s.byID))
+	for id := range s.byID {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	res := make([]APIKey, len(ids))
+	for i, id := range ids {
+		res[i] = *s.byID[id]
+		res[i].Hash = ""
+	}
+	return res
+}
+
+func (s *apiKeyStore) AddKey(key APIKey) (APIKey, error) {
+	if key.ID == "" {
+		return key, goerr.NewError("API key ID is required", goerr.BadRequest)
+	}
+	switch {
+	case key.Key != "":
+		key.Hash = HashAPIKey(key.Key)
+	case key.Hash == "":
+		b := make([]byte, generatedKeyBytes)
+		if _, err := rand.Read(b); err != nil {
+			return key, err
+		}
+		key.Key = hex.EncodeToString(b)
+		key.Hash = HashAPIKey(key.Key)
+	case !validHash(key.Hash):
+		return key, goerr.NewError("API key hash must be a hex encoded SHA-256 hash", goerr.BadRequest)
+	}
+	stored := key
+	stored.Key = ""
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.byID[key.ID]; exists {
+		return key, goerr.NewError("API key with this ID already exists", Conflict)
+	}
+	if _, exists := s.byHash[key.Hash]; exists {
+		return key, goerr.NewError("API key is already registered", Conflict)
+	}
+	s.byID[stored.ID] = &stored
+	s.byHash[stored.Hash] = &stored
+	log.WithFields(log.Fields{"logger": "api-proxy.apikey", "method": "AddKey", "key": key.ID}).
+		Info("API key added")
+	return key, nil
+}
+
+func (s *apiKeyStore) RemoveKey(ID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, exists := s.byID[ID]
+	if !exists {
+		return false
+	}
+	delete(s.byID, ID)
+	delete(s.byHash, k.Hash)
+	log.WithFields(log.Fields{"logger": "api-proxy.apikey", "method": "RemoveKey", "key": ID}).
+		Info("API key removed")
+	return true
+}
+
+func (s *apiKeyStore) Wrap(next CachingGatekeeper) CachingGatekeeper {
+	return &keyKeeper{CachingGatekeeper: next, keys: s}
+}
+
+func (s *apiKeyStore) find(key string) (APIKey, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	k, found := s.byHash[HashAPIKey(key)]
+	if !found {
+		return APIKey{}, false
+	}
+	return *k, true
+}
+
+//keyKeeper checks API keys and passes tokens to the wrapped gatekeeper
+type keyKeeper struct {
+	CachingGatekeeper
+	keys *apiKeyStore
+}
+
+func (k *keyKeeper) CheckKey(key, target string, req Requirement) (*Identity, error) {
+	var found APIKey
+	var ok bool
+	if found, ok = k.keys.find(key); !ok {
+		return nil, goerr.NewError("Invalid API key", goerr.Unauthorized)
+	}
+	if !found.allows(target) {
+		return nil, goerr.NewError("API key is not valid for this target", Forbidden)
+	}
+	id := found.identity()
+	return id, req.check(id)
+}
@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/mklimuk/goerr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type APIKeyTestSuite struct {
+	suite.Suite
+}
+
+func (suite *APIKeyTestSuite) TestStore() {
+	a := assert.New(suite.T())
+	s, err := NewAPIKeyStore([]*APIKey{
+		&APIKey{ID: "cron", Hash: HashAPIKey("cron-key"), Permissions: 10, Roles: []string{"batch"}},
+		&APIKey{ID: "billing", Hash: HashAPIKey("billing-key"), Permissions: 50, Targets: []string{"billing"}},
+	})
+	a.NoError(err)
+	gatekeeper := s.Wrap(CachingGatekeeper(&keeper{}))
+
+	id, err := gatekeeper.CheckKey("cron-key", "users", Requirement{Privileges: 10})
+	a.NoError(err)
+	a.Equal("cron", id.Username)
+	a.Equal([]string{"batch"}, id.Roles)
+	id, err = gatekeeper.CheckKey("cron-key", "users", Requirement{Privileges: 20})
+	a.Equal(Forbidden, goerr.GetType(err))
+	a.Equal(10, id.Permissions)
+	_, err = gatekeeper.CheckKey("cron-key", "users", Requirement{Roles: &Match{AnyOf: []string{"admin"}}})
+	a.Error(err)
+	_, err = gatekeeper.CheckKey("billing-key", "users", Requirement{})
+	a.Equal(Forbidden, goerr.GetType(err))
+	_, err = gatekeeper.CheckKey("billing-key", "billing", Requirement{Privileges: 50})
+	a.NoError(err)
+	id, err = gatekeeper.CheckKey("unknown", "users", Requirement{})
+	a.Nil(id)
+	a.Equal(goerr.Unauthorized, goerr.GetType(err))
+
+	keys := s.Keys()
+	a.Len(keys, 2)
+	a.Equal("billing", keys[0].ID)
+	a.Empty(keys[0].Hash)
+
+	_, err = NewAPIKeyStore([]*APIKey{&APIKey{ID: "bad", Hash: "not-a-hash"}})
+	a.Equal(goerr.BadRequest, goerr.GetType(err))
+}
+
+func (suite *APIKeyTestSuite) TestAddRemove() {
+	a := assert.New(suite.T())
+	s, _ := NewAPIKeyStore(nil)
+	k, err := s.AddKey(APIKey{ID: "generated", Permissions: 5})
+	a.NoError(err)
+	a.Len(k.Key, 2*generatedKeyBytes)
+	a.Equal(HashAPIKey(k.Key), k.Hash)
+	k, err = s.AddKey(APIKey{ID: "plain", Key: "secret"})
+	a.NoError(err)
+	a.Equal(HashAPIKey("secret"), k.Hash)
+	_, err = s.AddKey(APIKey{ID: "plain", Key: "other"})
+	a.Equal(Conflict, goerr.GetType(err))
+	_, err = s.AddKey(APIKey{ID: "copy", Hash: HashAPIKey("secret")})
+	a.Equal(Conflict, goerr.GetType(err))
+	_, err = s.AddKey(APIKey{Key: "secret"})
+	a.Equal(goerr.BadRequest, goerr.GetType(err))
+	gatekeeper := s.Wrap(CachingGatekeeper(&keeper{}))
+	_, err = gatekeeper.CheckKey("secret", "any", Requirement{})
+	a.NoError(err)
+	a.True(s.RemoveKey("plain"))
+	a.False(s.RemoveKey("plain"))
+	_, err = gatekeeper.CheckKey("secret", "any", Requirement{})
+	a.Error(err)
+	a.Len(s.Keys(), 1)
+}
+
+func (suite *APIKeyTestSuite) TestExtract() {
+	a := assert.New(suite.T())
+	r, _ := http.NewRequest(http.MethodGet, "http://test.com/users?api_key=fromQuery&page=2", nil)
+	var disabled *APIKeyAuth
+	a.Empty(disabled.extract(r))
+	def := &APIKeyAuth{}
+	a.Empty(def.extract(r))
+	r.Header.Set(defaultAPIKeyHeader, "fromHeader")
+	a.Equal("fromHeader", def.extract(r))
+	query := &APIKeyAuth{Query: "api_key"}
+	a.Equal("fromQuery", query.extract(r))
+	both := &APIKeyAuth{Header: "X-Service-Key", Query: "api_key"}
+	a.Equal("fromQuery", both.extract(r))
+	r.Header.Set("X-Service-Key", "custom")
+	a.Equal("custom", both.extract(r))
+	both.strip(r)
+	a.Empty(r.Header.Get("X-Service-Key"))
+	a.Equal("fromHeader", r.Header.Get(defaultAPIKeyHeader))
+	a.Equal("page=2", r.URL.RawQuery)
+}
+
+func TestAPIKeyTestSuite(t *testing.T) {
+	suite.Run(t, new(APIKeyTestSuite))
+}
@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/mklimuk/goerr"
+)
+
+//PermissionMode defines how the permissions claim is compared with required privileges
+type PermissionMode string
+
+// permission modes
+const (
+	// PermissionLevel treats privileges as an ordered level, the permissions claim must be greater or equal
+	PermissionLevel PermissionMode = "level"
+	// PermissionBitmask treats privileges as bits which have to be set in the permissions claim
+	PermissionBitmask PermissionMode = "bitmask"
+)
+
+// bit matching in bitmask mode
+const (
+	BitsAll = "all"
+	BitsAny = "any"
+)
+
+//Match lists names of which any or all have to be granted to the token bearer
+type Match struct {
+	AnyOf []string `yaml:"anyOf" json:"anyOf,omitempty"`
+	AllOf []string `yaml:"allOf" json:"allOf,omitempty"`
+}
+
+func (m *Match) empty() bool {
+	return m == nil || (len(m.AnyOf) == 0 && len(m.AllOf) == 0)
+}
+
+func (m *Match) matches(granted []string) bool {
+	if m.empty() {
+		return true
+	}
+	set := make(map[string]bool, len(granted))
+	for _, g := range granted {
+		set[g] = true
+	}
+	for _, name := range m.AllOf {
+		if !set[name] {
+			return false
+		}
+	}
+	if len(m.AnyOf) == 0 {
+		return true
+	}
+	for _, name := range m.AnyOf {
+		if set[name] {
+			return true
+		}
+	}
+	return false
+}
+
+//Requirement describes what a token has to grant to access a path; the integer privilege level is compared with the permissions claim
+type Requirement struct {
+	Privileges int            `json:"privileges"`
+	Mode       PermissionMode `json:"mode,omitempty"`
+	// Bits is either all (default) or any of the privileges bits in bitmask mode
+	Bits   string `json:"bits,omitempty"`
+	Roles  *Match `json:"roles,omitempty"`
+	Scopes *Match `json:"scopes,omitempty"`
+	// Deny rejects all requests regardless of their credentials
+	Deny bool `json:"deny,omitempty"`
+}
+
+//Anonymous reports whether the requirement can be met without a token
+func (r Requirement) Anonymous() bool {
+	return !r.Deny && r.Privileges <= 0 && r.Roles.empty() && r.Scopes.empty()
+}
+
+//check returns a forbidden error if the identity does not meet the requirement
+func (r Requirement) check(id *Identity) error {
+	if r.Deny {
+		return goerr.NewError("Access denied", Forbidden)
+	}
+	if !r.permits(id.Permissions) {
+		return goerr.NewError("Too low privileges", Forbidden)
+	}
+	if !r.Roles.matches(id.Roles) {
+		return goerr.NewError("Missing required role", Forbidden)
+	}
+	if !r.Scopes.matches(id.Scopes) {
+		return goerr.NewError("Missing required scope", Forbidden)
+	}
+	return nil
+}
+
+func (r Requirement) permits(permissions int) bool {
+	if r.Privileges <= 0 {
+		return true
+	}
+	if r.Mode != PermissionBitmask {
+		return permissions >= r.Privileges
+	}
+	if r.Bits == BitsAny {
+		return permissions&r.Privileges != 0
+	}
+	return permissions&r.Privileges == r.Privileges
+}
+
+//Identity describes the bearer of a checked token
+type Identity struct {
+	// Token is the checked token, updated by the auth service if requested
+	Token       string   `json:"-"`
+	Username    string   `json:"username,omitempty"`
+	Name        string   `json:"name,omitempty"`
+	Permissions int      `json:"permissions"`
+	Roles       []string `json:"roles,omitempty"`
+	Scopes      []string `json:"scopes,omitempty"`
+	// Expires is the expiry time of the token; zero if unknown
+	Expires time.Time `json:"-"`
+}
+
+func (c claims) identity(token string) *Identity {
+	id := &Identity{Token: token, Username: c.Username, Name: c.Name, Permissions: c.Permissions, Roles: c.Roles, Scopes: c.Scope}
+	if c.Expires != nil {
+		id.Expires = unixTime(*c.Expires)
+	}
+	return id
+}
+
+//anonymousAccess is the check result for requests without a token
+func anonymousAccess(req Requirement) (*Identity, error) {
+	if !req.Anonymous() {
+		return nil, goerr.NewError("Authorization token required but not present", goerr.Unauthorized)
+	}
+	return &Identity{}, nil
+}
+
+//scopeList is an OAuth scope claim, either a space delimited string or a list of strings
+type scopeList []string
+
+func (s *scopeList) UnmarshalJSON(b []byte) error {
+	var joined string
+	if err := json.Unmarshal(b, &joined); err == nil {
+		*s = strings.Fields(joined)
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		return err
+	}
+	*s = list
+	return nil
+}
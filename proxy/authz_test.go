@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/mklimuk/goerr"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type AuthzTestSuite struct {
+	suite.Suite
+}
+
+func (suite *AuthzTestSuite) TestMatch() {
+	a := assert.New(suite.T())
+	var m *Match
+	a.True(m.matches(nil))
+	a.True((&Match{}).matches(nil))
+	m = &Match{AnyOf: []string{"a", "b"}}
+	a.True(m.matches([]string{"b"}))
+	a.False(m.matches([]string{"c"}))
+	a.False(m.matches(nil))
+	m = &Match{AllOf: []string{"a", "b"}}
+	a.True(m.matches([]string{"b", "c", "a"}))
+	a.False(m.matches([]string{"a"}))
+	m = &Match{AnyOf: []string{"x", "y"}, AllOf: []string{"a"}}
+	a.True(m.matches([]string{"a", "y"}))
+	a.False(m.matches([]string{"a"}))
+	a.False(m.matches([]string{"x"}))
+}
+
+func (suite *AuthzTestSuite) TestRequirement() {
+	a := assert.New(suite.T())
+	a.True(Requirement{}.Anonymous())
+	a.False(Requirement{Privileges: 1}.Anonymous())
+	a.False(Requirement{Scopes: &Match{AnyOf: []string{"read"}}}.Anonymous())
+	a.True(Requirement{Roles: &Match{}}.Anonymous())
+	a.False(Requirement{Deny: true}.Anonymous())
+	id := &Identity{Permissions: 5, Roles: []string{"admin"}, Scopes: []string{"read"}}
+	a.NoError(Requirement{Privileges: 5, Roles: &Match{AnyOf: []string{"admin"}}}.check(id))
+	err := Requirement{Privileges: 6}.check(id)
+	a.Equal(Forbidden, goerr.GetType(err))
+	a.Error(Requirement{Roles: &Match{AllOf: []string{"admin", "root"}}}.check(id))
+	a.Error(Requirement{Scopes: &Match{AnyOf: []string{"write"}}}.check(id))
+	err = Requirement{Deny: true}.check(id)
+	a.Equal(Forbidden, goerr.GetType(err))
+	_, err = anonymousAccess(Requirement{Roles: &Match{AnyOf: []string{"admin"}}})
+	a.Error(err)
+	id, err = anonymousAccess(Requirement{})
+	a.NoError(err)
+	a.NotNil(id)
+}
+
+func (suite *AuthzTestSuite) TestScopeClaim() {
+	a := assert.New(suite.T())
+	c := claims{}
+	a.NoError(json.Unmarshal([]byte(`{"scope":"read  write"}`), &c))
+	a.Equal([]string{"read", "write"}, []string(c.Scope))
+	c = claims{}
+	a.NoError(json.Unmarshal([]byte(`{"scope":["read","write"],"roles":["admin"]}`), &c))
+	a.Equal([]string{"read", "write"}, []string(c.Scope))
+	a.Equal([]string{"admin"}, c.identity("t").Roles)
+	a.Error(json.Unmarshal([]byte(`{"scope":5}`), &c))
+}
+
+func TestAuthzTestSuite(t *testing.T) {
+	suite.Run(t, new(AuthzTestSuite))
+}
@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//Strategy defines how requests are distributed among pool members
+type Strategy string
+
+//Load balancing strategies
+const (
+	// StrategyAddressed expects the member ID as the first path segment (/api/:id/:memberId/*path)
+	StrategyAddressed  Strategy = "addressed"
+	StrategyRoundRobin Strategy = "round-robin"
+	StrategyLeastConn  Strategy = "least-connections"
+	StrategyRandom     Strategy = "random"
+	StrategyWeighted   Strategy = "weighted"
+)
+
+//balancer picks a member that should serve the next request
+type balancer interface {
+	next(members []*member) *member
+}
+
+func newBalancer(s Strategy) (balancer, error) {
+	switch s {
+	case StrategyRoundRobin:
+		return &roundRobin{}, nil
+	case StrategyLeastConn:
+		return &leastConn{}, nil
+	case StrategyRandom:
+		return &random{rnd: rand.New(rand.NewSource(time.Now().UnixNano()))}, nil
+	case StrategyWeighted:
+		return &weighted{current: make(map[*member]int)}, nil
+	case StrategyAddressed, "":
+		// addressed pools route by the ID found in the request path
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unknown load balancing strategy '%s'", s)
+}
+
+type roundRobin struct {
+	counter uint64
+}
+
+func (b *roundRobin) next(members []*member) *member {
+	if len(members) == 0 {
+		return nil
+	}
+	n := atomic.AddUint64(&b.counter, 1) - 1
+	return members[n%uint64(len(members))]
+}
+
+type leastConn struct {
+	roundRobin
+}
+
+func (b *leastConn) next(members []*member) *member {
+	if len(members) == 0 {
+		return nil
+	}
+	// start from a rotating offset so that ties are spread evenly
+	start := int(atomic.AddUint64(&b.counter, 1) % uint64(len(members)))
+	best := members[start]
+	for i := 1; i < len(members); i++ {
+		m := members[(start+i)%len(members)]
+		if m.activeRequests() < best.activeRequests() {
+			best = m
+		}
+	}
+	return best
+}
+
+type random struct {
+	mu  sync.Mutex
+	rnd *rand.Rand
+}
+
+func (b *random) next(members []*member) *member {
+	if len(members) == 0 {
+		return nil
+	}
+	b.mu.Lock()
+	i := b.rnd.Intn(len(members))
+	b.mu.Unlock()
+	return members[i]
+}
+
+//weighted implements the smooth weighted round robin algorithm
+type weighted struct {
+	mu      sync.Mutex
+	current map[*member]int
+}
+
+func (b *weighted) next(members []*member) *member {
+	if len(members) == 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var best *member
+	total := 0
+	for _, m := range members {
+		b.current[m] += m.weight
+		total += m.weight
+		if best == nil || b.current[m] > b.current[best] {
+			best = m
+		}
+	}
+	b.current[best] -= total
+	// forget members that are not part of the pool anymore
+	if len(b.current) > len(members) {
+		present := make(map[*member]int, len(members))
+		for _, m := range members {
+			present[m] = b.current[m]
+		}
+		b.current = present
+	}
+	return best
+}
@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type BalancerTestSuite struct {
+	suite.Suite
+	members []*member
+}
+
+func (suite *BalancerTestSuite) SetupTest() {
+	f := &fakeHandler{}
+	suite.members = []*member{
+		newMember("m1", nil, 0, f),
+		newMember("m2", nil, 0, f),
+		newMember("m3", nil, 0, f),
+	}
+}
+
+func (suite *BalancerTestSuite) TestConstructor() {
+	a := assert.New(suite.T())
+	b, err := newBalancer("")
+	a.NoError(err)
+	a.Nil(b)
+	b, err = newBalancer(StrategyAddressed)
+	a.NoError(err)
+	a.Nil(b)
+	for _, s := range []Strategy{StrategyRoundRobin, StrategyLeastConn, StrategyRandom, StrategyWeighted} {
+		b, err = newBalancer(s)
+		a.NoError(err)
+		a.NotNil(b)
+	}
+	_, err = newBalancer("sticky")
+	a.Error(err)
+}
+
+func (suite *BalancerTestSuite) TestEmpty() {
+	a := assert.New(suite.T())
+	for _, s := range []Strategy{StrategyRoundRobin, StrategyLeastConn, StrategyRandom, StrategyWeighted} {
+		b, _ := newBalancer(s)
+		a.Nil(b.next([]*member{}))
+	}
+}
+
+func (suite *BalancerTestSuite) TestRoundRobin() {
+	a := assert.New(suite.T())
+	b, _ := newBalancer(StrategyRoundRobin)
+	a.Equal("m1", b.next(suite.members).id)
+	a.Equal("m2", b.next(suite.members).id)
+	a.Equal("m3", b.next(suite.members).id)
+	a.Equal("m1", b.next(suite.members).id)
+}
+
+func (suite *BalancerTestSuite) TestLeastConn() {
+	a := assert.New(suite.T())
+	b, _ := newBalancer(StrategyLeastConn)
+	suite.members[0].active = 3
+	suite.members[1].active = 1
+	suite.members[2].active = 2
+	for i := 0; i < 3; i++ {
+		a.Equal("m2", b.next(suite.members).id)
+	}
+	suite.members[2].active = 0
+	a.Equal("m3", b.next(suite.members).id)
+}
+
+func (suite *BalancerTestSuite) TestRandom() {
+	a := assert.New(suite.T())
+	b, _ := newBalancer(StrategyRandom)
+	seen := make(map[string]int)
+	for i := 0; i < 300; i++ {
+		seen[b.next(suite.members).id]++
+	}
+	a.Len(seen, 3)
+}
+
+func (suite *BalancerTestSuite) TestWeighted() {
+	a := assert.New(suite.T())
+	b, _ := newBalancer(StrategyWeighted)
+	suite.members[0].weight = 5
+	suite.members[1].weight = 1
+	suite.members[2].weight = 1
+	seen := make(map[string]int)
+	for i := 0; i < 70; i++ {
+		seen[b.next(suite.members).id]++
+	}
+	a.Equal(50, seen["m1"])
+	a.Equal(10, seen["m2"])
+	a.Equal(10, seen["m3"])
+	// removed members are forgotten
+	b.next(suite.members[:1])
+	a.Len(b.(*weighted).current, 1)
+}
+
+func TestBalancerTestSuite(t *testing.T) {
+	suite.Run(t, new(BalancerTestSuite))
+}
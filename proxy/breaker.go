@@ -0,0 +1,182 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+//BreakerState enumerates circuit breaker states
+type BreakerState string
+
+//Circuit breaker states
+const (
+	BreakerClosed   BreakerState = "closed"
+	BreakerOpen     BreakerState = "open"
+	BreakerHalfOpen BreakerState = "half-open"
+)
+
+const (
+	defaultBreakerThreshold = 5
+	defaultOpenDuration     = 30 * time.Second
+	defaultHalfOpenProbes   = 1
+)
+
+// CircuitBreaker defines passive outlier detection settings of a target
+type CircuitBreaker struct {
+	// Threshold is the number of consecutive 5xx responses or transport errors opening the circuit
+	Threshold int `yaml:"threshold" json:"threshold"`
+	// OpenDuration is the time the circuit stays open before probe requests are let through
+	OpenDuration string `yaml:"openDuration" json:"openDuration"`
+	// HalfOpenProbes is the number of successful probe requests needed to close the circuit
+	HalfOpenProbes int `yaml:"halfOpenProbes" json:"halfOpenProbes"`
+}
+
+func (c *CircuitBreaker) threshold() int {
+	if c.Threshold <= 0 {
+		return defaultBreakerThreshold
+	}
+	return c.Threshold
+}
+
+func (c *CircuitBreaker) openDuration() time.Duration {
+	return parseDuration(c.OpenDuration, defaultOpenDuration)
+}
+
+func (c *CircuitBreaker) halfOpenProbes() int {
+	if c.HalfOpenProbes <= 0 {
+		return defaultHalfOpenProbes
+	}
+	return c.HalfOpenProbes
+}
+
+//breaker guards a single upstream; a nil breaker lets every request through
+type breaker struct {
+	conf     *CircuitBreaker
+	target   string
+	member   string
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	// number of half-open probe requests in flight and their consecutive successes
+	probing   int
+	successes int
+	// generation changes on each transition so that late results of older requests are ignored
+	generation uint64
+	now        func() time.Time
+}
+
+func newBreaker(target, member string, conf *CircuitBreaker) *breaker {
+	if conf == nil {
+		return nil
+	}
+	return &breaker{conf: conf, target: target, member: member, state: BreakerClosed, now: time.Now}
+}
+
+//available tells whether the upstream may currently receive traffic without reserving a probe slot
+func (b *breaker) available() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		return b.now().Sub(b.openedAt) >= b.conf.openDuration()
+	case BreakerHalfOpen:
+		return b.probing < b.conf.halfOpenProbes()
+	}
+	return true
+}
+
+//acquire checks whether a request may be sent upstream; the result must be reported with done or release
+func (b *breaker) acquire() (uint64, bool) {
+	if b == nil {
+		return 0, true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerClosed:
+		return b.generation, true
+	case BreakerOpen:
+		if b.now().Sub(b.openedAt) < b.conf.openDuration() {
+			return b.generation, false
+		}
+		b.transition(BreakerHalfOpen)
+	}
+	if b.probing >= b.conf.halfOpenProbes() {
+		return b.generation, false
+	}
+	b.probing++
+	return b.generation, true
+}
+
+//done reports the outcome of a request allowed by acquire
+func (b *breaker) done(generation uint64, success bool) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if generation != b.generation {
+		return
+	}
+	switch b.state {
+	case BreakerClosed:
+		if success {
+			b.failures = 0
+			return
+		}
+		b.failures++
+		if b.failures >= b.conf.threshold() {
+			b.transition(BreakerOpen)
+		}
+	case BreakerHalfOpen:
+		b.probing--
+		if !success {
+			b.transition(BreakerOpen)
+			return
+		}
+		b.successes++
+		if b.successes >= b.conf.halfOpenProbes() {
+			b.transition(BreakerClosed)
+		}
+	}
+}
+
+//release gives back the slot of a request allowed by acquire which was not sent upstream; no outcome is recorded
+func (b *breaker) release(generation uint64) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if generation == b.generation && b.state == BreakerHalfOpen {
+		b.probing--
+	}
+}
+
+func (b *breaker) transition(to BreakerState) {
+	log.WithFields(log.Fields{"logger": "api-proxy.breaker", "target": b.target, "member": b.member, "from": b.state, "to": to, "failures": b.failures}).
+		Warn("Circuit breaker state changed")
+	b.state = to
+	b.failures = 0
+	b.probing = 0
+	b.successes = 0
+	b.generation++
+	if to == BreakerOpen {
+		b.openedAt = b.now()
+	}
+}
+
+func (b *breaker) current() BreakerState {
+	if b == nil {
+		return ""
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
@@ -0,0 +1,253 @@
+package proxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type BreakerTestSuite struct {
+	suite.Suite
+	now time.Time
+}
+
+func (suite *BreakerTestSuite) SetupSuite() {
+	log.SetLevel(log.DebugLevel)
+}
+
+func (suite *BreakerTestSuite) newBreaker(conf *CircuitBreaker) *breaker {
+	suite.now = time.Now()
+	b := newBreaker("t", "m", conf)
+	b.now = func() time.Time { return suite.now }
+	return b
+}
+
+func (suite *BreakerTestSuite) TestNil() {
+	a := assert.New(suite.T())
+	var b *breaker
+	a.Nil(newBreaker("t", "m", nil))
+	a.True(b.available())
+	_, ok := b.acquire()
+	a.True(ok)
+	b.done(0, false)
+	b.release(0)
+	a.Equal(BreakerState(""), b.current())
+}
+
+func (suite *BreakerTestSuite) TestTransitions() {
+	a := assert.New(suite.T())
+	b := suite.newBreaker(&CircuitBreaker{Threshold: 2, OpenDuration: "10s", HalfOpenProbes: 2})
+	g, ok := b.acquire()
+	a.True(ok)
+	b.done(g, false)
+	b.done(g, true)
+	b.done(g, false)
+	a.Equal(BreakerClosed, b.current())
+	b.done(g, false)
+	a.Equal(BreakerOpen, b.current())
+	// results of requests started before the circuit opened are ignored
+	b.done(g, true)
+	a.False(b.available())
+	_, ok = b.acquire()
+	a.False(ok)
+	suite.now = suite.now.Add(10 * time.Second)
+	a.True(b.available())
+	g1, ok := b.acquire()
+	a.True(ok)
+	a.Equal(BreakerHalfOpen, b.current())
+	g2, ok := b.acquire()
+	a.True(ok)
+	_, ok = b.acquire()
+	a.False(ok)
+	a.False(b.available())
+	b.done(g1, true)
+	a.Equal(BreakerHalfOpen, b.current())
+	b.done(g2, true)
+	a.Equal(BreakerClosed, b.current())
+}
+
+func (suite *BreakerTestSuite) TestHalfOpenFailure() {
+	a := assert.New(suite.T())
+	b := suite.newBreaker(&CircuitBreaker{Threshold: 1})
+	g, _ := b.acquire()
+	b.done(g, false)
+	a.Equal(BreakerOpen, b.current())
+	suite.now = suite.now.Add(defaultOpenDuration)
+	g, ok := b.acquire()
+	a.True(ok)
+	b.done(g, false)
+	a.Equal(BreakerOpen, b.current())
+	a.False(b.available())
+}
+
+func (suite *BreakerTestSuite) TestRelease() {
+	a := assert.New(suite.T())
+	b := suite.newBreaker(&CircuitBreaker{Threshold: 1})
+	g, _ := b.acquire()
+	b.done(g, false)
+	suite.now = suite.now.Add(defaultOpenDuration)
+	g, ok := b.acquire()
+	a.True(ok)
+	a.False(b.available())
+	// a probe which was not sent upstream frees its slot without closing the circuit
+	b.release(g)
+	a.Equal(BreakerHalfOpen, b.current())
+	a.True(b.available())
+	g, ok = b.acquire()
+	a.True(ok)
+	b.done(g, true)
+	a.Equal(BreakerClosed, b.current())
+}
+
+func (suite *BreakerTestSuite) TestFastFail() {
+	a := assert.New(suite.T())
+	calls := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		calls++
+		res.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer upstream.Close()
+	k := &GatekeeperMock{}
+	k.On("CheckAccess", "", Requirement{}, false).Return(&Identity{Token: ""}, nil)
+	c := &TargetConfig{Privileges: &Privileges{}, TID: "s", URL: upstream.URL, TargetType: TypeSingle, TargetProtocol: ProtocolHTTP, CircuitBreaker: &CircuitBreaker{Threshold: 2}}
+	c.keeper = k
+	s, err := NewSingle(c)
+	a.NoError(err)
+	router := gin.New()
+	router.GET("/api/:id/*path", s.Handler())
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest(http.MethodGet, "/api/s/test", nil)
+		res := serve(router, req)
+		if i < 2 {
+			a.Equal(http.StatusInternalServerError, res.Code)
+		} else {
+			a.Equal(http.StatusServiceUnavailable, res.Code)
+			a.Contains(res.Body.String(), "circuit breaker is open")
+		}
+	}
+	a.Equal(2, calls)
+	a.Equal(BreakerOpen, s.Health()[0].Circuit)
+	// requests rejected by the open circuit are not authorized
+	k.AssertNumberOfCalls(suite.T(), "CheckAccess", 2)
+}
+
+func (suite *BreakerTestSuite) TestAbortedProbe() {
+	a := assert.New(suite.T())
+	calls := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		calls++
+		switch calls {
+		case 1:
+			res.WriteHeader(http.StatusInternalServerError)
+		case 2:
+			// the body is cut after the headers were sent
+			res.Header().Set("Content-Length", "100")
+			res.WriteHeader(http.StatusOK)
+			res.Write([]byte("partial"))
+			res.(http.Flusher).Flush()
+			conn, _, _ := res.(http.Hijacker).Hijack()
+			conn.Close()
+		}
+	}))
+	defer upstream.Close()
+	k := &GatekeeperMock{}
+	k.On("CheckAccess", "", Requirement{}, false).Return(&Identity{Token: ""}, nil)
+	c := &TargetConfig{TID: "s", URL: upstream.URL, TargetType: TypeSingle, TargetProtocol: ProtocolHTTP, CircuitBreaker: &CircuitBreaker{Threshold: 1, OpenDuration: "20ms"}}
+	c.keeper = k
+	s, err := NewSingle(c)
+	a.NoError(err)
+	router := gin.New()
+	router.GET("/api/:id/*path", s.Handler())
+	router.POST("/api/:id/*path", s.Handler())
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+	res, err := http.Get(srv.URL + "/api/s/test")
+	a.NoError(err)
+	a.Equal(http.StatusInternalServerError, res.StatusCode)
+	time.Sleep(30 * time.Millisecond)
+	// the aborted probe counts as a failure and gives back its slot; POST requests are not retried by the client
+	if res, err = http.Post(srv.URL+"/api/s/test", "text/plain", nil); err == nil {
+		_, err = ioutil.ReadAll(res.Body)
+	}
+	a.Error(err)
+	a.Equal(BreakerOpen, s.Health()[0].Circuit)
+	time.Sleep(30 * time.Millisecond)
+	res, err = http.Get(srv.URL + "/api/s/test")
+	a.NoError(err)
+	a.Equal(http.StatusOK, res.StatusCode)
+	a.Equal(BreakerClosed, s.Health()[0].Circuit)
+	a.Equal(3, calls)
+}
+
+func (suite *BreakerTestSuite) TestPoolRotation() {
+	a := assert.New(suite.T())
+	p, _ := NewPool(&TargetConfig{TID: "p", TargetType: TypePool, TargetProtocol: ProtocolHTTP, Balancing: StrategyRoundRobin, CircuitBreaker: &CircuitBreaker{Threshold: 1}})
+	for i := 1; i <= 2; i++ {
+		u, _ := url.Parse(fmt.Sprintf("http://m%d.com", i))
+		p.Add(fmt.Sprintf("m%d", i), u, 0)
+	}
+	m1 := p.(*pool).current().byID["m1"]
+	g, _ := m1.breaker.acquire()
+	m1.breaker.done(g, false)
+	a.Len(p.(*pool).current().available(), 1)
+	a.Equal("m2", p.(*pool).current().available()[0].id)
+	a.Equal(BreakerOpen, p.Health()[0].Circuit)
+	a.Equal(BreakerClosed, p.Health()[1].Circuit)
+}
+
+func (suite *BreakerTestSuite) TestWebsocketProbe() {
+	a := assert.New(suite.T())
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer upstream.Close()
+	k := &GatekeeperMock{}
+	k.On("CheckAccess", "", Requirement{}, false).Return(&Identity{}, nil)
+	c := &TargetConfig{TID: "ws", URL: strings.Replace(upstream.URL, "http", "ws", 1), TargetType: TypeSingle, TargetProtocol: ProtocolWebsocket,
+		CircuitBreaker: &CircuitBreaker{Threshold: 1, OpenDuration: "10ms"}}
+	c.keeper = k
+	s, err := NewSingle(c)
+	a.NoError(err)
+	b := s.(*single).upstream.breaker
+	g, _ := b.acquire()
+	b.done(g, false)
+	time.Sleep(20 * time.Millisecond)
+	router := gin.New()
+	router.GET("/api/:id/*path", s.Handler())
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+	url := strings.Replace(srv.URL, "http", "ws", 1) + "/api/ws/events"
+	// the probe session closes the circuit as soon as the upstream accepted the handshake
+	probe, _, err := websocket.DefaultDialer.Dial(url, nil)
+	a.NoError(err)
+	defer probe.Close()
+	a.Equal(BreakerClosed, b.current())
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	a.NoError(err)
+	conn.Close()
+}
+
+func TestBreakerTestSuite(t *testing.T) {
+	suite.Run(t, new(BreakerTestSuite))
+}
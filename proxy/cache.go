@@ -0,0 +1,204 @@
+package proxy
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	defaultCacheTTL        = 30 * time.Second
+	defaultCacheMaxEntries = 10000
+)
+
+//TokenCache configures caching of token check results returned by the auth service
+type TokenCache struct {
+	TTL        string `yaml:"ttl" json:"ttl,omitempty"`
+	MaxEntries int    `yaml:"maxEntries" json:"maxEntries,omitempty"`
+}
+
+//CacheStats describes token cache usage
+type CacheStats struct {
+	Enabled       bool    `json:"enabled"`
+	Entries       int     `json:"entries"`
+	Hits          uint64  `json:"hits"`
+	Misses        uint64  `json:"misses"`
+	HitRate       float64 `json:"hitRate"`
+	Evictions     uint64  `json:"evictions"`
+	Expirations   uint64  `json:"expirations"`
+	Invalidations uint64  `json:"invalidations"`
+}
+
+//TokenCacheControl gives access to the cache of token check results
+type TokenCacheControl interface {
+	//Invalidate removes the check result of a single token and reports whether it was cached
+	Invalidate(token string) bool
+	//InvalidateAll removes all cached check results and returns their number
+	InvalidateAll() int
+	CacheStats() CacheStats
+}
+
+type cacheEntry struct {
+	key     string
+	claims  claims
+	expires time.Time
+}
+
+//tokenCache is a LRU cache of token claims with a fixed time to live capped by the token expiry; a nil cache is disabled
+type tokenCache struct {
+	mu            sync.Mutex
+	ttl           time.Duration
+	max           int
+	entries       map[string]*list.Element
+	lru           *list.List
+	hits          uint64
+	misses        uint64
+	evictions     uint64
+	expirations   uint64
+	invalidations uint64
+	now           func() time.Time
+}
+
+func newTokenCache(conf *TokenCache) *tokenCache {
+	if conf == nil {
+		return nil
+	}
+	c := &tokenCache{
+		ttl:     parseDuration(conf.TTL, defaultCacheTTL),
+		max:     conf.MaxEntries,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		now:     time.Now,
+	}
+	if c.max <= 0 {
+		c.max = defaultCacheMaxEntries
+	}
+	return c
+}
+
+//tokenKey hashes the token so that raw tokens are never kept in memory longer than necessary
+func tokenKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *tokenCache) get(token string) (claims, bool) {
+	if c == nil {
+		return claims{}, false
+	}
+	key := tokenKey(token)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		c.misses++
+		return claims{}, false
+	}
+	e := el.Value.(*cacheEntry)
+	if !c.now().Before(e.expires) {
+		c.drop(el)
+		c.expirations++
+		c.misses++
+		return claims{}, false
+	}
+	c.lru.MoveToFront(el)
+	c.hits++
+	return e.claims, true
+}
+
+func (c *tokenCache) set(token string, cl claims) {
+	if c == nil {
+		return
+	}
+	key := tokenKey(token)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	// entries never outlive the token
+	expires := now.Add(c.ttl)
+	if cl.Expires != nil {
+		if exp := unixTime(*cl.Expires); exp.Before(expires) {
+			expires = exp
+		}
+	}
+	el, ok := c.entries[key]
+	if !now.Before(expires) {
+		if ok {
+			c.drop(el)
+		}
+		return
+	}
+	if ok {
+		e := el.Value.(*cacheEntry)
+		e.claims = cl
+		e.expires = expires
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, claims: cl, expires: expires})
+	for c.lru.Len() > c.max {
+		c.drop(c.lru.Back())
+		c.evictions++
+	}
+}
+
+func (c *tokenCache) invalidate(token string) bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[tokenKey(token)]
+	if !ok {
+		return false
+	}
+	c.drop(el)
+	c.invalidations++
+	return true
+}
+
+func (c *tokenCache) clear() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := c.lru.Len()
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+	c.invalidations += uint64(n)
+	log.WithFields(log.Fields{"logger": "api-proxy.gatekeeper", "method": "clear", "entries": n}).
+		Info("Token cache cleared")
+	return n
+}
+
+func (c *tokenCache) stats() CacheStats {
+	if c == nil {
+		return CacheStats{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := CacheStats{
+		Enabled:       true,
+		Entries:       c.lru.Len(),
+		Hits:          c.hits,
+		Misses:        c.misses,
+		Evictions:     c.evictions,
+		Expirations:   c.expirations,
+		Invalidations: c.invalidations,
+	}
+	if total := c.hits + c.misses; total > 0 {
+		s.HitRate = float64(c.hits) / float64(total)
+	}
+	return s
+}
+
+//drop must be called with the lock held
+func (c *tokenCache) drop(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*cacheEntry).key)
+}
@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type CacheTestSuite struct {
+	suite.Suite
+}
+
+func (suite *CacheTestSuite) TestExpiry() {
+	a := assert.New(suite.T())
+	c := newTokenCache(&TokenCache{TTL: "10s"})
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	c.set("t1", claims{Username: "u1", Permissions: 5})
+	cl, ok := c.get("t1")
+	a.True(ok)
+	a.Equal(5, cl.Permissions)
+	now = now.Add(10 * time.Second)
+	_, ok = c.get("t1")
+	a.False(ok)
+	s := c.stats()
+	a.Equal(0, s.Entries)
+	a.Equal(uint64(1), s.Expirations)
+	a.Equal(uint64(1), s.Hits)
+	a.Equal(uint64(1), s.Misses)
+	a.Equal(0.5, s.HitRate)
+}
+
+func (suite *CacheTestSuite) TestTokenExpiry() {
+	a := assert.New(suite.T())
+	c := newTokenCache(&TokenCache{TTL: "10s"})
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	exp := float64(now.Add(time.Second).Unix())
+	c.set("t1", claims{Username: "u1", Expires: &exp})
+	_, ok := c.get("t1")
+	a.True(ok)
+	now = now.Add(time.Second)
+	_, ok = c.get("t1")
+	a.False(ok)
+	// expired tokens are not cached and replace a cached result
+	c.set("t1", claims{Username: "u1"})
+	c.set("t1", claims{Username: "u1", Expires: &exp})
+	_, ok = c.get("t1")
+	a.False(ok)
+	a.Equal(0, c.stats().Entries)
+}
+
+func (suite *CacheTestSuite) TestBounded() {
+	a := assert.New(suite.T())
+	c := newTokenCache(&TokenCache{MaxEntries: 3})
+	a.Equal(defaultCacheTTL, c.ttl)
+	for i := 0; i < 3; i++ {
+		c.set(fmt.Sprintf("t%d", i), claims{Permissions: i})
+	}
+	// t0 becomes the most recently used entry so t1 is evicted
+	_, ok := c.get("t0")
+	a.True(ok)
+	c.set("t3", claims{Permissions: 3})
+	_, ok = c.get("t1")
+	a.False(ok)
+	for _, token := range []string{"t0", "t2", "t3"} {
+		_, ok = c.get(token)
+		a.True(ok, token)
+	}
+	a.Equal(3, c.stats().Entries)
+	a.Equal(uint64(1), c.stats().Evictions)
+}
+
+func (suite *CacheTestSuite) TestHashedKeys() {
+	a := assert.New(suite.T())
+	c := newTokenCache(&TokenCache{})
+	c.set("secret-token", claims{})
+	for key := range c.entries {
+		a.NotContains(key, "secret-token")
+		a.Len(key, 64)
+	}
+}
+
+func (suite *CacheTestSuite) TestDisabled() {
+	a := assert.New(suite.T())
+	var c *tokenCache
+	c.set("t", claims{})
+	_, ok := c.get("t")
+	a.False(ok)
+	a.False(c.invalidate("t"))
+	a.Equal(0, c.clear())
+	a.False(c.stats().Enabled)
+}
+
+func TestCacheTestSuite(t *testing.T) {
+	suite.Run(t, new(CacheTestSuite))
+}
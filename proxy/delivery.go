@@ -0,0 +1,268 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//DeliveryMode defines how refreshed tokens are returned to HTTP clients
+type DeliveryMode string
+
+// token delivery modes
+const (
+	// DeliverHeader returns the token in a response header exposed to cross-origin clients
+	DeliverHeader DeliveryMode = "header"
+	// DeliverCookie returns the token in a secure, HTTP only cookie
+	DeliverCookie DeliveryMode = "cookie"
+	// DeliverEnvelope wraps JSON responses as {"token": ..., "data": ...}; other responses get the token header
+	DeliverEnvelope DeliveryMode = "envelope"
+)
+
+//SessionExpiry defines what happens to websocket sessions when their token expires
+type SessionExpiry string
+
+// session expiry policies
+const (
+	// ExpiryIgnore keeps sessions open after their token expired
+	ExpiryIgnore SessionExpiry = "ignore"
+	// ExpiryPush refreshes the token before it expires and pushes it to the client as {"type": "token", "token": ...}
+	ExpiryPush SessionExpiry = "push"
+	// ExpiryReject closes sessions with code 4401 when their token expires
+	ExpiryReject SessionExpiry = "reject"
+)
+
+const (
+	defaultTokenHeader   = "Token"
+	defaultRefreshBefore = 30 * time.Second
+	sameSiteStrict       = "Strict"
+)
+
+//TokenDelivery configures how tokens refreshed by the auth service reach clients of targets updating tokens.
+//Tokens are returned in the Token header by default.
+type TokenDelivery struct {
+	Mode DeliveryMode `yaml:"mode" json:"mode,omitempty"`
+	// Header is the name of the token header, Token by default
+	Header string          `yaml:"header" json:"header,omitempty"`
+	Cookie *DeliveryCookie `yaml:"cookie" json:"cookie,omitempty"`
+	// Expiry applies to websocket sessions; sessions are kept open by default
+	Expiry SessionExpiry `yaml:"expiry" json:"expiry,omitempty"`
+	// RefreshBefore is how long before expiry the token of a websocket session is refreshed in push mode, 30s by default
+	RefreshBefore string `yaml:"refreshBefore" json:"refreshBefore,omitempty"`
+}
+
+//DeliveryCookie sets attributes of the token cookie. Cookies are HTTP only, secure and strict same site unless configured otherwise.
+type DeliveryCookie struct {
+	// Name is token by default so that the cookie is read back by the cookie token source
+	Name   string `yaml:"name" json:"name,omitempty"`
+	Path   string `yaml:"path" json:"path,omitempty"`
+	Domain string `yaml:"domain" json:"domain,omitempty"`
+	// SameSite is one of Strict, Lax or None
+	SameSite string `yaml:"sameSite" json:"sameSite,omitempty"`
+	// Insecure allows sending the cookie over plain HTTP
+	Insecure bool `yaml:"insecure" json:"insecure,omitempty"`
+}
+
+func (d *TokenDelivery) mode() DeliveryMode {
+	if d == nil || d.Mode == "" {
+		return DeliverHeader
+	}
+	return d.Mode
+}
+
+func (d *TokenDelivery) header() string {
+	if d == nil || d.Header == "" {
+		return defaultTokenHeader
+	}
+	return d.Header
+}
+
+func (d *TokenDelivery) expiry() SessionExpiry {
+	if d == nil || d.Expiry == "" {
+		return ExpiryIgnore
+	}
+	return d.Expiry
+}
+
+func (d *TokenDelivery) refreshBefore() time.Duration {
+	if d == nil {
+		return defaultRefreshBefore
+	}
+	return parseDuration(d.RefreshBefore, defaultRefreshBefore)
+}
+
+//writer returns the response writer delivering the refreshed token of id; finish has to be called once the response is complete
+func (d *TokenDelivery) writer(w http.ResponseWriter, id *Identity) (res http.ResponseWriter, finish func()) {
+	switch d.mode() {
+	case DeliverCookie:
+		w.Header().Add("Set-Cookie", d.cookie(id))
+	case DeliverEnvelope:
+		e := &envelopeWriter{ResponseWriter: w, token: id.Token, fallback: d.setHeader, status: http.StatusOK}
+		return e, e.finish
+	default:
+		d.setHeader(w.Header(), id.Token)
+	}
+	return w, func() {}
+}
+
+//deliver adds the refreshed token to the headers of a websocket handshake response which can not be wrapped
+func (d *TokenDelivery) deliver(h http.Header, id *Identity) {
+	if d.mode() == DeliverCookie {
+		h.Add("Set-Cookie", d.cookie(id))
+		return
+	}
+	d.setHeader(h, id.Token)
+}
+
+func (d *TokenDelivery) setHeader(h http.Header, token string) {
+	name := d.header()
+	h.Set(name, token)
+	h.Add("Access-Control-Expose-Headers", name)
+}
+
+//cookie returns the Set-Cookie value for the token; the cookie expires with the token if its expiry is known
+func (d *TokenDelivery) cookie(id *Identity) string {
+	conf := d.Cookie
+	if conf == nil {
+		conf = &DeliveryCookie{}
+	}
+	c := &http.Cookie{Name: conf.Name, Value: id.Token, Path: conf.Path, Domain: conf.Domain, HttpOnly: true, Secure: !conf.Insecure}
+	if c.Name == "" {
+		c.Name = defaultTokenCookie
+	}
+	if c.Path == "" {
+		c.Path = "/"
+	}
+	if !id.Expires.IsZero() {
+		c.Expires = id.Expires
+	}
+	sameSite := conf.SameSite
+	if sameSite == "" {
+		sameSite = sameSiteStrict
+	}
+	// http.Cookie does not support the SameSite attribute
+	return c.String() + "; SameSite=" + sameSite
+}
+
+//maxEnvelopeBody is the size up to which JSON responses are buffered to be wrapped; larger responses get the token header
+const maxEnvelopeBody = 1 << 20
+
+//envelopeWriter buffers JSON responses to wrap them together with the refreshed token.
+//Other responses are passed through unbuffered with the token header once their headers are written.
+type envelopeWriter struct {
+	http.ResponseWriter
+	token    string
+	fallback func(h http.Header, token string)
+	status   int
+	body     bytes.Buffer
+	// decided is set once the headers are written; responses which are not buffered are passed through
+	decided  bool
+	buffered bool
+}
+
+type envelope struct {
+	Token string          `json:"token"`
+	Data  json.RawMessage `json:"data"`
+}
+
+func (e *envelopeWriter) WriteHeader(status int) {
+	if e.decided {
+		return
+	}
+	e.decided = true
+	e.status = status
+	h := e.Header()
+	e.buffered = isJSON(h.Get("Content-Type")) && h.Get("Content-Encoding") == "" && !e.oversized(h.Get("Content-Length"))
+	if !e.buffered {
+		e.passThrough()
+	}
+}
+
+func (e *envelopeWriter) Write(b []byte) (int, error) {
+	if !e.decided {
+		e.WriteHeader(http.StatusOK)
+	}
+	if !e.buffered {
+		return e.ResponseWriter.Write(b)
+	}
+	if e.body.Len()+len(b) <= maxEnvelopeBody {
+		return e.body.Write(b)
+	}
+	// the body is too large to be wrapped, write what was buffered so far and stream the rest
+	e.buffered = false
+	e.passThrough()
+	if _, err := e.ResponseWriter.Write(e.body.Bytes()); err != nil {
+		return 0, err
+	}
+	e.body.Reset()
+	return e.ResponseWriter.Write(b)
+}
+
+//Flush forwards flushes of responses which are passed through; buffered responses are only written when complete
+func (e *envelopeWriter) Flush() {
+	if !e.decided || e.buffered {
+		return
+	}
+	if f, ok := e.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+//passThrough adds the token header and writes the status of a response which is not wrapped
+func (e *envelopeWriter) passThrough() {
+	e.fallback(e.Header(), e.token)
+	e.ResponseWriter.WriteHeader(e.status)
+}
+
+func (e *envelopeWriter) oversized(contentLength string) bool {
+	n, err := strconv.ParseInt(contentLength, 10, 64)
+	return err == nil && n > maxEnvelopeBody
+}
+
+func (e *envelopeWriter) finish() {
+	if !e.decided {
+		e.WriteHeader(e.status)
+	}
+	if !e.buffered {
+		return
+	}
+	h := e.Header()
+	body := e.body.Bytes()
+	if wrapped, ok := e.wrap(body); ok {
+		body = wrapped
+		h.Set("Content-Length", strconv.Itoa(len(body)))
+	} else {
+		e.fallback(h, e.token)
+	}
+	e.ResponseWriter.WriteHeader(e.status)
+	e.ResponseWriter.Write(body)
+}
+
+//wrap returns the envelope of a buffered JSON body; empty and invalid bodies are not wrapped
+func (e *envelopeWriter) wrap(body []byte) ([]byte, bool) {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil, false
+	}
+	wrapped, err := json.Marshal(&envelope{Token: e.token, Data: json.RawMessage(body)})
+	return wrapped, err == nil
+}
+
+func isJSON(contentType string) bool {
+	t, _, err := mime.ParseMediaType(contentType)
+	return err == nil && (t == "application/json" || strings.HasSuffix(t, "+json"))
+}
+
+//tokenMessage is pushed to websocket clients when the token of their session is refreshed
+type tokenMessage struct {
+	Type  string `json:"type"`
+	Token string `json:"token"`
+}
+
+func pushedToken(token string) []byte {
+	b, _ := json.Marshal(&tokenMessage{Type: "token", Token: token})
+	return b
+}
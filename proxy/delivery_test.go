@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type DeliveryTestSuite struct {
+	suite.Suite
+}
+
+func (suite *DeliveryTestSuite) TestHeader() {
+	a := assert.New(suite.T())
+	var d *TokenDelivery
+	rec := httptest.NewRecorder()
+	w, finish := d.writer(rec, &Identity{Token: "refreshed"})
+	w.WriteHeader(http.StatusOK)
+	finish()
+	a.Equal("refreshed", rec.Header().Get("Token"))
+	a.Equal("Token", rec.Header().Get("Access-Control-Expose-Headers"))
+	d = &TokenDelivery{Header: "X-Refreshed-Token"}
+	h := http.Header{}
+	d.deliver(h, &Identity{Token: "refreshed"})
+	a.Equal("refreshed", h.Get("X-Refreshed-Token"))
+	a.Equal("X-Refreshed-Token", h.Get("Access-Control-Expose-Headers"))
+}
+
+func (suite *DeliveryTestSuite) TestCookie() {
+	a := assert.New(suite.T())
+	d := &TokenDelivery{Mode: DeliverCookie}
+	rec := httptest.NewRecorder()
+	expires := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	d.writer(rec, &Identity{Token: "refreshed", Expires: expires})
+	c := rec.Header().Get("Set-Cookie")
+	a.True(strings.HasPrefix(c, "token=refreshed; Path=/; Expires=Wed, 02 Jan 2030 03:04:05 GMT"))
+	a.Contains(c, "; HttpOnly; Secure")
+	a.True(strings.HasSuffix(c, "; SameSite=Strict"))
+	a.Empty(rec.Header().Get("Token"))
+
+	d.Cookie = &DeliveryCookie{Name: "session", Path: "/app", Domain: "example.com", SameSite: "Lax", Insecure: true}
+	h := http.Header{}
+	d.deliver(h, &Identity{Token: "refreshed"})
+	c = h.Get("Set-Cookie")
+	a.Contains(c, "session=refreshed; Path=/app; Domain=example.com; HttpOnly")
+	a.NotContains(c, "Secure")
+	a.NotContains(c, "Expires")
+	a.True(strings.HasSuffix(c, "; SameSite=Lax"))
+}
+
+func (suite *DeliveryTestSuite) TestEnvelope() {
+	a := assert.New(suite.T())
+	d := &TokenDelivery{Mode: DeliverEnvelope}
+	rec := httptest.NewRecorder()
+	w, finish := d.writer(rec, &Identity{Token: "refreshed"})
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Content-Length", "11")
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(`{"id":"1"}`))
+	w.Write([]byte("\n"))
+	a.Empty(rec.Body.String())
+	finish()
+	a.Equal(http.StatusCreated, rec.Code)
+	a.JSONEq(`{"token":"refreshed","data":{"id":"1"}}`, rec.Body.String())
+	a.Equal("39", rec.Header().Get("Content-Length"))
+	a.Empty(rec.Header().Get("Token"))
+
+	// other content is passed as is with the token header
+	for _, r := range []struct{ contentType, body string }{
+		{"text/plain", "plain"},
+		{"application/json", ""},
+		{"application/vnd.api+json", "{broken"},
+	} {
+		rec = httptest.NewRecorder()
+		w, finish = d.writer(rec, &Identity{Token: "refreshed"})
+		w.Header().Set("Content-Type", r.contentType)
+		w.Write([]byte(r.body))
+		finish()
+		a.Equal(http.StatusOK, rec.Code)
+		a.Equal(r.body, rec.Body.String())
+		a.Equal("refreshed", rec.Header().Get("Token"))
+	}
+}
+
+func (suite *DeliveryTestSuite) TestEnvelopeStream() {
+	a := assert.New(suite.T())
+	d := &TokenDelivery{Mode: DeliverEnvelope}
+	rec := httptest.NewRecorder()
+	w, finish := d.writer(rec, &Identity{Token: "refreshed"})
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("data: 1\n\n"))
+	w.(http.Flusher).Flush()
+	a.True(rec.Flushed)
+	a.Equal("data: 1\n\n", rec.Body.String())
+	a.Equal("refreshed", rec.Header().Get("Token"))
+	w.Write([]byte("data: 2\n\n"))
+	finish()
+	a.Equal("data: 1\n\ndata: 2\n\n", rec.Body.String())
+
+	// compressed and oversized JSON bodies are not buffered
+	for _, h := range []http.Header{
+		{"Content-Encoding": {"gzip"}},
+		{"Content-Length": {strconv.Itoa(maxEnvelopeBody + 1)}},
+	} {
+		rec = httptest.NewRecorder()
+		w, finish = d.writer(rec, &Identity{Token: "refreshed"})
+		for k, v := range h {
+			w.Header()[k] = v
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("{"))
+		a.Equal("{", rec.Body.String())
+		finish()
+		a.Equal("refreshed", rec.Header().Get("Token"))
+	}
+
+	// JSON bodies exceeding the limit are streamed once it is reached
+	rec = httptest.NewRecorder()
+	w, finish = d.writer(rec, &Identity{Token: "refreshed"})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	chunk := bytes.Repeat([]byte(" "), maxEnvelopeBody/2)
+	w.Write([]byte("["))
+	w.Write(chunk)
+	a.Empty(rec.Body.String())
+	w.Write(chunk)
+	a.Equal(http.StatusAccepted, rec.Code)
+	a.Equal(maxEnvelopeBody+1, rec.Body.Len())
+	w.Write([]byte("]"))
+	finish()
+	a.Equal(maxEnvelopeBody+2, rec.Body.Len())
+	a.Equal("refreshed", rec.Header().Get("Token"))
+}
+
+func TestDeliveryTestSuite(t *testing.T) {
+	suite.Run(t, new(DeliveryTestSuite))
+}
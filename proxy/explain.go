@@ -0,0 +1,53 @@
+package proxy
+
+import "github.com/gin-gonic/gin"
+
+//Explanation describes how a request to a target is authorized. It is decided by the same checks as proxied requests,
+//except that tokens are never refreshed.
+type Explanation struct {
+	Target string `json:"target"`
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	// UpstreamPath is the path passed to the upstream after rewriting, relative to the target URL
+	UpstreamPath string `json:"upstreamPath"`
+	// Rule is the privileges rule applying to the request; nil if the defaults of the target apply
+	Rule *Path `json:"rule"`
+	// RuleIndex is the position of Rule in privileges.paths; -1 if the defaults of the target apply
+	RuleIndex   int         `json:"ruleIndex"`
+	Policy      Policy      `json:"policy"`
+	Requirement Requirement `json:"requirement"`
+	// Identity holds the claims of the token or API key as returned by the gatekeeper
+	Identity *Identity `json:"identity,omitempty"`
+	// Decision is allow or deny
+	Decision Policy `json:"decision"`
+	// Status, Error and Details describe the response a proxied request would be rejected with
+	Status  int    `json:"status,omitempty"`
+	Error   string `json:"error,omitempty"`
+	Details string `json:"details,omitempty"`
+}
+
+//explain authorizes a request to the target without proxying it; path is relative to the target and explained in its canonical form
+func explain(t Target, method, path, token, key string) *Explanation {
+	path = canonicalPath(path)
+	e := &Explanation{Target: t.ID(), Method: method, Path: path, UpstreamPath: t.RewritePath(path), RuleIndex: -1, Decision: PolicyAllow}
+	conf := t.Config()
+	e.Policy = conf.policy()
+	d := authorize(t, path, method, extractToken(token), key, false)
+	e.Rule, e.Requirement, e.Identity = d.rule, d.requirement, d.id
+	if d.rule != nil {
+		for i, p := range conf.Privileges.Paths {
+			if p == d.rule {
+				e.RuleIndex = i
+				break
+			}
+		}
+	}
+	if d.err != nil {
+		var body gin.H
+		e.Decision = PolicyDeny
+		e.Status, body = d.rejection()
+		e.Error, _ = body["error"].(string)
+		e.Details, _ = body["details"].(string)
+	}
+	return e
+}
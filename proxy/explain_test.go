@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/mklimuk/goerr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type ExplainTestSuite struct {
+	suite.Suite
+}
+
+func (suite *ExplainTestSuite) target(k Gatekeeper) Target {
+	c := &TargetConfig{TID: "users", URL: "http://users:8080", TargetType: TypeSingle, TargetProtocol: ProtocolHTTP, UpdatesToken: true,
+		APIKey: &APIKeyAuth{}, Rewrite: &Rewrite{AddPrefix: "/v1"}, Privileges: &Privileges{Default: 1, Paths: []*Path{
+			&Path{Prefix: "/admin", Method: MethodAny, Privileges: 10},
+			&Path{Exact: "/users/:id", Method: http.MethodDelete, Privileges: 5},
+			&Path{Prefix: "/internal", Method: MethodAny, Access: AccessDeny},
+		}}}
+	c.keeper = k
+	t, err := NewSingle(c)
+	suite.Require().NoError(err)
+	return t
+}
+
+func (suite *ExplainTestSuite) TestAllow() {
+	a := assert.New(suite.T())
+	k := &GatekeeperMock{}
+	// tokens are not refreshed by explanations
+	k.On("CheckAccess", "john", Requirement{Privileges: 5}, false).Return(&Identity{Token: "john", Username: "john", Permissions: 7}, nil).Once()
+	e := explain(suite.target(k), http.MethodDelete, "/users/12", "Bearer john", "")
+	a.Equal(PolicyAllow, e.Decision)
+	a.Equal("/v1/users/12", e.UpstreamPath)
+	a.Equal(1, e.RuleIndex)
+	a.Equal("/users/:id", e.Rule.Exact)
+	a.Equal(Requirement{Privileges: 5}, e.Requirement)
+	a.Equal(PolicyAllow, e.Policy)
+	a.Equal(7, e.Identity.Permissions)
+	a.Zero(e.Status)
+	k.On("CheckKey", "secret", "users", Requirement{Privileges: 1}).Return(&Identity{Username: "cron", Permissions: 1}, nil).Once()
+	e = explain(suite.target(k), http.MethodGet, "/users/12", "", "secret")
+	a.Equal(PolicyAllow, e.Decision)
+	a.Nil(e.Rule)
+	a.Equal(-1, e.RuleIndex)
+	a.Equal("cron", e.Identity.Username)
+	k.AssertExpectations(suite.T())
+}
+
+func (suite *ExplainTestSuite) TestDeny() {
+	a := assert.New(suite.T())
+	k := &GatekeeperMock{}
+	k.On("CheckAccess", "john", Requirement{Privileges: 10}, false).Return(&Identity{Token: "john", Username: "john", Permissions: 7}, goerr.NewError("Too low privileges", Forbidden)).Once()
+	e := explain(suite.target(k), http.MethodGet, "/admin/users", "john", "")
+	a.Equal(PolicyDeny, e.Decision)
+	a.Equal(0, e.RuleIndex)
+	a.Equal(http.StatusForbidden, e.Status)
+	a.Equal("Insufficient privileges", e.Error)
+	a.Equal("Too low privileges", e.Details)
+	a.Equal("john", e.Identity.Username)
+	k.On("CheckAccess", "", Requirement{Privileges: 1}, false).Return(nil, goerr.NewError("Authorization token required but not present", goerr.Unauthorized)).Once()
+	e = explain(suite.target(k), http.MethodGet, "/users", "", "")
+	a.Equal(http.StatusUnauthorized, e.Status)
+	a.Equal("Invalid access token", e.Error)
+	a.Nil(e.Identity)
+	// denied paths are rejected without checking credentials
+	e = explain(suite.target(k), http.MethodGet, "/internal/metrics", "john", "")
+	a.Equal(PolicyDeny, e.Decision)
+	a.Equal(2, e.RuleIndex)
+	a.Equal(http.StatusForbidden, e.Status)
+	a.Equal("Access denied", e.Error)
+	a.True(e.Requirement.Deny)
+	e = explain(suite.target(k), http.MethodGet, "/users/../internal//metrics", "john", "")
+	a.Equal("/internal/metrics", e.Path)
+	a.Equal(http.StatusForbidden, e.Status)
+	k.AssertExpectations(suite.T())
+}
+
+func TestExplainTestSuite(t *testing.T) {
+	suite.Run(t, new(ExplainTestSuite))
+}
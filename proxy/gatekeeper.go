@@ -2,10 +2,15 @@ package proxy
 
 import (
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
+	"strings"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -19,62 +24,277 @@ type checkToken struct {
 }
 
 type claims struct {
-	Username    string `json:"username"`
-	Name        string `json:"name"`
-	Permissions int    `json:"permissions"`
+	Username    string    `json:"username"`
+	Name        string    `json:"name"`
+	Permissions int       `json:"permissions"`
+	Roles       []string  `json:"roles,omitempty"`
+	Scope       scopeList `json:"scope,omitempty"`
+	Expires     *float64  `json:"exp,omitempty"`
+}
+
+// gatekeeper modes
+const (
+	AuthModeRemote = "remote"
+	AuthModeJWT    = "jwt"
+)
+
+//AuthUnavailable is the error type returned when the auth service could not be reached
+const AuthUnavailable goerr.ErrorType = 19
+
+const (
+	defaultAuthURL         = "http://auth:8080"
+	defaultCheckPath       = "/token/check"
+	defaultCheckType       = "application/x.token.check+json"
+	defaultAuthTimeout     = 10 * time.Second
+	defaultRetryBackoff    = 100 * time.Millisecond
+	defaultRetryMaxBackoff = 2 * time.Second
+)
+
+//AuthConfig selects how tokens are checked and how the auth service is called
+type AuthConfig struct {
+	// Mode is either remote (default), calling the auth service, or jwt, verifying tokens locally
+	Mode        string       `yaml:"mode"`
+	JWT         *JWTConfig   `yaml:"jwt"`
+	URL         string       `yaml:"url"`
+	CheckPath   string       `yaml:"checkPath"`
+	ContentType string       `yaml:"contentType"`
+	Timeout     string       `yaml:"timeout"`
+	Retry       *RetryPolicy `yaml:"retry"`
+	TLS         *TLSConfig   `yaml:"tls"`
+}
+
+//RetryPolicy configures retries of auth service calls failing with a transport error or a 5xx status.
+//Calls refreshing the token are only retried when the auth service could not be reached.
+type RetryPolicy struct {
+	// Attempts is the total number of calls made for a single check
+	Attempts   int    `yaml:"attempts"`
+	Backoff    string `yaml:"backoff"`
+	MaxBackoff string `yaml:"maxBackoff"`
+}
+
+//TLSConfig configures TLS connections to the auth service; client certificates enable mutual TLS
+type TLSConfig struct {
+	CAFile             string `yaml:"caFile"`
+	CertFile           string `yaml:"certFile"`
+	KeyFile            string `yaml:"keyFile"`
+	ServerName         string `yaml:"serverName"`
+	InsecureSkipVerify bool   `yaml:"insecureSkipVerify"`
 }
 
 //Gatekeeper is responsible for checking access privileges for an API
 type Gatekeeper interface {
-	CheckAccess(token string, accessPrivileges int, updateToken bool) (string, error)
+	//CheckAccess returns the identity of the token bearer; the identity is also returned when the token is valid but does not meet the requirement
+	CheckAccess(token string, req Requirement, updateToken bool) (*Identity, error)
+	//CheckKey returns the identity of an API key valid for the target; as with tokens the identity is returned when the requirement is not met
+	CheckKey(key, target string, req Requirement) (*Identity, error)
+}
+
+//CachingGatekeeper is a Gatekeeper keeping token check results in a cache
+type CachingGatekeeper interface {
+	Gatekeeper
+	TokenCacheControl
 }
 
 //NewGatekeeper is the gatekeeper constructor
 func NewGatekeeper(auth *url.URL) Gatekeeper {
-	k := keeper{auth, &http.Client{Timeout: 10 * time.Second}}
-	return Gatekeeper(&k)
+	return Gatekeeper(NewCachingGatekeeper(auth, nil))
+}
+
+//NewCachingGatekeeper is the gatekeeper constructor; check results are not cached if cache is nil
+func NewCachingGatekeeper(auth *url.URL, cache *TokenCache) CachingGatekeeper {
+	k := newKeeper(auth, &AuthConfig{}, &http.Client{Timeout: defaultAuthTimeout}, cache)
+	return CachingGatekeeper(k)
+}
+
+//NewRemoteGatekeeper creates a gatekeeper calling the auth service configured in conf; defaults are used if conf is nil
+func NewRemoteGatekeeper(conf *AuthConfig, cache *TokenCache) (CachingGatekeeper, error) {
+	if conf == nil {
+		conf = &AuthConfig{}
+	}
+	raw := conf.URL
+	if raw == "" {
+		raw = defaultAuthURL
+	}
+	var auth *url.URL
+	var err error
+	if auth, err = url.Parse(raw); err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: parseDuration(conf.Timeout, defaultAuthTimeout)}
+	if conf.TLS != nil {
+		var t *tls.Config
+		if t, err = conf.TLS.load(); err != nil {
+			return nil, err
+		}
+		client.Transport = &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: t}
+	}
+	return CachingGatekeeper(newKeeper(auth, conf, client, cache)), nil
+}
+
+func newKeeper(auth *url.URL, conf *AuthConfig, client *http.Client, cache *TokenCache) *keeper {
+	k := &keeper{
+		auth:        auth,
+		checkPath:   conf.CheckPath,
+		contentType: conf.ContentType,
+		client:      client,
+		attempts:    1,
+		backoff:     defaultRetryBackoff,
+		maxBackoff:  defaultRetryMaxBackoff,
+		cache:       newTokenCache(cache),
+	}
+	if k.checkPath == "" {
+		k.checkPath = defaultCheckPath
+	}
+	if k.contentType == "" {
+		k.contentType = defaultCheckType
+	}
+	if r := conf.Retry; r != nil {
+		if r.Attempts > 1 {
+			k.attempts = r.Attempts
+		}
+		k.backoff = parseDuration(r.Backoff, defaultRetryBackoff)
+		k.maxBackoff = parseDuration(r.MaxBackoff, defaultRetryMaxBackoff)
+	}
+	return k
 }
 
 type keeper struct {
-	auth   *url.URL
-	client *http.Client
+	auth        *url.URL
+	checkPath   string
+	contentType string
+	client      *http.Client
+	attempts    int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+	cache       *tokenCache
 }
 
-func (k *keeper) CheckAccess(token string, accessPrivileges int, updateToken bool) (string, error) {
+func (k *keeper) CheckAccess(token string, req Requirement, updateToken bool) (*Identity, error) {
 	if token == "" {
-		if accessPrivileges > 0 {
-			return token, goerr.NewError("Authorization token required but not present", goerr.Unauthorized)
+		return anonymousAccess(req)
+	}
+	//token refresh requests always go to the authentication service
+	if !updateToken {
+		if c, ok := k.cache.get(token); ok {
+			id := c.identity(token)
+			return id, req.check(id)
 		}
-		return token, nil
 	}
 	//call authentication service to check the token and compare privileges afterwards
-	req := &checkToken{
+	check := &checkToken{
 		Token:  token,
 		Update: updateToken,
 	}
 	var b []byte
 	var err error
-	if b, err = json.Marshal(&req); err != nil {
-		return token, err
+	if b, err = json.Marshal(&check); err != nil {
+		return nil, err
 	}
 
 	var res *http.Response
-	if res, err = k.client.Post(fmt.Sprintf("%s%s", k.auth.String(), "/token/check"), "application/x.token.check+json", bytes.NewReader(b)); err != nil {
-		return token, err
+	if res, err = k.post(b, updateToken); err != nil {
+		return nil, err
 	}
+	defer res.Body.Close()
 
 	if res.StatusCode != 200 {
 		log.WithFields(log.Fields{"logger": "api-proxy.gatekeeper", "method": "CheckAccess", "status": res.StatusCode}).
 			Error("Got invalid status code from auth service")
-		return token, goerr.NewError("Got invalid status code from auth service", goerr.Unauthorized)
+		k.cache.invalidate(token)
+		return nil, goerr.NewError("Got invalid status code from auth service", goerr.Unauthorized)
 	}
 
-	if err = json.NewDecoder(res.Body).Decode(req); err != nil {
-		return token, err
+	if err = json.NewDecoder(res.Body).Decode(check); err != nil {
+		return nil, goerr.NewError(fmt.Sprintf("Invalid response from auth service: %s", err.Error()), AuthUnavailable)
 	}
+	k.cache.set(check.Token, check.Claims)
+
+	id := check.Claims.identity(check.Token)
+	return id, req.check(id)
+}
+
+//CheckKey rejects all keys; API keys are checked by the gatekeeper wrapped by an APIKeyStore
+func (k *keeper) CheckKey(key, target string, req Requirement) (*Identity, error) {
+	return nil, goerr.NewError("API keys are not enabled", goerr.Unauthorized)
+}
+
+//post calls the auth service retrying transport errors and server errors; responses with other statuses are returned to the caller.
+//Checks updating the token are only retried if the request was never sent as the auth service may have refreshed the token already.
+func (k *keeper) post(body []byte, update bool) (*http.Response, error) {
+	clog := log.WithFields(log.Fields{"logger": "api-proxy.gatekeeper", "method": "post"})
+	target := strings.TrimRight(k.auth.String(), "/") + k.checkPath
+	var res *http.Response
+	var err error
+	for attempt := 1; ; attempt++ {
+		res, err = k.client.Post(target, k.contentType, bytes.NewReader(body))
+		switch {
+		case err != nil:
+			clog.WithField("attempt", attempt).WithError(err).Warn("Could not call auth service")
+		case res.StatusCode >= http.StatusInternalServerError:
+			clog.WithFields(log.Fields{"attempt": attempt, "status": res.StatusCode}).Warn("Auth service returned a server error")
+			res.Body.Close()
+			err = fmt.Errorf("got status %d", res.StatusCode)
+		default:
+			return res, nil
+		}
+		if attempt >= k.attempts || (update && !notSent(err)) {
+			return nil, goerr.NewError(fmt.Sprintf("Auth service unavailable: %s", err.Error()), AuthUnavailable)
+		}
+		time.Sleep(k.delay(attempt))
+	}
+}
+
+//notSent tells if a request failed before it was sent, i.e. the connection to the auth service could not be established
+func notSent(err error) bool {
+	if u, ok := err.(*url.Error); ok {
+		err = u.Err
+	}
+	op, ok := err.(*net.OpError)
+	return ok && op.Op == "dial"
+}
 
-	if req.Claims.Permissions < accessPrivileges {
-		return req.Token, goerr.NewError("Too low privileges", goerr.Unauthorized)
+//delay returns the exponential backoff before the retry following the given attempt
+func (k *keeper) delay(attempt int) time.Duration {
+	d := k.backoff
+	for i := 1; i < attempt && d < k.maxBackoff; i++ {
+		d *= 2
 	}
-	return req.Token, err
+	if d > k.maxBackoff {
+		return k.maxBackoff
+	}
+	return d
+}
+
+func (c *TLSConfig) load() (*tls.Config, error) {
+	t := &tls.Config{ServerName: c.ServerName, InsecureSkipVerify: c.InsecureSkipVerify}
+	if c.CAFile != "" {
+		b, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		t.RootCAs = x509.NewCertPool()
+		if !t.RootCAs.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificates found in %s", c.CAFile)
+		}
+	}
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		t.Certificates = []tls.Certificate{cert}
+	}
+	return t, nil
+}
+
+func (k *keeper) Invalidate(token string) bool {
+	return k.cache.invalidate(token)
+}
+
+func (k *keeper) InvalidateAll() int {
+	return k.cache.clear()
+}
+
+func (k *keeper) CacheStats() CacheStats {
+	return k.cache.stats()
 }
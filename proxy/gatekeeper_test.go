@@ -2,13 +2,20 @@ package proxy
 
 import (
 	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/gin-gonic/gin"
+	"github.com/mklimuk/goerr"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
@@ -23,6 +30,9 @@ type GatekeeperTestSuite struct {
 	url       *url.URL
 	authorize bool
 	perm      int
+	roles     []string
+	scope     string
+	calls     int
 }
 
 func (suite *GatekeeperTestSuite) SetupSuite() {
@@ -40,12 +50,12 @@ func (suite *GatekeeperTestSuite) TearDownSuite() {
 func (suite *GatekeeperTestSuite) TestEmptyToken() {
 	a := assert.New(suite.T())
 	k := NewGatekeeper(suite.url)
-	t, err := k.CheckAccess("", 0, true)
+	t, err := k.CheckAccess("", Requirement{}, true)
 	a.NoError(err)
-	a.Equal("", t)
-	t, err = k.CheckAccess("", 3, true)
+	a.Equal("", t.Token)
+	t, err = k.CheckAccess("", Requirement{Privileges: 3}, true)
 	a.Error(err)
-	a.Equal("", t)
+	a.Nil(t)
 }
 
 func (suite *GatekeeperTestSuite) TestHappyPath() {
@@ -53,9 +63,9 @@ func (suite *GatekeeperTestSuite) TestHappyPath() {
 	k := NewGatekeeper(suite.url)
 	suite.perm = 7
 	suite.authorize = true
-	t, err := k.CheckAccess("test", 5, true)
+	t, err := k.CheckAccess("test", Requirement{Privileges: 5}, true)
 	a.NoError(err)
-	a.Equal("updated", t)
+	a.Equal("updated", t.Token)
 }
 
 func (suite *GatekeeperTestSuite) TestTooLowPrivileges() {
@@ -63,9 +73,9 @@ func (suite *GatekeeperTestSuite) TestTooLowPrivileges() {
 	k := NewGatekeeper(suite.url)
 	suite.authorize = true
 	suite.perm = 3
-	t, err := k.CheckAccess("test", 5, true)
+	t, err := k.CheckAccess("test", Requirement{Privileges: 5}, true)
 	a.Error(err)
-	a.Equal("updated", t)
+	a.Equal("updated", t.Token)
 }
 
 func (suite *GatekeeperTestSuite) TestUnauthorized() {
@@ -73,9 +83,248 @@ func (suite *GatekeeperTestSuite) TestUnauthorized() {
 	k := NewGatekeeper(suite.url)
 	suite.authorize = false
 	suite.perm = 3
-	t, err := k.CheckAccess("test", 5, true)
+	t, err := k.CheckAccess("test", Requirement{Privileges: 5}, true)
 	a.Error(err)
-	a.Equal("test", t)
+	a.Nil(t)
+}
+
+func (suite *GatekeeperTestSuite) TestCache() {
+	a := assert.New(suite.T())
+	k := NewCachingGatekeeper(suite.url, &TokenCache{TTL: "1m"})
+	suite.authorize = true
+	suite.perm = 5
+	suite.calls = 0
+	t, err := k.CheckAccess("test", Requirement{Privileges: 5}, false)
+	a.NoError(err)
+	a.Equal("test", t.Token)
+	a.Equal(1, suite.calls)
+	// served from the cache, privileges are still compared
+	t, err = k.CheckAccess("test", Requirement{Privileges: 3}, false)
+	a.NoError(err)
+	a.Equal("test", t.Token)
+	_, err = k.CheckAccess("test", Requirement{Privileges: 7}, false)
+	a.Error(err)
+	a.Equal(1, suite.calls)
+	// token refresh goes to the auth service
+	t, err = k.CheckAccess("test", Requirement{Privileges: 5}, true)
+	a.NoError(err)
+	a.Equal("updated", t.Token)
+	a.Equal(2, suite.calls)
+	stats := k.CacheStats()
+	a.True(stats.Enabled)
+	a.Equal(uint64(2), stats.Hits)
+	a.Equal(uint64(1), stats.Misses)
+	a.Equal(2, stats.Entries)
+	// revoked tokens are checked again once invalidated
+	a.True(k.Invalidate("test"))
+	a.False(k.Invalidate("test"))
+	suite.authorize = false
+	_, err = k.CheckAccess("test", Requirement{Privileges: 5}, false)
+	a.Error(err)
+	a.Equal(3, suite.calls)
+	_, err = k.CheckAccess("test", Requirement{Privileges: 5}, false)
+	a.Error(err)
+	a.Equal(4, suite.calls)
+	a.Equal(1, k.InvalidateAll())
+	a.Equal(0, k.CacheStats().Entries)
+}
+
+func (suite *GatekeeperTestSuite) TestNoCache() {
+	a := assert.New(suite.T())
+	k := NewCachingGatekeeper(suite.url, nil)
+	suite.authorize = true
+	suite.perm = 5
+	suite.calls = 0
+	k.CheckAccess("test", Requirement{Privileges: 5}, false)
+	k.CheckAccess("test", Requirement{Privileges: 5}, false)
+	a.Equal(2, suite.calls)
+	a.False(k.CacheStats().Enabled)
+	a.False(k.Invalidate("test"))
+}
+
+func (suite *GatekeeperTestSuite) TestRetry() {
+	a := assert.New(suite.T())
+	failures := 2
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		a.Equal("/auth/check", r.URL.Path)
+		a.Equal("application/json", r.Header.Get("Content-Type"))
+		if calls <= failures {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		json.NewEncoder(w).Encode(&checkToken{Token: "test", Claims: claims{Permissions: 5}})
+	}))
+	defer srv.Close()
+	conf := &AuthConfig{URL: srv.URL + "/", CheckPath: "/auth/check", ContentType: "application/json", Retry: &RetryPolicy{Attempts: 3, Backoff: "1ms"}}
+	k, err := NewRemoteGatekeeper(conf, nil)
+	a.NoError(err)
+	_, err = k.CheckAccess("test", Requirement{Privileges: 5}, false)
+	a.NoError(err)
+	a.Equal(3, calls)
+
+	calls = 0
+	failures = 3
+	_, err = k.CheckAccess("test", Requirement{Privileges: 5}, false)
+	a.Error(err)
+	a.Equal(AuthUnavailable, goerr.GetType(err))
+	a.Equal(3, calls)
+
+	// token updates are not retried once sent as the token may have been refreshed already
+	calls = 0
+	failures = 1
+	_, err = k.CheckAccess("test", Requirement{Privileges: 5}, true)
+	a.Error(err)
+	a.Equal(AuthUnavailable, goerr.GetType(err))
+	a.Equal(1, calls)
+}
+
+func (suite *GatekeeperTestSuite) TestNotSent() {
+	a := assert.New(suite.T())
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+	_, err := http.Post(srv.URL, "application/json", nil)
+	a.Error(err)
+	a.False(notSent(err))
+	srv.Close()
+	_, err = http.Post(srv.URL, "application/json", nil)
+	a.Error(err)
+	a.True(notSent(err))
+}
+
+func (suite *GatekeeperTestSuite) TestOutage() {
+	a := assert.New(suite.T())
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer srv.Close()
+	k, err := NewRemoteGatekeeper(&AuthConfig{URL: srv.URL, Timeout: "10ms"}, nil)
+	a.NoError(err)
+	_, err = k.CheckAccess("test", Requirement{Privileges: 5}, false)
+	a.Error(err)
+	a.Equal(AuthUnavailable, goerr.GetType(err))
+	// invalid tokens are still reported as unauthorized
+	suite.authorize = false
+	k, err = NewRemoteGatekeeper(&AuthConfig{URL: suite.serv.URL}, nil)
+	a.NoError(err)
+	_, err = k.CheckAccess("test", Requirement{Privileges: 5}, false)
+	a.Error(err)
+	a.Equal(goerr.Unauthorized, goerr.GetType(err))
+	_, err = NewRemoteGatekeeper(&AuthConfig{URL: ":invalid"}, nil)
+	a.Error(err)
+}
+
+func (suite *GatekeeperTestSuite) TestTLS() {
+	a := assert.New(suite.T())
+	srv := httptest.NewTLSServer(suite.router)
+	defer srv.Close()
+	dir, _ := ioutil.TempDir("", "api-proxy")
+	defer os.RemoveAll(dir)
+	ca := filepath.Join(dir, "ca.pem")
+	ioutil.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0600)
+	suite.authorize = true
+	suite.perm = 5
+	k, err := NewRemoteGatekeeper(&AuthConfig{URL: srv.URL, TLS: &TLSConfig{CAFile: ca}}, nil)
+	a.NoError(err)
+	_, err = k.CheckAccess("test", Requirement{Privileges: 5}, false)
+	a.NoError(err)
+	// the test server certificate is not trusted by default
+	k, err = NewRemoteGatekeeper(&AuthConfig{URL: srv.URL}, nil)
+	a.NoError(err)
+	_, err = k.CheckAccess("test", Requirement{Privileges: 5}, false)
+	a.Equal(AuthUnavailable, goerr.GetType(err))
+	_, err = NewRemoteGatekeeper(&AuthConfig{URL: srv.URL, TLS: &TLSConfig{CertFile: filepath.Join(dir, "missing.pem"), KeyFile: filepath.Join(dir, "missing.key")}}, nil)
+	a.Error(err)
+	_, err = NewRemoteGatekeeper(&AuthConfig{URL: srv.URL, TLS: &TLSConfig{CAFile: filepath.Join(dir, "missing.pem")}}, nil)
+	a.Error(err)
+}
+
+func (suite *GatekeeperTestSuite) TestBackoff() {
+	a := assert.New(suite.T())
+	k := newKeeper(suite.url, &AuthConfig{Retry: &RetryPolicy{Attempts: 5, Backoff: "100ms", MaxBackoff: "300ms"}}, http.DefaultClient, nil)
+	a.Equal(5, k.attempts)
+	a.Equal(100*time.Millisecond, k.delay(1))
+	a.Equal(200*time.Millisecond, k.delay(2))
+	a.Equal(300*time.Millisecond, k.delay(3))
+	a.Equal(300*time.Millisecond, k.delay(10))
+	k = newKeeper(suite.url, &AuthConfig{}, http.DefaultClient, nil)
+	a.Equal(1, k.attempts)
+	a.Equal(defaultCheckPath, k.checkPath)
+	a.Equal(defaultCheckType, k.contentType)
+}
+
+func (suite *GatekeeperTestSuite) TestRolesAndScopes() {
+	a := assert.New(suite.T())
+	k := NewGatekeeper(suite.url)
+	suite.authorize = true
+	suite.perm = 1
+	suite.roles = []string{"editor", "viewer"}
+	suite.scope = "catalog:read catalog:write"
+	defer func() { suite.roles, suite.scope = nil, "" }()
+	id, err := k.CheckAccess("test", Requirement{Roles: &Match{AnyOf: []string{"admin", "editor"}}, Scopes: &Match{AllOf: []string{"catalog:read"}}}, false)
+	a.NoError(err)
+	a.Equal([]string{"editor", "viewer"}, id.Roles)
+	a.Equal([]string{"catalog:read", "catalog:write"}, id.Scopes)
+	_, err = k.CheckAccess("test", Requirement{Roles: &Match{AllOf: []string{"editor", "admin"}}}, false)
+	a.Error(err)
+	_, err = k.CheckAccess("test", Requirement{Scopes: &Match{AnyOf: []string{"users:read"}}}, false)
+	a.Error(err)
+	// the integer model is still compared with the permissions claim
+	id, err = k.CheckAccess("test", Requirement{Privileges: 2, Roles: &Match{AnyOf: []string{"editor"}}}, false)
+	a.Error(err)
+	a.Equal("test", id.Token)
+	_, err = k.CheckAccess("", Requirement{Roles: &Match{AnyOf: []string{"editor"}}}, false)
+	a.Error(err)
+}
+
+func (suite *GatekeeperTestSuite) TestLevelMode() {
+	a := assert.New(suite.T())
+	k := NewGatekeeper(suite.url)
+	suite.authorize = true
+	// rights 7 is an ordered level, it covers every lower level
+	suite.perm = 7
+	for _, p := range []int{1, 4, 7} {
+		_, err := k.CheckAccess("test", Requirement{Privileges: p, Mode: PermissionLevel}, false)
+		a.NoError(err, p)
+	}
+	_, err := k.CheckAccess("test", Requirement{Privileges: 8, Mode: PermissionLevel}, false)
+	a.Error(err)
+	// bits are ignored in level mode
+	_, err = k.CheckAccess("test", Requirement{Privileges: 8, Bits: BitsAny}, false)
+	a.Error(err)
+}
+
+func (suite *GatekeeperTestSuite) TestBitmaskMode() {
+	a := assert.New(suite.T())
+	const (
+		read  = 1
+		write = 2
+		admin = 8
+	)
+	k := NewGatekeeper(suite.url)
+	suite.authorize = true
+	// admin without write, which the level mode could not express
+	suite.perm = read | admin
+	id, err := k.CheckAccess("test", Requirement{Privileges: admin, Mode: PermissionBitmask}, false)
+	a.NoError(err)
+	a.Equal(read|admin, id.Permissions)
+	_, err = k.CheckAccess("test", Requirement{Privileges: read | admin, Mode: PermissionBitmask, Bits: BitsAll}, false)
+	a.NoError(err)
+	_, err = k.CheckAccess("test", Requirement{Privileges: write, Mode: PermissionBitmask}, false)
+	a.Error(err)
+	// level 2 would be granted by rights 9
+	_, err = k.CheckAccess("test", Requirement{Privileges: write}, false)
+	a.NoError(err)
+	_, err = k.CheckAccess("test", Requirement{Privileges: write | admin, Mode: PermissionBitmask}, false)
+	a.Error(err)
+	_, err = k.CheckAccess("test", Requirement{Privileges: write | admin, Mode: PermissionBitmask, Bits: BitsAny}, false)
+	a.NoError(err)
+	_, err = k.CheckAccess("test", Requirement{Privileges: write | 4, Mode: PermissionBitmask, Bits: BitsAny}, false)
+	a.Error(err)
+	_, err = k.CheckAccess("test", Requirement{Mode: PermissionBitmask}, false)
+	a.NoError(err)
 }
 
 func TestGatekeeperTestSuite(t *testing.T) {
@@ -83,10 +332,12 @@ func TestGatekeeperTestSuite(t *testing.T) {
 }
 
 func (suite *GatekeeperTestSuite) fakeAuth(ctx *gin.Context) {
+	suite.calls++
 	a := new(checkToken)
 	defer ctx.Request.Body.Close()
 	json.NewDecoder(ctx.Request.Body).Decode(a)
-	a.Claims = claims{Permissions: suite.perm}
+	a.Claims = claims{Permissions: suite.perm, Roles: suite.roles}
+	json.Unmarshal([]byte(fmt.Sprintf("%q", suite.scope)), &a.Claims.Scope)
 	if a.Update {
 		a.Token = "updated"
 	}
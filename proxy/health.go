@@ -0,0 +1,229 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+//HealthState describes the last known state of an upstream
+type HealthState string
+
+//Health states
+const (
+	HealthUnknown HealthState = "unknown"
+	HealthUp      HealthState = "up"
+	HealthDown    HealthState = "down"
+)
+
+const (
+	defaultProbePath          = "/health"
+	defaultProbeInterval      = 10 * time.Second
+	defaultProbeTimeout       = 2 * time.Second
+	defaultHealthyThreshold   = 2
+	defaultUnhealthyThreshold = 3
+)
+
+// HealthCheck defines active health checking settings of a target. Members in the unknown state receive traffic
+// until they are marked down.
+type HealthCheck struct {
+	Path     string `yaml:"path" json:"path"`
+	Interval string `yaml:"interval" json:"interval"`
+	Timeout  string `yaml:"timeout" json:"timeout"`
+	// HealthyThreshold is the number of consecutive successful probes marking a member up, also from the unknown state
+	HealthyThreshold int `yaml:"healthyThreshold" json:"healthyThreshold"`
+	// UnhealthyThreshold is the number of consecutive failed probes marking a member down
+	UnhealthyThreshold int `yaml:"unhealthyThreshold" json:"unhealthyThreshold"`
+}
+
+// MemberHealth is a snapshot of an upstream health
+type MemberHealth struct {
+	ID        string       `json:"id"`
+	URL       string       `json:"url"`
+	State     HealthState  `json:"state"`
+	Successes int          `json:"successes"`
+	Failures  int          `json:"failures"`
+	LastCheck time.Time    `json:"lastCheck"`
+	LastError string       `json:"lastError,omitempty"`
+	Circuit   BreakerState `json:"circuit,omitempty"`
+}
+
+func (h *HealthCheck) probePath() string {
+	if h.Path == "" {
+		return defaultProbePath
+	}
+	return h.Path
+}
+
+func (h *HealthCheck) interval() time.Duration {
+	return parseDuration(h.Interval, defaultProbeInterval)
+}
+
+func (h *HealthCheck) timeout() time.Duration {
+	return parseDuration(h.Timeout, defaultProbeTimeout)
+}
+
+func (h *HealthCheck) healthyThreshold() int {
+	if h.HealthyThreshold <= 0 {
+		return defaultHealthyThreshold
+	}
+	return h.HealthyThreshold
+}
+
+func (h *HealthCheck) unhealthyThreshold() int {
+	if h.UnhealthyThreshold <= 0 {
+		return defaultUnhealthyThreshold
+	}
+	return h.UnhealthyThreshold
+}
+
+func parseDuration(d string, def time.Duration) time.Duration {
+	if d == "" {
+		return def
+	}
+	var p time.Duration
+	var err error
+	if p, err = time.ParseDuration(d); err != nil || p <= 0 {
+		return def
+	}
+	return p
+}
+
+//healthChecker periodically probes a single upstream; a nil checker is always healthy
+type healthChecker struct {
+	conf     *HealthCheck
+	target   string
+	probeURL string
+	client   *http.Client
+	mu       sync.RWMutex
+	state    MemberHealth
+	stop     chan struct{}
+	once     sync.Once
+}
+
+func newHealthChecker(target, ID string, uri *url.URL, conf *HealthCheck) *healthChecker {
+	if conf == nil || uri == nil {
+		return nil
+	}
+	return &healthChecker{
+		conf:     conf,
+		target:   target,
+		probeURL: probeURL(uri, conf.probePath()),
+		client:   &http.Client{Timeout: conf.timeout()},
+		state:    MemberHealth{ID: ID, URL: uri.String(), State: HealthUnknown},
+		stop:     make(chan struct{}),
+	}
+}
+
+func probeURL(uri *url.URL, path string) string {
+	u := *uri
+	switch u.Scheme {
+	case "ws":
+		u.Scheme = "http"
+	case "wss":
+		u.Scheme = "https"
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	u.RawPath = ""
+	return u.String()
+}
+
+func (h *healthChecker) start() {
+	if h == nil {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(h.conf.interval())
+		defer ticker.Stop()
+		h.probe()
+		for {
+			select {
+			case <-ticker.C:
+				h.probe()
+			case <-h.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (h *healthChecker) close() {
+	if h == nil {
+		return
+	}
+	h.once.Do(func() { close(h.stop) })
+}
+
+func (h *healthChecker) probe() {
+	var err error
+	var res *http.Response
+	if res, err = h.client.Get(h.probeURL); err == nil {
+		res.Body.Close()
+		if res.StatusCode < 200 || res.StatusCode >= 400 {
+			err = &probeError{res.StatusCode}
+		}
+	}
+	h.record(err)
+}
+
+func (h *healthChecker) record(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.state.LastCheck = time.Now()
+	previous := h.state.State
+	if err != nil {
+		h.state.LastError = err.Error()
+		h.state.Successes = 0
+		h.state.Failures++
+		if h.state.Failures >= h.conf.unhealthyThreshold() {
+			h.state.State = HealthDown
+		}
+	} else {
+		h.state.LastError = ""
+		h.state.Failures = 0
+		h.state.Successes++
+		if h.state.Successes >= h.conf.healthyThreshold() {
+			h.state.State = HealthUp
+		}
+	}
+	if previous != h.state.State {
+		log.WithFields(log.Fields{"logger": "api-proxy.health", "target": h.target, "member": h.state.ID, "from": previous, "to": h.state.State}).
+			Warn("Upstream health state changed")
+	}
+}
+
+func (h *healthChecker) healthy() bool {
+	if h == nil {
+		return true
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.state.State != HealthDown
+}
+
+func (h *healthChecker) status() MemberHealth {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.state
+}
+
+func unchecked(ID string, uri *url.URL) MemberHealth {
+	h := MemberHealth{ID: ID, State: HealthUnknown}
+	if uri != nil {
+		h.URL = uri.String()
+	}
+	return h
+}
+
+type probeError struct {
+	status int
+}
+
+func (e *probeError) Error() string {
+	return fmt.Sprintf("unexpected probe status %d", e.status)
+}
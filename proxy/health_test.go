@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type HealthTestSuite struct {
+	suite.Suite
+	serv   *httptest.Server
+	url    *url.URL
+	status int
+}
+
+func (suite *HealthTestSuite) SetupSuite() {
+	log.SetLevel(log.DebugLevel)
+	router := gin.New()
+	router.GET("/svc/health", func(ctx *gin.Context) {
+		ctx.AbortWithStatus(suite.status)
+	})
+	suite.serv = httptest.NewServer(router)
+	suite.url, _ = url.Parse(fmt.Sprintf("%s/svc/", suite.serv.URL))
+}
+
+func (suite *HealthTestSuite) TearDownSuite() {
+	suite.serv.Close()
+}
+
+func (suite *HealthTestSuite) TestDefaults() {
+	a := assert.New(suite.T())
+	h := &HealthCheck{Interval: "invalid", Timeout: "500ms"}
+	a.Equal(defaultProbePath, h.probePath())
+	a.Equal(defaultProbeInterval, h.interval())
+	a.Equal("500ms", h.timeout().String())
+	a.Equal(defaultHealthyThreshold, h.healthyThreshold())
+	a.Equal(defaultUnhealthyThreshold, h.unhealthyThreshold())
+	a.Nil(newHealthChecker("t", "m", suite.url, nil))
+	var c *healthChecker
+	a.True(c.healthy())
+}
+
+func (suite *HealthTestSuite) TestProbeURL() {
+	a := assert.New(suite.T())
+	u, _ := url.Parse("ws://host:8080/base/")
+	a.Equal("http://host:8080/base/health", probeURL(u, "/health"))
+	u, _ = url.Parse("https://host")
+	a.Equal("https://host/ping", probeURL(u, "/ping"))
+}
+
+func (suite *HealthTestSuite) TestThresholds() {
+	a := assert.New(suite.T())
+	h := newHealthChecker("t", "m", suite.url, &HealthCheck{HealthyThreshold: 2, UnhealthyThreshold: 2})
+	a.Equal(HealthUnknown, h.status().State)
+	// the healthy threshold also applies to members never checked before
+	h.record(nil)
+	a.Equal(HealthUnknown, h.status().State)
+	a.True(h.healthy())
+	h.record(nil)
+	a.Equal(HealthUp, h.status().State)
+	h.record(errors.New("refused"))
+	a.True(h.healthy())
+	h.record(errors.New("refused"))
+	a.False(h.healthy())
+	a.Equal(HealthDown, h.status().State)
+	a.Equal("refused", h.status().LastError)
+	h.record(nil)
+	a.False(h.healthy())
+	h.record(nil)
+	a.True(h.healthy())
+	a.Equal(HealthUp, h.status().State)
+	a.Equal("", h.status().LastError)
+}
+
+func (suite *HealthTestSuite) TestProbe() {
+	a := assert.New(suite.T())
+	h := newHealthChecker("t", "m", suite.url, &HealthCheck{HealthyThreshold: 1, UnhealthyThreshold: 1})
+	suite.status = http.StatusOK
+	h.probe()
+	a.Equal(HealthUp, h.status().State)
+	suite.status = http.StatusInternalServerError
+	h.probe()
+	a.Equal(HealthDown, h.status().State)
+	a.Equal("unexpected probe status 500", h.status().LastError)
+}
+
+func (suite *HealthTestSuite) TestPoolRotation() {
+	a := assert.New(suite.T())
+	p, _ := NewPool(&TargetConfig{TID: "p", TargetType: TypePool, TargetProtocol: ProtocolHTTP, Balancing: StrategyRoundRobin})
+	u, _ := url.Parse("http://m.com")
+	p.Add("m1", u, 0)
+	p.Add("m2", u, 0)
+	m1 := p.(*pool).current().byID["m1"]
+	m1.health = newHealthChecker("p", "m1", u, &HealthCheck{UnhealthyThreshold: 1})
+	a.Len(p.(*pool).current().available(), 2)
+	m1.health.record(errors.New("timeout"))
+	a.Len(p.(*pool).current().available(), 1)
+	a.Equal("m2", p.(*pool).current().available()[0].id)
+	health := p.Health()
+	a.Len(health, 2)
+	a.Equal(HealthDown, health[0].State)
+	a.Equal(HealthUnknown, health[1].State)
+}
+
+func (suite *HealthTestSuite) TestSingleDown() {
+	a := assert.New(suite.T())
+	s, err := NewSingle(&TargetConfig{TID: "s", URL: "http://s.com", TargetType: TypeSingle, TargetProtocol: ProtocolHTTP})
+	a.NoError(err)
+	s.(*single).upstream.health = newHealthChecker("s", "s", s.URI(), &HealthCheck{UnhealthyThreshold: 1})
+	s.(*single).upstream.health.record(errors.New("timeout"))
+	router := gin.New()
+	router.GET("/api/:id/*path", s.Handler())
+	res := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/api/s/test", nil)
+	router.ServeHTTP(res, req)
+	a.Equal(http.StatusServiceUnavailable, res.Code)
+	a.Equal(HealthDown, s.Health()[0].State)
+}
+
+func TestHealthTestSuite(t *testing.T) {
+	suite.Run(t, new(HealthTestSuite))
+}
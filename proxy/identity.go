@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// default identity header names
+const (
+	HeaderUser        = "X-User"
+	HeaderUserName    = "X-User-Name"
+	HeaderPermissions = "X-Permissions"
+	HeaderRoles       = "X-Roles"
+	HeaderScopes      = "X-Scopes"
+)
+
+//disabledHeader turns off a single identity header
+const disabledHeader = "-"
+
+//IdentityHeaders configures headers carrying the authenticated identity to upstreams. Empty names use the defaults, "-" disables a header.
+//Copies of these headers sent by clients are always removed, as are client supplied headers with the default names.
+type IdentityHeaders struct {
+	User               string `yaml:"user" json:"user,omitempty"`
+	Name               string `yaml:"name" json:"name,omitempty"`
+	Permissions        string `yaml:"permissions" json:"permissions,omitempty"`
+	Roles              string `yaml:"roles" json:"roles,omitempty"`
+	Scopes             string `yaml:"scopes" json:"scopes,omitempty"`
+	StripAuthorization bool   `yaml:"stripAuthorization" json:"stripAuthorization,omitempty"`
+}
+
+type contextKey string
+
+//forwardedHeadersKey holds names of request headers set by the proxy; they are copied to websocket upstreams which do not receive request headers otherwise
+const forwardedHeadersKey contextKey = "forwardedHeaders"
+
+func headerName(name, def string) string {
+	switch name {
+	case "":
+		return def
+	case disabledHeader:
+		return ""
+	}
+	return http.CanonicalHeaderKey(name)
+}
+
+//values maps enabled header names to identity values; values are empty for anonymous requests
+func (h *IdentityHeaders) values(id *Identity) map[string]string {
+	if id == nil {
+		id = &Identity{}
+	}
+	res := make(map[string]string, 5)
+	set := func(name, def, value string) {
+		if n := headerName(name, def); n != "" {
+			res[n] = value
+		}
+	}
+	set(h.User, HeaderUser, id.Username)
+	set(h.Name, HeaderUserName, id.Name)
+	permissions := ""
+	if id.Username != "" || id.Permissions != 0 {
+		permissions = strconv.Itoa(id.Permissions)
+	}
+	set(h.Permissions, HeaderPermissions, permissions)
+	set(h.Roles, HeaderRoles, strings.Join(id.Roles, ","))
+	set(h.Scopes, HeaderScopes, strings.Join(id.Scopes, " "))
+	return res
+}
+
+//defaultHeaders are removed from requests even if they are renamed or disabled so that upstreams can not be sent spoofed identities
+var defaultHeaders = []string{HeaderUser, HeaderUserName, HeaderPermissions, HeaderRoles, HeaderScopes}
+
+//apply replaces client supplied identity headers with the ones of the authenticated identity
+func (h *IdentityHeaders) apply(r *http.Request, id *Identity) *http.Request {
+	if h == nil {
+		return r
+	}
+	for _, name := range defaultHeaders {
+		r.Header.Del(name)
+	}
+	var forwarded []string
+	for name, value := range h.values(id) {
+		r.Header.Del(name)
+		if value != "" {
+			r.Header.Set(name, value)
+			forwarded = append(forwarded, name)
+		}
+	}
+	if h.StripAuthorization {
+		r.Header.Del("Authorization")
+	}
+	return r.WithContext(context.WithValue(r.Context(), forwardedHeadersKey, forwarded))
+}
+
+//forwardHeaders copies headers set by the proxy to the websocket upstream handshake
+func forwardHeaders(in *http.Request, out http.Header) {
+	names, _ := in.Context().Value(forwardedHeadersKey).([]string)
+	for _, name := range names {
+		out.Set(name, in.Header.Get(name))
+	}
+}
@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type IdentityTestSuite struct {
+	suite.Suite
+}
+
+func (suite *IdentityTestSuite) TestDefaults() {
+	a := assert.New(suite.T())
+	r, _ := http.NewRequest(http.MethodGet, "http://test.com/users", nil)
+	r.Header.Set("Authorization", "Bearer token")
+	r.Header.Set(HeaderUser, "spoofed")
+	r.Header.Set(HeaderRoles, "admin")
+	id := &Identity{Username: "john", Name: "John Doe", Permissions: 7, Scopes: []string{"read", "write"}}
+	r = (&IdentityHeaders{}).apply(r, id)
+	a.Equal("john", r.Header.Get(HeaderUser))
+	a.Equal("John Doe", r.Header.Get(HeaderUserName))
+	a.Equal("7", r.Header.Get(HeaderPermissions))
+	a.Equal("read write", r.Header.Get(HeaderScopes))
+	a.Empty(r.Header.Get(HeaderRoles))
+	a.Equal("Bearer token", r.Header.Get("Authorization"))
+	out := http.Header{}
+	forwardHeaders(r, out)
+	a.Len(out, 4)
+	a.Equal("john", out.Get(HeaderUser))
+}
+
+func (suite *IdentityTestSuite) TestCustom() {
+	a := assert.New(suite.T())
+	h := &IdentityHeaders{User: "x-remote-user", Name: disabledHeader, Roles: "X-Groups", StripAuthorization: true}
+	r, _ := http.NewRequest(http.MethodGet, "http://test.com/users", nil)
+	r.Header.Set("Authorization", "Bearer token")
+	r.Header.Set("X-Remote-User", "spoofed")
+	r.Header.Set(HeaderUserName, "not ours")
+	r = h.apply(r, &Identity{Username: "john", Name: "John", Roles: []string{"admin", "editor"}})
+	a.Equal("john", r.Header.Get("X-Remote-User"))
+	a.Equal("admin,editor", r.Header.Get("X-Groups"))
+	a.Equal("0", r.Header.Get(HeaderPermissions))
+	// client supplied copies of disabled and renamed headers are removed
+	a.Empty(r.Header.Get(HeaderUserName))
+	a.Empty(r.Header.Get(HeaderRoles))
+	a.Empty(r.Header.Get("Authorization"))
+}
+
+func (suite *IdentityTestSuite) TestSpoofedDisabled() {
+	a := assert.New(suite.T())
+	h := &IdentityHeaders{User: disabledHeader, Permissions: disabledHeader}
+	r, _ := http.NewRequest(http.MethodGet, "http://test.com/users", nil)
+	r.Header.Set(HeaderUser, "admin")
+	r.Header.Set(HeaderPermissions, "100")
+	r = h.apply(r, &Identity{Username: "john", Name: "John", Permissions: 1})
+	a.Empty(r.Header.Get(HeaderUser))
+	a.Empty(r.Header.Get(HeaderPermissions))
+	a.Equal("John", r.Header.Get(HeaderUserName))
+	out := http.Header{}
+	forwardHeaders(r, out)
+	a.Len(out, 1)
+}
+
+func (suite *IdentityTestSuite) TestAnonymous() {
+	a := assert.New(suite.T())
+	r, _ := http.NewRequest(http.MethodGet, "http://test.com/users", nil)
+	r.Header.Set(HeaderUser, "spoofed")
+	r.Header.Set(HeaderPermissions, "100")
+	r = (&IdentityHeaders{}).apply(r, &Identity{})
+	a.Empty(r.Header.Get(HeaderUser))
+	a.Empty(r.Header.Get(HeaderPermissions))
+	out := http.Header{}
+	forwardHeaders(r, out)
+	a.Empty(out)
+	var h *IdentityHeaders
+	r.Header.Set(HeaderUser, "kept")
+	a.Equal("kept", h.apply(r, nil).Header.Get(HeaderUser))
+}
+
+func TestIdentityTestSuite(t *testing.T) {
+	suite.Run(t, new(IdentityTestSuite))
+}
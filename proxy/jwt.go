@@ -0,0 +1,224 @@
+package proxy
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/mklimuk/goerr"
+)
+
+// supported signature algorithms
+const (
+	AlgHS256 = "HS256"
+	AlgRS256 = "RS256"
+	AlgES256 = "ES256"
+)
+
+//JWTConfig configures local verification of tokens
+type JWTConfig struct {
+	// Secret is the HS256 shared secret; SecretFile reads it from a file instead
+	Secret     string `yaml:"secret"`
+	SecretFile string `yaml:"secretFile"`
+	// KeyFiles are PEM files with RS256/ES256 public keys or certificates
+	KeyFiles []string `yaml:"keyFiles"`
+	// JWKS is a path or an http(s) URL of a JWKS document
+	JWKS     string `yaml:"jwks"`
+	Issuer   string `yaml:"issuer"`
+	Audience string `yaml:"audience"`
+	// Leeway is the accepted clock skew when checking exp and nbf
+	Leeway string `yaml:"leeway"`
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type jwtClaims struct {
+	claims
+	Issuer    string          `json:"iss"`
+	Audience  json.RawMessage `json:"aud"`
+	NotBefore *float64        `json:"nbf"`
+}
+
+//NewLocalGatekeeper creates a gatekeeper verifying tokens locally; token updates are delegated to remote
+func NewLocalGatekeeper(conf *JWTConfig, remote CachingGatekeeper) (CachingGatekeeper, error) {
+	if conf == nil {
+		return nil, fmt.Errorf("jwt configuration is required for local verification")
+	}
+	v := &jwtVerifier{issuer: conf.Issuer, audience: conf.Audience, leeway: parseDuration(conf.Leeway, 0), now: time.Now}
+	v.secret = []byte(conf.Secret)
+	if conf.SecretFile != "" {
+		b, err := ioutil.ReadFile(conf.SecretFile)
+		if err != nil {
+			return nil, err
+		}
+		v.secret = []byte(strings.TrimSpace(string(b)))
+	}
+	var err error
+	if v.keys, err = newKeySet(conf.KeyFiles, conf.JWKS); err != nil {
+		return nil, err
+	}
+	if len(v.secret) == 0 && len(v.keys.static) == 0 && conf.JWKS == "" {
+		return nil, fmt.Errorf("jwt configuration requires a secret, key files or a JWKS document")
+	}
+	k := localKeeper{CachingGatekeeper: remote, verifier: v}
+	return CachingGatekeeper(&k), nil
+}
+
+//localKeeper verifies tokens itself and falls back to the remote gatekeeper only when the token should be updated
+type localKeeper struct {
+	CachingGatekeeper
+	verifier *jwtVerifier
+}
+
+func (k *localKeeper) CheckAccess(token string, req Requirement, updateToken bool) (*Identity, error) {
+	if token == "" {
+		return anonymousAccess(req)
+	}
+	if updateToken {
+		return k.CachingGatekeeper.CheckAccess(token, req, updateToken)
+	}
+	var c *jwtClaims
+	var err error
+	if c, err = k.verifier.verify(token); err != nil {
+		log.WithFields(log.Fields{"logger": "api-proxy.gatekeeper", "method": "CheckAccess"}).
+			WithError(err).Info("Token verification failed")
+		return nil, goerr.NewError(err.Error(), goerr.Unauthorized)
+	}
+	id := c.identity(token)
+	return id, req.check(id)
+}
+
+type jwtVerifier struct {
+	secret   []byte
+	keys     *keySet
+	issuer   string
+	audience string
+	leeway   time.Duration
+	now      func() time.Time
+}
+
+func (v *jwtVerifier) verify(token string) (*jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+	h := new(jwtHeader)
+	if err := decodeSegment(parts[0], h); err != nil {
+		return nil, fmt.Errorf("malformed token header")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token signature")
+	}
+	if err = v.checkSignature(h, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, err
+	}
+	c := new(jwtClaims)
+	if err = decodeSegment(parts[1], c); err != nil {
+		return nil, fmt.Errorf("malformed token claims")
+	}
+	return c, v.checkClaims(c)
+}
+
+func (v *jwtVerifier) checkSignature(h *jwtHeader, signed string, sig []byte) error {
+	digest := sha256.Sum256([]byte(signed))
+	switch h.Alg {
+	case AlgHS256:
+		if len(v.secret) == 0 {
+			return fmt.Errorf("unsupported signature algorithm '%s'", h.Alg)
+		}
+		mac := hmac.New(sha256.New, v.secret)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return fmt.Errorf("invalid token signature")
+		}
+		return nil
+	case AlgRS256, AlgES256:
+		for _, k := range v.keys.find(h.Kid, h.Alg) {
+			if verifySignature(h.Alg, k.key, digest[:], sig) {
+				return nil
+			}
+		}
+		return fmt.Errorf("invalid token signature")
+	}
+	return fmt.Errorf("unsupported signature algorithm '%s'", h.Alg)
+}
+
+//verifySignature checks the signature with keys of the type matching the algorithm only
+func verifySignature(alg string, key crypto.PublicKey, digest, sig []byte) bool {
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		return alg == AlgRS256 && rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest, sig) == nil
+	case *ecdsa.PublicKey:
+		if alg != AlgES256 || len(sig) != 64 || pub.Curve.Params().BitSize != 256 {
+			return false
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(pub, digest, r, s)
+	}
+	return false
+}
+
+func (v *jwtVerifier) checkClaims(c *jwtClaims) error {
+	now := v.now()
+	if c.Expires != nil && !now.Add(-v.leeway).Before(unixTime(*c.Expires)) {
+		return fmt.Errorf("token expired")
+	}
+	if c.NotBefore != nil && now.Add(v.leeway).Before(unixTime(*c.NotBefore)) {
+		return fmt.Errorf("token not valid yet")
+	}
+	if v.issuer != "" && c.Issuer != v.issuer {
+		return fmt.Errorf("invalid token issuer")
+	}
+	if v.audience != "" && !hasAudience(c.Audience, v.audience) {
+		return fmt.Errorf("invalid token audience")
+	}
+	return nil
+}
+
+//hasAudience checks the aud claim which is either a string or a list of strings
+func hasAudience(raw json.RawMessage, audience string) bool {
+	if len(raw) == 0 {
+		return false
+	}
+	var single string
+	if json.Unmarshal(raw, &single) == nil {
+		return single == audience
+	}
+	var list []string
+	if json.Unmarshal(raw, &list) != nil {
+		return false
+	}
+	for _, a := range list {
+		if a == audience {
+			return true
+		}
+	}
+	return false
+}
+
+func unixTime(seconds float64) time.Time {
+	return time.Unix(0, int64(seconds*float64(time.Second)))
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(seg, "="))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
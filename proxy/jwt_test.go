@@ -0,0 +1,258 @@
+package proxy
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/mklimuk/goerr"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type JWTTestSuite struct {
+	suite.Suite
+	dir    string
+	rsaKey *rsa.PrivateKey
+	ecKey  *ecdsa.PrivateKey
+}
+
+func (suite *JWTTestSuite) SetupSuite() {
+	log.SetLevel(log.DebugLevel)
+	suite.rsaKey, _ = rsa.GenerateKey(rand.Reader, 2048)
+	suite.ecKey, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
+
+func (suite *JWTTestSuite) SetupTest() {
+	suite.dir, _ = ioutil.TempDir("", "api-proxy")
+}
+
+func (suite *JWTTestSuite) TearDownTest() {
+	os.RemoveAll(suite.dir)
+}
+
+func (suite *JWTTestSuite) TestHS256() {
+	a := assert.New(suite.T())
+	k, err := NewLocalGatekeeper(&JWTConfig{Secret: "secret"}, nil)
+	a.NoError(err)
+	token := suite.hs256("secret", map[string]interface{}{"username": "john", "permissions": 7})
+	t, err := k.CheckAccess(token, Requirement{Privileges: 5}, false)
+	a.NoError(err)
+	a.Equal(token, t.Token)
+	_, err = k.CheckAccess(token, Requirement{Privileges: 10}, false)
+	a.Error(err)
+	a.Equal(Forbidden, goerr.GetType(err))
+	_, err = k.CheckAccess(suite.hs256("other", map[string]interface{}{"permissions": 7}), Requirement{Privileges: 5}, false)
+	a.Error(err)
+	_, err = k.CheckAccess("not.a.token", Requirement{}, false)
+	a.Error(err)
+	_, err = k.CheckAccess("", Requirement{}, false)
+	a.NoError(err)
+	_, err = k.CheckAccess("", Requirement{Privileges: 1}, false)
+	a.Error(err)
+	token = suite.hs256("secret", map[string]interface{}{"permissions": 1, "roles": []string{"admin"}, "scope": []string{"users:read"}})
+	id, err := k.CheckAccess(token, Requirement{Roles: &Match{AnyOf: []string{"admin"}}, Scopes: &Match{AllOf: []string{"users:read"}}}, false)
+	a.NoError(err)
+	a.Equal([]string{"admin"}, id.Roles)
+	_, err = k.CheckAccess(token, Requirement{Scopes: &Match{AllOf: []string{"users:read", "users:write"}}}, false)
+	a.Error(err)
+}
+
+func (suite *JWTTestSuite) TestSecretFile() {
+	a := assert.New(suite.T())
+	path := filepath.Join(suite.dir, "secret")
+	ioutil.WriteFile(path, []byte("from-file\n"), 0600)
+	k, err := NewLocalGatekeeper(&JWTConfig{SecretFile: path}, nil)
+	a.NoError(err)
+	_, err = k.CheckAccess(suite.hs256("from-file", map[string]interface{}{"permissions": 1}), Requirement{Privileges: 1}, false)
+	a.NoError(err)
+	_, err = NewLocalGatekeeper(&JWTConfig{SecretFile: filepath.Join(suite.dir, "missing")}, nil)
+	a.Error(err)
+	_, err = NewLocalGatekeeper(&JWTConfig{}, nil)
+	a.Error(err)
+	_, err = NewLocalGatekeeper(nil, nil)
+	a.Error(err)
+}
+
+func (suite *JWTTestSuite) TestKeyFile() {
+	a := assert.New(suite.T())
+	rsaDER, _ := x509.MarshalPKIXPublicKey(&suite.rsaKey.PublicKey)
+	ecDER, _ := x509.MarshalPKIXPublicKey(&suite.ecKey.PublicKey)
+	path := filepath.Join(suite.dir, "keys.pem")
+	b := append(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: rsaDER}), pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: ecDER})...)
+	ioutil.WriteFile(path, b, 0600)
+	k, err := NewLocalGatekeeper(&JWTConfig{KeyFiles: []string{path}}, nil)
+	a.NoError(err)
+	c := map[string]interface{}{"permissions": 5}
+	_, err = k.CheckAccess(suite.sign(AlgRS256, "", c), Requirement{Privileges: 5}, false)
+	a.NoError(err)
+	_, err = k.CheckAccess(suite.sign(AlgES256, "", c), Requirement{Privileges: 5}, false)
+	a.NoError(err)
+	// a secret is not configured so HS256 tokens are rejected even if signed with the public key
+	_, err = k.CheckAccess(suite.hs256(string(rsaDER), c), Requirement{}, false)
+	a.Error(err)
+	_, err = k.CheckAccess(suite.sign("none", "", c), Requirement{}, false)
+	a.Error(err)
+
+	ioutil.WriteFile(path, []byte("garbage"), 0600)
+	_, err = NewLocalGatekeeper(&JWTConfig{KeyFiles: []string{path}}, nil)
+	a.Error(err)
+}
+
+func (suite *JWTTestSuite) TestJWKS() {
+	a := assert.New(suite.T())
+	doc := suite.jwks("rsa-1", "ec-1")
+	served := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served++
+		w.Write(doc)
+	}))
+	defer srv.Close()
+	k, err := NewLocalGatekeeper(&JWTConfig{JWKS: srv.URL}, nil)
+	a.NoError(err)
+	c := map[string]interface{}{"permissions": 5}
+	_, err = k.CheckAccess(suite.sign(AlgRS256, "rsa-1", c), Requirement{Privileges: 5}, false)
+	a.NoError(err)
+	_, err = k.CheckAccess(suite.sign(AlgES256, "ec-1", c), Requirement{Privileges: 5}, false)
+	a.NoError(err)
+	a.Equal(1, served)
+
+	// rotated keys are fetched again once the document gets stale
+	doc = suite.jwks("rsa-2", "ec-2")
+	keys := k.(*localKeeper).verifier.keys
+	_, err = k.CheckAccess(suite.sign(AlgRS256, "rsa-2", c), Requirement{Privileges: 5}, false)
+	a.Error(err)
+	a.Equal(1, served)
+	keys.now = func() time.Time { return time.Now().Add(jwksRefreshInterval) }
+	_, err = k.CheckAccess(suite.sign(AlgRS256, "rsa-2", c), Requirement{Privileges: 5}, false)
+	a.NoError(err)
+	a.Equal(2, served)
+
+	path := filepath.Join(suite.dir, "jwks.json")
+	ioutil.WriteFile(path, doc, 0600)
+	k, err = NewLocalGatekeeper(&JWTConfig{JWKS: path}, nil)
+	a.NoError(err)
+	_, err = k.CheckAccess(suite.sign(AlgES256, "ec-2", c), Requirement{Privileges: 5}, false)
+	a.NoError(err)
+	ioutil.WriteFile(path, []byte("{"), 0600)
+	_, err = NewLocalGatekeeper(&JWTConfig{JWKS: path}, nil)
+	a.Error(err)
+}
+
+func (suite *JWTTestSuite) TestRegisteredClaims() {
+	a := assert.New(suite.T())
+	k, err := NewLocalGatekeeper(&JWTConfig{Secret: "secret", Issuer: "auth", Audience: "api", Leeway: "30s"}, nil)
+	a.NoError(err)
+	now := time.Now().Unix()
+	valid := map[string]interface{}{"iss": "auth", "aud": []string{"web", "api"}, "exp": now + 60, "nbf": now}
+	id, err := k.CheckAccess(suite.hs256("secret", valid), Requirement{}, false)
+	a.NoError(err)
+	a.Equal(now+60, id.Expires.Unix())
+	for name, c := range map[string]map[string]interface{}{
+		"expired":     {"iss": "auth", "aud": "api", "exp": now - 60},
+		"not before":  {"iss": "auth", "aud": "api", "nbf": now + 60},
+		"issuer":      {"iss": "other", "aud": "api"},
+		"audience":    {"iss": "auth", "aud": "web"},
+		"no audience": {"iss": "auth"},
+	} {
+		_, err = k.CheckAccess(suite.hs256("secret", c), Requirement{}, false)
+		a.Error(err, name)
+	}
+	// expired within leeway
+	_, err = k.CheckAccess(suite.hs256("secret", map[string]interface{}{"iss": "auth", "aud": "api", "exp": now - 10}), Requirement{}, false)
+	a.NoError(err)
+}
+
+func (suite *JWTTestSuite) TestRemoteUpdate() {
+	a := assert.New(suite.T())
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		req := new(checkToken)
+		json.NewDecoder(r.Body).Decode(req)
+		req.Token = "updated"
+		req.Claims = claims{Permissions: 5}
+		json.NewEncoder(w).Encode(req)
+	}))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+	k, err := NewLocalGatekeeper(&JWTConfig{Secret: "secret"}, NewCachingGatekeeper(u, &TokenCache{}))
+	a.NoError(err)
+	token := suite.hs256("secret", map[string]interface{}{"permissions": 5})
+	t, err := k.CheckAccess(token, Requirement{Privileges: 5}, true)
+	a.NoError(err)
+	a.Equal("updated", t.Token)
+	a.Equal(1, calls)
+	t, err = k.CheckAccess(token, Requirement{Privileges: 5}, false)
+	a.NoError(err)
+	a.Equal(token, t.Token)
+	a.Equal(1, calls)
+	// cache control is provided by the remote gatekeeper
+	a.True(k.CacheStats().Enabled)
+}
+
+func TestJWTTestSuite(t *testing.T) {
+	suite.Run(t, new(JWTTestSuite))
+}
+
+func (suite *JWTTestSuite) hs256(secret string, c map[string]interface{}) string {
+	signed := segment(map[string]string{"alg": AlgHS256, "typ": "JWT"}) + "." + segment(c)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (suite *JWTTestSuite) sign(alg, kid string, c map[string]interface{}) string {
+	signed := segment(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"}) + "." + segment(c)
+	digest := sha256.Sum256([]byte(signed))
+	var sig []byte
+	switch alg {
+	case AlgRS256:
+		sig, _ = rsa.SignPKCS1v15(rand.Reader, suite.rsaKey, crypto.SHA256, digest[:])
+	case AlgES256:
+		r, s, _ := ecdsa.Sign(rand.Reader, suite.ecKey, digest[:])
+		sig = append(pad(r, 32), pad(s, 32)...)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func (suite *JWTTestSuite) jwks(rsaKid, ecKid string) []byte {
+	enc := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	pub := suite.ecKey.PublicKey
+	doc := map[string]interface{}{"keys": []map[string]string{
+		{"kty": "RSA", "kid": rsaKid, "alg": AlgRS256, "use": "sig", "n": enc(suite.rsaKey.N.Bytes()), "e": enc(big.NewInt(int64(suite.rsaKey.E)).Bytes())},
+		{"kty": "EC", "kid": ecKid, "crv": "P-256", "x": enc(pad(pub.X, 32)), "y": enc(pad(pub.Y, 32))},
+		{"kty": "oct", "kid": "ignored", "k": enc([]byte("secret"))},
+	}}
+	b, _ := json.Marshal(doc)
+	return b
+}
+
+func segment(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func pad(i *big.Int, size int) []byte {
+	b := i.Bytes()
+	return append(make([]byte, size-len(b)), b...)
+}
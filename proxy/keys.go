@@ -0,0 +1,256 @@
+package proxy
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	jwksTimeout         = 10 * time.Second
+	jwksRefreshInterval = time.Minute
+)
+
+//verificationKey is a public key used to check token signatures
+type verificationKey struct {
+	kid string
+	alg string
+	key crypto.PublicKey
+}
+
+//keySet holds public keys loaded from PEM files and a JWKS document
+type keySet struct {
+	mu     sync.RWMutex
+	static []verificationKey
+	jwks   []verificationKey
+	// source is the location of the JWKS document; documents fetched over HTTP are reloaded when an unknown key is requested
+	source  string
+	fetched time.Time
+	client  *http.Client
+	now     func() time.Time
+}
+
+func newKeySet(keyFiles []string, jwks string) (*keySet, error) {
+	s := &keySet{source: jwks, client: &http.Client{Timeout: jwksTimeout}, now: time.Now}
+	var err error
+	for _, f := range keyFiles {
+		var keys []verificationKey
+		if keys, err = loadPEM(f); err != nil {
+			return nil, err
+		}
+		s.static = append(s.static, keys...)
+	}
+	if jwks != "" {
+		if err = s.refresh(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+//find returns keys matching the key ID and algorithm of a token
+func (s *keySet) find(kid, alg string) []verificationKey {
+	keys := s.match(kid, alg)
+	if len(keys) > 0 || kid == "" || !s.remote() {
+		return keys
+	}
+	//the signing key might have been rotated
+	s.mu.RLock()
+	stale := s.now().Sub(s.fetched) >= jwksRefreshInterval
+	s.mu.RUnlock()
+	if !stale {
+		return keys
+	}
+	if err := s.refresh(); err != nil {
+		log.WithFields(log.Fields{"logger": "api-proxy.gatekeeper", "method": "find", "jwks": s.source}).
+			WithError(err).Error("Could not refresh JWKS document")
+		return keys
+	}
+	return s.match(kid, alg)
+}
+
+func (s *keySet) match(kid, alg string) []verificationKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var res []verificationKey
+	// the key lists are shared by concurrent readers and must not be appended to
+	for _, keys := range [][]verificationKey{s.jwks, s.static} {
+		for _, k := range keys {
+			if kid != "" && k.kid != "" && k.kid != kid {
+				continue
+			}
+			if k.alg != "" && k.alg != alg {
+				continue
+			}
+			res = append(res, k)
+		}
+	}
+	return res
+}
+
+func (s *keySet) remote() bool {
+	return strings.HasPrefix(s.source, "http://") || strings.HasPrefix(s.source, "https://")
+}
+
+func (s *keySet) refresh() error {
+	var b []byte
+	var err error
+	if s.remote() {
+		var res *http.Response
+		if res, err = s.client.Get(s.source); err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return fmt.Errorf("got status %d fetching JWKS document", res.StatusCode)
+		}
+		if b, err = ioutil.ReadAll(res.Body); err != nil {
+			return err
+		}
+	} else if b, err = ioutil.ReadFile(s.source); err != nil {
+		return err
+	}
+	var keys []verificationKey
+	if keys, err = parseJWKS(b); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.jwks = keys
+	s.fetched = s.now()
+	s.mu.Unlock()
+	return nil
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+//parseJWKS reads RSA and EC signature keys from a JWKS document; other keys are skipped
+func parseJWKS(b []byte) ([]verificationKey, error) {
+	doc := struct {
+		Keys []jwk `json:"keys"`
+	}{}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, fmt.Errorf("invalid JWKS document: %s", err.Error())
+	}
+	var res []verificationKey
+	for _, k := range doc.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		var key crypto.PublicKey
+		var err error
+		switch k.Kty {
+		case "RSA":
+			key, err = rsaFromJWK(k)
+		case "EC":
+			key, err = ecFromJWK(k)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid key '%s' in JWKS document: %s", k.Kid, err.Error())
+		}
+		res = append(res, verificationKey{kid: k.Kid, alg: k.Alg, key: key})
+	}
+	return res, nil
+}
+
+func rsaFromJWK(k jwk) (crypto.PublicKey, error) {
+	var n, e []byte
+	var err error
+	if n, err = base64.RawURLEncoding.DecodeString(k.N); err != nil {
+		return nil, err
+	}
+	if e, err = base64.RawURLEncoding.DecodeString(k.E); err != nil {
+		return nil, err
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+}
+
+func ecFromJWK(k jwk) (crypto.PublicKey, error) {
+	var curve elliptic.Curve
+	switch k.Crv {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	case "P-521":
+		curve = elliptic.P521()
+	default:
+		return nil, fmt.Errorf("unsupported curve '%s'", k.Crv)
+	}
+	var x, y []byte
+	var err error
+	if x, err = base64.RawURLEncoding.DecodeString(k.X); err != nil {
+		return nil, err
+	}
+	if y, err = base64.RawURLEncoding.DecodeString(k.Y); err != nil {
+		return nil, err
+	}
+	key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	if !curve.IsOnCurve(key.X, key.Y) {
+		return nil, fmt.Errorf("point is not on curve %s", k.Crv)
+	}
+	return key, nil
+}
+
+//loadPEM reads public keys and certificates from a PEM file
+func loadPEM(path string) ([]verificationKey, error) {
+	var b []byte
+	var err error
+	if b, err = ioutil.ReadFile(path); err != nil {
+		return nil, err
+	}
+	var res []verificationKey
+	for {
+		var block *pem.Block
+		if block, b = pem.Decode(b); block == nil {
+			break
+		}
+		var key crypto.PublicKey
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "RSA PUBLIC KEY":
+			key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		case "CERTIFICATE":
+			var cert *x509.Certificate
+			if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+				key = cert.PublicKey
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid key in %s: %s", path, err.Error())
+		}
+		res = append(res, verificationKey{key: key})
+	}
+	if len(res) == 0 {
+		return nil, fmt.Errorf("no public keys found in %s", path)
+	}
+	return res, nil
+}
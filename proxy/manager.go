@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"sort"
+	"sync"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/gin-gonic/gin"
@@ -18,16 +20,25 @@ const (
 
 //TargetsManager is responsible for registering proxy targets with the router
 type TargetsManager interface {
-	AddToPool(poolID, ID, targetURI string) error
+	AddToPool(poolID, ID, targetURI string, weight int) error
 	RemoveFromPool(poolID, ID string) error
 	CreatePool(conf *TargetConfig) error
+	DeletePool(poolID string) error
 	Proxy(ctx *gin.Context)
+	Health() map[string][]MemberHealth
+	Targets() []TargetConfig
+	Target(ID string) (TargetConfig, error)
+	CreateTarget(conf *TargetConfig) error
+	ReplaceTarget(ID string, conf *TargetConfig) error
+	DeleteTarget(ID string) error
+	PoolMembers(poolID string) ([]MemberInfo, error)
+	Reload(targets []*TargetConfig) error
+	Explain(ID, method, path, token, key string) (*Explanation, error)
 }
 
 //NewTargetsManager is the TargetsManager constructor
 func NewTargetsManager(targets []*TargetConfig, keeper Gatekeeper) TargetsManager {
-	t := &targetsManager{keeper: keeper}
-	t.targets = make(map[string]Target)
+	t := &targetsManager{keeper: keeper, targets: newRegistry(), configured: make(map[string][]byte)}
 	var tg Target
 	var err error
 	for _, conf := range targets {
@@ -35,44 +46,66 @@ func NewTargetsManager(targets []*TargetConfig, keeper Gatekeeper) TargetsManage
 		if tg, err = targetFromConfig(conf); err != nil {
 			panic(err)
 		}
-		t.targets[conf.TID] = tg
+		t.targets.put(tg)
+		t.configured[conf.TID], _ = fingerprint(conf)
 	}
 	return TargetsManager(t)
 }
 
 type targetsManager struct {
-	targets map[string]Target
+	targets *registry
 	keeper  Gatekeeper
+	// configured holds fingerprints of targets coming from the configuration file
+	configured map[string][]byte
+	reloadMu   sync.Mutex
+	store      StateStore
+	persistMu  sync.Mutex
 }
 
-func (t *targetsManager) AddToPool(poolID, ID, targetURI string) error {
-	var p Pool
-	var err error
-	if p, err = t.getPool(poolID); err != nil {
-		return err
-	}
-	var u *url.URL
-	if u, err = url.Parse(targetURI); err != nil {
+func (t *targetsManager) AddToPool(poolID, ID, targetURI string, weight int) error {
+	u, err := url.Parse(targetURI)
+	if err != nil {
 		return goerr.NewError("Invalid URL", goerr.BadRequest)
 	}
-	p.Add(ID, u)
+	// members are changed with the registry locked so that they are not lost if the pool is being replaced
+	if _, err = t.targets.update(poolID, func(current Target) (Target, error) {
+		var p Pool
+		var err error
+		if p, err = asPool(current); err != nil {
+			return nil, err
+		}
+		p.Add(ID, u, weight)
+		return nil, nil
+	}); err != nil {
+		return err
+	}
+	t.persist()
 	return nil
 }
 
 func (t *targetsManager) RemoveFromPool(poolID, ID string) error {
-	var p Pool
-	var err error
-	if p, err = t.getPool(poolID); err != nil {
+	if _, err := t.targets.update(poolID, func(current Target) (Target, error) {
+		var p Pool
+		var err error
+		if p, err = asPool(current); err != nil {
+			return nil, err
+		}
+		return nil, p.Remove(ID)
+	}); err != nil {
 		return err
 	}
-	p.Remove(ID)
+	t.persist()
 	return nil
 }
 
 func (t *targetsManager) getPool(poolID string) (Pool, error) {
-	var p Target
-	var ok bool
-	if p, ok = t.targets[poolID]; !ok {
+	p, _ := t.targets.get(poolID)
+	return asPool(p)
+}
+
+//asPool checks that a registered target is a pool; p is nil if there is no target
+func asPool(p Target) (Pool, error) {
+	if p == nil {
 		return nil, goerr.NewError("Pool not found", goerr.NotFound)
 	}
 	if p.Type() != TypePool {
@@ -82,12 +115,42 @@ func (t *targetsManager) getPool(poolID string) (Pool, error) {
 }
 
 func (t *targetsManager) CreatePool(conf *TargetConfig) error {
-	if _, ok := t.targets[conf.TID]; ok {
+	if _, ok := t.targets.get(conf.TID); ok {
 		return goerr.NewError("Pool already exists", Conflict)
 	}
+	// the pool endpoint implies the type
+	if conf.TargetType == "" {
+		conf.TargetType = TypePool
+	}
+	if conf.TargetType != TypePool {
+		return goerr.NewError(fmt.Sprintf("Invalid target type '%s', expected '%s'", conf.TargetType, TypePool), goerr.BadRequest)
+	}
+	if problems := ValidateTarget(conf, "").Errors(); len(problems) > 0 {
+		return goerr.NewError(problems.Error(), goerr.BadRequest)
+	}
 	conf.keeper = t.keeper
-	p := NewPool(conf)
-	t.targets[conf.TID] = p
+	p, err := NewPool(conf)
+	if err != nil {
+		return goerr.NewError(err.Error(), goerr.BadRequest)
+	}
+	if !t.targets.add(p) {
+		return goerr.NewError("Pool already exists", Conflict)
+	}
+	t.persist()
+	return nil
+}
+
+func (t *targetsManager) DeletePool(poolID string) error {
+	// the type is checked with the registry locked so that a target replacing the pool meanwhile is not removed
+	p, err := t.targets.removeIf(poolID, func(current Target) error {
+		_, err := asPool(current)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	p.Close()
+	t.persist()
 	return nil
 }
 
@@ -95,7 +158,7 @@ func (t *targetsManager) Proxy(ctx *gin.Context) {
 	targetID := ctx.Param("id")
 	var target Target
 	var exists bool
-	if target, exists = t.targets[targetID]; !exists {
+	if target, exists = t.targets.get(targetID); !exists {
 		ctx.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Target not found for id='%s'", targetID)})
 		return
 	}
@@ -106,12 +169,151 @@ func (t *targetsManager) Proxy(ctx *gin.Context) {
 	target.Handler()(ctx)
 }
 
+//Explain authorizes a request to a target without proxying it; path is the path following the target ID in proxied requests
+func (t *targetsManager) Explain(ID, method, path, token, key string) (*Explanation, error) {
+	var target Target
+	var exists bool
+	if target, exists = t.targets.get(ID); !exists {
+		return nil, goerr.NewError("Target not found", goerr.NotFound)
+	}
+	if p, isPool := target.(*pool); isPool && p.balancer == nil {
+		// addressed pools take the member ID from the path
+		_, path = extractID(path)
+	}
+	return explain(target, method, path, token, key), nil
+}
+
+func (t *targetsManager) Health() map[string][]MemberHealth {
+	targets := t.targets.all()
+	res := make(map[string][]MemberHealth, len(targets))
+	for ID, target := range targets {
+		res[ID] = target.Health()
+	}
+	return res
+}
+
+func (t *targetsManager) Targets() []TargetConfig {
+	targets := t.targets.all()
+	res := make([]TargetConfig, 0, len(targets))
+	for _, target := range targets {
+		res = append(res, target.Config())
+	}
+	sort.Sort(byID(res))
+	return res
+}
+
+func (t *targetsManager) Target(ID string) (TargetConfig, error) {
+	var target Target
+	var ok bool
+	if target, ok = t.targets.get(ID); !ok {
+		return TargetConfig{}, goerr.NewError("Target not found", goerr.NotFound)
+	}
+	return target.Config(), nil
+}
+
+func (t *targetsManager) PoolMembers(poolID string) ([]MemberInfo, error) {
+	var p Pool
+	var err error
+	if p, err = t.getPool(poolID); err != nil {
+		return nil, err
+	}
+	return p.Members(), nil
+}
+
+func (t *targetsManager) CreateTarget(conf *TargetConfig) error {
+	var tg Target
+	var err error
+	if tg, err = t.build(conf); err != nil {
+		return err
+	}
+	if !t.targets.add(tg) {
+		tg.Close()
+		return goerr.NewError("Target already exists", Conflict)
+	}
+	t.persist()
+	return nil
+}
+
+func (t *targetsManager) ReplaceTarget(ID string, conf *TargetConfig) error {
+	if _, ok := t.targets.get(ID); !ok {
+		return goerr.NewError("Target not found", goerr.NotFound)
+	}
+	conf.TID = ID
+	var tg Target
+	var err error
+	if tg, err = t.build(conf); err != nil {
+		return err
+	}
+	var old Target
+	if old, err = t.targets.update(ID, func(current Target) (Target, error) {
+		if current == nil {
+			return nil, goerr.NewError("Target not found", goerr.NotFound)
+		}
+		carryMembers(current, tg)
+		return tg, nil
+	}); err != nil {
+		tg.Close()
+		return err
+	}
+	// requests and websocket connections that already got the old target finish on it while new ones use the replacement
+	old.Retire()
+	t.persist()
+	return nil
+}
+
+func (t *targetsManager) DeleteTarget(ID string) error {
+	var tg Target
+	var ok bool
+	if tg, ok = t.targets.remove(ID); !ok {
+		return goerr.NewError("Target not found", goerr.NotFound)
+	}
+	tg.Close()
+	t.persist()
+	return nil
+}
+
+func (t *targetsManager) build(conf *TargetConfig) (Target, error) {
+	if problems := ValidateTarget(conf, "").Errors(); len(problems) > 0 {
+		return nil, goerr.NewError(problems.Error(), goerr.BadRequest)
+	}
+	conf.keeper = t.keeper
+	var tg Target
+	var err error
+	if tg, err = targetFromConfig(conf); err != nil {
+		return nil, goerr.NewError(err.Error(), goerr.BadRequest)
+	}
+	return tg, nil
+}
+
+//carryMembers adds members of the replaced pool to its replacement
+func carryMembers(old, replacement Target) {
+	from, isPool := old.(Pool)
+	if !isPool {
+		return
+	}
+	to, isPool := replacement.(Pool)
+	if !isPool {
+		return
+	}
+	for _, m := range from.Members() {
+		if u, err := url.Parse(m.URL); err == nil {
+			to.Add(m.ID, u, m.Weight)
+		}
+	}
+}
+
+type byID []TargetConfig
+
+func (b byID) Len() int           { return len(b) }
+func (b byID) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byID) Less(i, j int) bool { return b[i].TID < b[j].TID }
+
 func targetFromConfig(conf *TargetConfig) (Target, error) {
 	switch conf.TargetType {
 	case TypeSingle:
 		return NewSingle(conf)
 	case TypePool:
-		return NewPool(conf), nil
+		return NewPool(conf)
 	}
-	return nil, nil
+	return nil, fmt.Errorf("unknown target type '%s'", conf.TargetType)
 }
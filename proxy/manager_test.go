@@ -1,10 +1,20 @@
 package proxy
 
 import (
+	"context"
+	"fmt"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/mklimuk/goerr"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
@@ -31,7 +41,7 @@ func (suite *ManagerTestSuite) TestConstructor() {
 	}
 	m := NewTargetsManager(targets, k)
 	a := assert.New(suite.T())
-	a.Len(m.(*targetsManager).targets, 3)
+	a.Len(m.(*targetsManager).targets.all(), 3)
 }
 
 func (suite *ManagerTestSuite) TestCreatePool() {
@@ -44,6 +54,25 @@ func (suite *ManagerTestSuite) TestCreatePool() {
 	p, err := m.(*targetsManager).getPool("t2")
 	a.NoError(err)
 	a.NotNil(p)
+	a.Equal(StrategyAddressed, p.Strategy())
+	for _, c = range []*TargetConfig{
+		&TargetConfig{TargetType: TypePool, TargetProtocol: ProtocolHTTP, TID: "t3", Balancing: "unknown"},
+		&TargetConfig{TargetType: TypePool, TID: "t3"},
+		&TargetConfig{TargetType: TypePool, TargetProtocol: "ftp", TID: "t3"},
+		&TargetConfig{TargetType: TypeSingle, TargetProtocol: ProtocolHTTP, TID: "t3", URL: "http://t3.com"},
+		&TargetConfig{TargetType: TypePool, TargetProtocol: ProtocolHTTP},
+	} {
+		err = m.CreatePool(c)
+		a.Error(err)
+		a.Equal(goerr.BadRequest, goerr.GetType(err))
+	}
+	_, err = m.(*targetsManager).getPool("t3")
+	a.Equal(goerr.NotFound, goerr.GetType(err))
+	// the type defaults to pool
+	a.NoError(m.CreatePool(&TargetConfig{TargetProtocol: ProtocolHTTP, TID: "t4"}))
+	p, err = m.(*targetsManager).getPool("t4")
+	a.NoError(err)
+	a.Equal(TypePool, p.Type())
 }
 
 func (suite *ManagerTestSuite) TestAddToPool() {
@@ -53,34 +82,354 @@ func (suite *ManagerTestSuite) TestAddToPool() {
 		&TargetConfig{TargetType: TypePool, TargetProtocol: ProtocolWebsocket, TID: "t1"},
 	}
 	m := NewTargetsManager(targets, k)
-	m.AddToPool("t2", "p1", "http://p1.com")
-	m.AddToPool("t2", "p2", "http://p2.com")
-	m.AddToPool("t1", "ws1", "http://ws1.com")
+	m.AddToPool("t2", "p1", "http://p1.com", 0)
+	m.AddToPool("t2", "p2", "http://p2.com", 2)
+	m.AddToPool("t1", "ws1", "http://ws1.com", 0)
 	a := assert.New(suite.T())
-	a.Len(m.(*targetsManager).targets["t2"].(*pool).rp, 2)
+	p, _ := m.(*targetsManager).targets.get("t2")
+	a.Len(p.(*pool).current().byID, 2)
+	a.Equal(1, p.(*pool).current().byID["p1"].weight)
+	a.Equal(2, p.(*pool).current().byID["p2"].weight)
 }
 
 func (suite *ManagerTestSuite) TestDeleteFromPool() {
-	p := NewPool(&TargetConfig{TargetType: TypePool, TargetProtocol: ProtocolHTTP, TID: "t2"})
-	f := &fakeHandler{}
-	p.(*pool).rp = map[string]http.Handler{
-		"r1": f,
-		"r2": f,
-	}
-	m := &targetsManager{targets: map[string]Target{
-		"t2": p,
-	}}
+	p, _ := NewPool(&TargetConfig{TargetType: TypePool, TargetProtocol: ProtocolHTTP, TID: "t2"})
+	u, _ := url.Parse("http://r.com")
+	p.Add("r1", u, 0)
+	p.Add("r2", u, 0)
+	m := &targetsManager{targets: newRegistry()}
+	m.targets.put(p)
 	a := assert.New(suite.T())
-	a.Len(m.targets["t2"].(*pool).rp, 2)
+	a.Len(p.(*pool).current().byID, 2)
 	m.RemoveFromPool("t2", "r1")
-	a.Len(m.targets["t2"].(*pool).rp, 1)
-	a.NotNil(m.targets["t2"].(*pool).rp["r2"])
+	a.Len(p.(*pool).current().byID, 1)
+	a.Len(p.(*pool).current().order, 1)
+	a.NotNil(p.(*pool).current().byID["r2"])
+	err := m.RemoveFromPool("t2", "r1")
+	a.Error(err)
+	a.Equal(goerr.NotFound, goerr.GetType(err))
+	err = m.RemoveFromPool("t3", "r2")
+	a.Equal(goerr.NotFound, goerr.GetType(err))
+}
+
+func (suite *ManagerTestSuite) TestDeletePool() {
+	k := &GatekeeperMock{}
+	targets := []*TargetConfig{
+		&TargetConfig{TargetType: TypePool, TargetProtocol: ProtocolHTTP, TID: "p1"},
+		&TargetConfig{TargetType: TypeSingle, TargetProtocol: ProtocolHTTP, TID: "s1", URL: "http://s1.com"},
+	}
+	m := NewTargetsManager(targets, k)
+	a := assert.New(suite.T())
+	a.NoError(m.AddToPool("p1", "r1", "http://r1.com", 0))
+	p, _ := m.(*targetsManager).getPool("p1")
+	a.NoError(m.DeletePool("p1"))
+	a.Len(p.(*pool).current().byID, 0)
+	_, ok := m.(*targetsManager).targets.get("p1")
+	a.False(ok)
+	err := m.DeletePool("p1")
+	a.Equal(goerr.NotFound, goerr.GetType(err))
+	err = m.DeletePool("s1")
+	a.Equal(InvalidType, goerr.GetType(err))
+	a.Len(m.(*targetsManager).targets.all(), 1)
+}
+
+func (suite *ManagerTestSuite) TestConcurrentAccess() {
+	a := assert.New(suite.T())
+	upstream := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {}))
+	defer upstream.Close()
+	k := &GatekeeperMock{}
+	k.On("CheckAccess", "", Requirement{}, false).Return(&Identity{Token: ""}, nil)
+	targets := []*TargetConfig{
+		&TargetConfig{TargetType: TypePool, TargetProtocol: ProtocolHTTP, TID: "balanced", Balancing: StrategyRoundRobin, Privileges: &Privileges{}},
+		&TargetConfig{TargetType: TypeSingle, TargetProtocol: ProtocolHTTP, TID: "single", URL: upstream.URL, Privileges: &Privileges{}},
+	}
+	m := NewTargetsManager(targets, k)
+	m.AddToPool("balanced", "stable", upstream.URL, 0)
+	router := gin.New()
+	router.Any("/api/:id/*path", m.Proxy)
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(2)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				ID := fmt.Sprintf("m%d-%d", w, i%5)
+				a.NoError(m.AddToPool("balanced", ID, upstream.URL, 0))
+				m.CreatePool(&TargetConfig{TargetType: TypePool, TargetProtocol: ProtocolHTTP, TID: fmt.Sprintf("p%d", i), Privileges: &Privileges{}})
+				a.NoError(m.RemoveFromPool("balanced", ID))
+				m.Health()
+			}
+		}(w)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				for _, ID := range []string{"balanced", "single"} {
+					req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("/api/%s/test", ID), nil)
+					res := serve(router, req)
+					a.Equal(http.StatusOK, res.Code)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	a.Len(m.(*targetsManager).targets.all(), 52)
+	p, _ := m.(*targetsManager).getPool("balanced")
+	a.Len(p.Health(), 1)
+}
+
+func (suite *ManagerTestSuite) TestListing() {
+	k := &GatekeeperMock{}
+	targets := []*TargetConfig{
+		&TargetConfig{TargetType: TypeSingle, TargetProtocol: ProtocolHTTP, TID: "t3", URL: "http://t3.com", Privileges: &Privileges{Default: 2}},
+		&TargetConfig{TargetType: TypePool, TargetProtocol: ProtocolHTTP, TID: "t1", Balancing: StrategyWeighted},
+	}
+	m := NewTargetsManager(targets, k)
+	a := assert.New(suite.T())
+	list := m.Targets()
+	a.Len(list, 2)
+	a.Equal("t1", list[0].ID())
+	a.Equal("t3", list[1].ID())
+	t, err := m.Target("t3")
+	a.NoError(err)
+	a.Equal("http://t3.com", t.URL)
+	a.Equal(2, t.Privileges.Default)
+	_, err = m.Target("t2")
+	a.Equal(goerr.NotFound, goerr.GetType(err))
+	a.NoError(m.AddToPool("t1", "m1", "http://m1.com", 3))
+	members, err := m.PoolMembers("t1")
+	a.NoError(err)
+	a.Len(members, 1)
+	a.Equal("http://m1.com", members[0].URL)
+	a.Equal(3, members[0].Weight)
+	a.Equal(HealthUnknown, members[0].Health.State)
+	_, err = m.PoolMembers("t3")
+	a.Equal(InvalidType, goerr.GetType(err))
+}
+
+func (suite *ManagerTestSuite) TestTargetCRUD() {
+	a := assert.New(suite.T())
+	k := &GatekeeperMock{}
+	k.On("CheckAccess", "", Requirement{}, false).Return(&Identity{Token: ""}, nil)
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		<-release
+		res.Header().Set("Upstream", "slow")
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Upstream", "fast")
+	}))
+	defer fast.Close()
+	m := NewTargetsManager([]*TargetConfig{}, k)
+	router := gin.New()
+	router.Any("/api/:id/*path", m.Proxy)
+	invalid := []*TargetConfig{
+		&TargetConfig{TargetType: TypeSingle, TargetProtocol: ProtocolHTTP, TID: "s1"},
+		&TargetConfig{TargetType: TypeSingle, TargetProtocol: ProtocolHTTP, TID: "s1", URL: "/relative"},
+		&TargetConfig{TargetType: TypeSingle, TargetProtocol: "FTP", TID: "s1", URL: slow.URL},
+		&TargetConfig{TargetType: "cluster", TargetProtocol: ProtocolHTTP, TID: "s1", URL: slow.URL},
+		&TargetConfig{TargetType: TypeSingle, TargetProtocol: ProtocolHTTP, URL: slow.URL},
+	}
+	for _, c := range invalid {
+		a.Equal(goerr.BadRequest, goerr.GetType(m.CreateTarget(c)))
+	}
+	a.NoError(m.CreateTarget(&TargetConfig{TargetType: TypeSingle, TargetProtocol: ProtocolHTTP, TID: "s1", URL: slow.URL, Privileges: &Privileges{}}))
+	err := m.CreateTarget(&TargetConfig{TargetType: TypeSingle, TargetProtocol: ProtocolHTTP, TID: "s1", URL: fast.URL, Privileges: &Privileges{}})
+	a.Equal(Conflict, goerr.GetType(err))
+	// start a request on the old target and replace it while the request is in flight
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		req, _ := http.NewRequest(http.MethodGet, "/api/s1/test", nil)
+		done <- serve(router, req)
+	}()
+	old, _ := m.(*targetsManager).targets.get("s1")
+	for old.(*single).upstream.activeRequests() == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	err = m.ReplaceTarget("s2", &TargetConfig{TargetType: TypeSingle, TargetProtocol: ProtocolHTTP, URL: fast.URL, Privileges: &Privileges{}})
+	a.Equal(goerr.NotFound, goerr.GetType(err))
+	a.NoError(m.ReplaceTarget("s1", &TargetConfig{TargetType: TypeSingle, TargetProtocol: ProtocolHTTP, URL: fast.URL, Privileges: &Privileges{}}))
+	req, _ := http.NewRequest(http.MethodGet, "/api/s1/test", nil)
+	res := serve(router, req)
+	a.Equal("fast", res.Header().Get("Upstream"))
+	close(release)
+	res = <-done
+	a.Equal(http.StatusOK, res.Code)
+	a.Equal("slow", res.Header().Get("Upstream"))
+	a.NoError(m.DeleteTarget("s1"))
+	a.Equal(goerr.NotFound, goerr.GetType(m.DeleteTarget("s1")))
+}
+
+func (suite *ManagerTestSuite) TestReplacePool() {
+	a := assert.New(suite.T())
+	k := &GatekeeperMock{}
+	targets := []*TargetConfig{
+		&TargetConfig{TargetType: TypePool, TargetProtocol: ProtocolHTTP, TID: "p1"},
+	}
+	m := NewTargetsManager(targets, k)
+	a.NoError(m.AddToPool("p1", "m1", "http://m1.com", 2))
+	a.NoError(m.ReplaceTarget("p1", &TargetConfig{TargetType: TypePool, TargetProtocol: ProtocolHTTP, Balancing: StrategyWeighted}))
+	p, err := m.(*targetsManager).getPool("p1")
+	a.NoError(err)
+	a.Equal(StrategyWeighted, p.Strategy())
+	members := p.Members()
+	a.Len(members, 1)
+	a.Equal(2, members[0].Weight)
+}
+
+func (suite *ManagerTestSuite) TestReplaceKeepsWebsockets() {
+	a := assert.New(suite.T())
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			mt, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			conn.WriteMessage(mt, msg)
+		}
+	}))
+	defer upstream.Close()
+	k := &GatekeeperMock{}
+	k.On("CheckAccess", "", Requirement{}, false).Return(&Identity{}, nil)
+	wsURL := strings.Replace(upstream.URL, "http", "ws", 1)
+	m := NewTargetsManager([]*TargetConfig{
+		&TargetConfig{TargetType: TypeSingle, TargetProtocol: ProtocolWebsocket, TID: "events", URL: wsURL, Privileges: &Privileges{}},
+	}, k)
+	router := gin.New()
+	router.GET("/api/:id/*path", m.Proxy)
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(strings.Replace(srv.URL, "http", "ws", 1)+"/api/events/stream", nil)
+	a.NoError(err)
+	defer conn.Close()
+	a.NoError(m.ReplaceTarget("events", &TargetConfig{TargetType: TypeSingle, TargetProtocol: ProtocolWebsocket, URL: wsURL, Privileges: &Privileges{Default: 0}}))
+	// the connection opened on the replaced target stays open
+	time.Sleep(50 * time.Millisecond)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	a.NoError(conn.WriteMessage(websocket.TextMessage, []byte("ping")))
+	_, msg, err := conn.ReadMessage()
+	a.NoError(err)
+	a.Equal("ping", string(msg))
+	// deleted targets close their connections
+	a.NoError(m.DeleteTarget("events"))
+	_, _, err = conn.ReadMessage()
+	a.Error(err)
+}
+
+func (suite *ManagerTestSuite) TestReplaceWhileAddingMembers() {
+	a := assert.New(suite.T())
+	k := &GatekeeperMock{}
+	m := NewTargetsManager([]*TargetConfig{&TargetConfig{TargetType: TypePool, TargetProtocol: ProtocolHTTP, TID: "p1"}}, k)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			a.NoError(m.AddToPool("p1", fmt.Sprintf("m%d", i), "http://m.com", 0))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			a.NoError(m.ReplaceTarget("p1", &TargetConfig{TargetType: TypePool, TargetProtocol: ProtocolHTTP}))
+		}
+	}()
+	wg.Wait()
+	// members added while the pool is replaced are carried over
+	members, err := m.PoolMembers("p1")
+	a.NoError(err)
+	a.Len(members, 50)
+}
+
+func (suite *ManagerTestSuite) TestReload() {
+	a := assert.New(suite.T())
+	k := &GatekeeperMock{}
+	targets := []*TargetConfig{
+		&TargetConfig{TargetType: TypeSingle, TargetProtocol: ProtocolHTTP, TID: "unchanged", URL: "http://u.com"},
+		&TargetConfig{TargetType: TypeSingle, TargetProtocol: ProtocolHTTP, TID: "changed", URL: "http://c.com"},
+		&TargetConfig{TargetType: TypeSingle, TargetProtocol: ProtocolHTTP, TID: "removed", URL: "http://r.com"},
+		&TargetConfig{TargetType: TypePool, TargetProtocol: ProtocolHTTP, TID: "pool"},
+	}
+	m := NewTargetsManager(targets, k)
+	a.NoError(m.AddToPool("pool", "m1", "http://m1.com", 0))
+	a.NoError(m.CreateTarget(&TargetConfig{TargetType: TypeSingle, TargetProtocol: ProtocolHTTP, TID: "runtime", URL: "http://rt.com"}))
+	registry := m.(*targetsManager).targets
+	unchanged, _ := registry.get("unchanged")
+	changed, _ := registry.get("changed")
+	next := []*TargetConfig{
+		&TargetConfig{TargetType: TypeSingle, TargetProtocol: ProtocolHTTP, TID: "unchanged", URL: "http://u.com"},
+		&TargetConfig{TargetType: TypeSingle, TargetProtocol: ProtocolHTTP, TID: "changed", URL: "http://c2.com"},
+		&TargetConfig{TargetType: TypePool, TargetProtocol: ProtocolHTTP, TID: "pool", Balancing: StrategyRoundRobin},
+		&TargetConfig{TargetType: TypeSingle, TargetProtocol: ProtocolHTTP, TID: "added", URL: "http://a.com"},
+	}
+	a.NoError(m.Reload(next))
+	a.Len(registry.all(), 5)
+	tg, _ := registry.get("unchanged")
+	a.Equal(unchanged, tg)
+	tg, _ = registry.get("changed")
+	a.NotEqual(changed, tg)
+	a.Equal("http://c2.com", tg.URI().String())
+	_, ok := registry.get("removed")
+	a.False(ok)
+	_, ok = registry.get("runtime")
+	a.True(ok)
+	members, _ := m.PoolMembers("pool")
+	a.Len(members, 1)
+	// invalid configurations are rejected as a whole
+	invalid := []*TargetConfig{
+		&TargetConfig{TargetType: TypeSingle, TargetProtocol: ProtocolHTTP, TID: "another", URL: "http://another.com"},
+		&TargetConfig{TargetType: TypeSingle, TargetProtocol: "FTP", TID: "broken", URL: "http://b.com"},
+	}
+	err := m.Reload(invalid)
+	a.Equal(goerr.BadRequest, goerr.GetType(err))
+	duplicated := []*TargetConfig{next[0], next[0]}
+	a.Error(m.Reload(duplicated))
+	a.Len(registry.all(), 5)
+	_, ok = registry.get("another")
+	a.False(ok)
+}
+
+func (suite *ManagerTestSuite) TestExplain() {
+	a := assert.New(suite.T())
+	k := &GatekeeperMock{}
+	privileges := &Privileges{Paths: []*Path{&Path{Exact: "/users", Method: http.MethodGet, Privileges: 3}}}
+	m := NewTargetsManager([]*TargetConfig{
+		&TargetConfig{TargetType: TypeSingle, TargetProtocol: ProtocolHTTP, TID: "single", URL: "http://t1.com", Privileges: privileges},
+		&TargetConfig{TargetType: TypePool, TargetProtocol: ProtocolHTTP, TID: "pool", Privileges: privileges},
+	}, k)
+	_, err := m.Explain("unknown", http.MethodGet, "/users", "", "")
+	a.Equal(goerr.NotFound, goerr.GetType(err))
+	k.On("CheckAccess", "token", Requirement{Privileges: 3}, false).Return(&Identity{Token: "token", Permissions: 3}, nil).Twice()
+	e, err := m.Explain("single", http.MethodGet, "/users", "token", "")
+	a.NoError(err)
+	a.Equal(0, e.RuleIndex)
+	// the member ID of addressed pools is not part of the target path
+	e, err = m.Explain("pool", http.MethodGet, "/m1/users", "token", "")
+	a.NoError(err)
+	a.Equal("/users", e.Path)
+	a.Equal(0, e.RuleIndex)
+	k.AssertExpectations(suite.T())
 }
 
 func TestManagerTestSuite(t *testing.T) {
 	suite.Run(t, new(ManagerTestSuite))
 }
 
+//serve runs a request through h; the request gets a cancellable context as reverse proxies otherwise
+//rely on CloseNotify which the response recorder does not implement
+func serve(h http.Handler, req *http.Request) *httptest.ResponseRecorder {
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	res := httptest.NewRecorder()
+	h.ServeHTTP(res, req.WithContext(ctx))
+	return res
+}
+
 type fakeHandler struct{}
 
 func (f *fakeHandler) ServeHTTP(res http.ResponseWriter, req *http.Request) {}
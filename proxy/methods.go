@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// method wildcards
+const (
+	MethodAny      = "*"
+	MethodAnyAlias = "ANY"
+	methodExcept   = "!"
+)
+
+//Methods lists HTTP methods a path rule applies to. It is given as a single method, a list or a comma separated string.
+//* or ANY match all methods, methods prefixed with ! are excluded, e.g. !GET applies to all methods except GET.
+//Excluded methods are only meaningful together with a wildcard or on their own.
+type Methods string
+
+//NewMethods joins a list of methods in their canonical form
+func NewMethods(methods ...string) Methods {
+	list := make([]string, 0, len(methods))
+	for _, m := range methods {
+		for _, item := range strings.Split(m, ",") {
+			if item = strings.ToUpper(strings.TrimSpace(item)); item != "" {
+				list = append(list, item)
+			}
+		}
+	}
+	return Methods(strings.Join(list, ","))
+}
+
+//matches reports whether the rule applies to the method; the list is scanned in place to avoid allocations on each request
+func (m Methods) matches(method string) bool {
+	list := string(m)
+	wildcard, positive, included := false, false, false
+	for list != "" {
+		item := list
+		if i := strings.IndexByte(list, ','); i >= 0 {
+			item, list = list[:i], list[i+1:]
+		} else {
+			list = ""
+		}
+		switch {
+		case item == MethodAny || item == MethodAnyAlias:
+			wildcard = true
+		case strings.HasPrefix(item, methodExcept):
+			if item[len(methodExcept):] == method {
+				return false
+			}
+		default:
+			positive = true
+			included = included || item == method
+		}
+	}
+	return included || wildcard || (!positive && m != "")
+}
+
+//items returns the methods of the list
+func (m Methods) items() []string {
+	if m == "" {
+		return nil
+	}
+	return strings.Split(string(m), ",")
+}
+
+//UnmarshalYAML accepts a single method, a comma separated string or a list
+func (m *Methods) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var single string
+	if err := unmarshal(&single); err == nil {
+		*m = NewMethods(single)
+		return nil
+	}
+	var list []string
+	if err := unmarshal(&list); err != nil {
+		return err
+	}
+	*m = NewMethods(list...)
+	return nil
+}
+
+//UnmarshalJSON accepts a single method, a comma separated string or a list
+func (m *Methods) UnmarshalJSON(b []byte) error {
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		*m = NewMethods(single)
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		return err
+	}
+	*m = NewMethods(list...)
+	return nil
+}
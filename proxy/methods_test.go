@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	yaml "gopkg.in/yaml.v2"
+)
+
+type MethodsTestSuite struct {
+	suite.Suite
+}
+
+func (suite *MethodsTestSuite) TestMatches() {
+	a := assert.New(suite.T())
+	for _, c := range []struct {
+		methods Methods
+		match   []string
+		noMatch []string
+	}{
+		{"GET", []string{"GET"}, []string{"POST", "HEAD", ""}},
+		{"POST,PUT,PATCH,DELETE", []string{"POST", "PUT", "PATCH", "DELETE"}, []string{"GET", "HEAD"}},
+		{"*", []string{"GET", "POST", "PROPFIND"}, nil},
+		{"ANY", []string{"GET", "OPTIONS"}, nil},
+		{"!GET", []string{"POST", "DELETE", "HEAD"}, []string{"GET"}},
+		{"!GET,!HEAD", []string{"POST"}, []string{"GET", "HEAD"}},
+		{"*,!OPTIONS", []string{"GET"}, []string{"OPTIONS"}},
+		{"POST,!GET", []string{"POST"}, []string{"GET", "PUT"}},
+		{"", nil, []string{"GET"}},
+	} {
+		for _, m := range c.match {
+			a.True(c.methods.matches(m), "%s should match %s", c.methods, m)
+		}
+		for _, m := range c.noMatch {
+			a.False(c.methods.matches(m), "%s should not match %s", c.methods, m)
+		}
+	}
+}
+
+func (suite *MethodsTestSuite) TestUnmarshal() {
+	a := assert.New(suite.T())
+	var p Path
+	a.NoError(yaml.Unmarshal([]byte("method: GET"), &p))
+	a.Equal(Methods("GET"), p.Method)
+	a.NoError(yaml.Unmarshal([]byte("method: [post, ' PUT', DELETE]"), &p))
+	a.Equal(Methods("POST,PUT,DELETE"), p.Method)
+	a.NoError(yaml.Unmarshal([]byte("method: '!get, !head'"), &p))
+	a.Equal(Methods("!GET,!HEAD"), p.Method)
+	a.Error(yaml.Unmarshal([]byte("method: {get: true}"), &p))
+	a.NoError(json.Unmarshal([]byte(`{"method":["GET","head"]}`), &p))
+	a.Equal(Methods("GET,HEAD"), p.Method)
+	a.NoError(json.Unmarshal([]byte(`{"method":"*"}`), &p))
+	a.Equal(Methods("*"), p.Method)
+	a.Error(json.Unmarshal([]byte(`{"method":5}`), &p))
+	b, _ := json.Marshal(&Path{Method: NewMethods("post", "put")})
+	a.Contains(string(b), `"method":"POST,PUT"`)
+}
+
+func BenchmarkMethodsMatches(b *testing.B) {
+	m := NewMethods("POST", "PUT", "PATCH", "DELETE")
+	for i := 0; i < b.N; i++ {
+		m.matches("DELETE")
+	}
+}
+
+func TestMethodsTestSuite(t *testing.T) {
+	suite.Run(t, new(MethodsTestSuite))
+}
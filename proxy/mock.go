@@ -11,8 +11,8 @@ type TargetsManagerMock struct {
 }
 
 //AddToPool is a mocked method
-func (m *TargetsManagerMock) AddToPool(poolID, ID, targetURI string) error {
-	args := m.Called(poolID, ID, targetURI)
+func (m *TargetsManagerMock) AddToPool(poolID, ID, targetURI string, weight int) error {
+	args := m.Called(poolID, ID, targetURI, weight)
 	return args.Error(0)
 }
 
@@ -28,18 +28,133 @@ func (m *TargetsManagerMock) CreatePool(conf *TargetConfig) error {
 	return args.Error(0)
 }
 
+//DeletePool is a mocked method
+func (m *TargetsManagerMock) DeletePool(poolID string) error {
+	args := m.Called(poolID)
+	return args.Error(0)
+}
+
 //Proxy is a mocked method
 func (m *TargetsManagerMock) Proxy(ctx *gin.Context) {
 	m.Called(ctx)
 }
 
+//Health is a mocked method
+func (m *TargetsManagerMock) Health() map[string][]MemberHealth {
+	args := m.Called()
+	return args.Get(0).(map[string][]MemberHealth)
+}
+
+//Targets is a mocked method
+func (m *TargetsManagerMock) Targets() []TargetConfig {
+	args := m.Called()
+	return args.Get(0).([]TargetConfig)
+}
+
+//Target is a mocked method
+func (m *TargetsManagerMock) Target(ID string) (TargetConfig, error) {
+	args := m.Called(ID)
+	return args.Get(0).(TargetConfig), args.Error(1)
+}
+
+//CreateTarget is a mocked method
+func (m *TargetsManagerMock) CreateTarget(conf *TargetConfig) error {
+	args := m.Called(conf)
+	return args.Error(0)
+}
+
+//ReplaceTarget is a mocked method
+func (m *TargetsManagerMock) ReplaceTarget(ID string, conf *TargetConfig) error {
+	args := m.Called(ID, conf)
+	return args.Error(0)
+}
+
+//DeleteTarget is a mocked method
+func (m *TargetsManagerMock) DeleteTarget(ID string) error {
+	args := m.Called(ID)
+	return args.Error(0)
+}
+
+//Reload is a mocked method
+func (m *TargetsManagerMock) Reload(targets []*TargetConfig) error {
+	args := m.Called(targets)
+	return args.Error(0)
+}
+
+//PoolMembers is a mocked method
+func (m *TargetsManagerMock) PoolMembers(poolID string) ([]MemberInfo, error) {
+	args := m.Called(poolID)
+	return args.Get(0).([]MemberInfo), args.Error(1)
+}
+
+//Explain is a mocked method
+func (m *TargetsManagerMock) Explain(ID, method, path, token, key string) (*Explanation, error) {
+	args := m.Called(ID, method, path, token, key)
+	e, _ := args.Get(0).(*Explanation)
+	return e, args.Error(1)
+}
+
 //GatekeeperMock is a mock of the Gatekeeper interface
 type GatekeeperMock struct {
 	mock.Mock
 }
 
 //CheckAccess is a mocked method
-func (m *GatekeeperMock) CheckAccess(token string, accessPrivileges int, updateToken bool) (string, error) {
-	args := m.Called(token, accessPrivileges, updateToken)
-	return args.String(0), args.Error(1)
+func (m *GatekeeperMock) CheckAccess(token string, req Requirement, updateToken bool) (*Identity, error) {
+	args := m.Called(token, req, updateToken)
+	id, _ := args.Get(0).(*Identity)
+	return id, args.Error(1)
+}
+
+//CheckKey is a mocked method
+func (m *GatekeeperMock) CheckKey(key, target string, req Requirement) (*Identity, error) {
+	args := m.Called(key, target, req)
+	id, _ := args.Get(0).(*Identity)
+	return id, args.Error(1)
+}
+
+//TokenCacheControlMock is a mock of the TokenCacheControl interface
+type TokenCacheControlMock struct {
+	mock.Mock
+}
+
+//Invalidate is a mocked method
+func (m *TokenCacheControlMock) Invalidate(token string) bool {
+	args := m.Called(token)
+	return args.Bool(0)
+}
+
+//InvalidateAll is a mocked method
+func (m *TokenCacheControlMock) InvalidateAll() int {
+	args := m.Called()
+	return args.Int(0)
+}
+
+//CacheStats is a mocked method
+func (m *TokenCacheControlMock) CacheStats() CacheStats {
+	args := m.Called()
+	return args.Get(0).(CacheStats)
+}
+
+//APIKeyControlMock is a mock of the APIKeyControl interface
+type APIKeyControlMock struct {
+	mock.Mock
+}
+
+//Keys is a mocked method
+func (m *APIKeyControlMock) Keys() []APIKey {
+	args := m.Called()
+	return args.Get(0).([]APIKey)
+}
+
+//AddKey is a mocked method
+func (m *APIKeyControlMock) AddKey(key APIKey) (APIKey, error) {
+	args := m.Called(key)
+	return args.Get(0).(APIKey), args.Error(1)
+}
+
+//RemoveKey is a mocked method
+func (m *APIKeyControlMock) RemoveKey(ID string) bool {
+	args := m.Called(ID)
+	return args.Bool(0)
 }
@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"sync/atomic"
+
+	"github.com/mklimuk/goerr"
+)
+
+//Forbidden is the error type returned when a valid token or API key does not grant access to a path
+const Forbidden goerr.ErrorType = 20
+
+//Policy decides about requests no path privileges rule applies to
+type Policy string
+
+// default policies
+const (
+	// PolicyAllow lets requests through with the default privileges of the target
+	PolicyAllow Policy = "allow"
+	// PolicyDeny rejects requests with 403
+	PolicyDeny Policy = "deny"
+)
+
+//Access is the kind of a path privileges rule; rules without access require their privileges, roles and scopes
+type Access string
+
+// path rule kinds
+const (
+	// AccessDeny rejects matching requests with 403, the path is never proxied
+	AccessDeny Access = "deny"
+	// AccessAnonymous lets matching requests through without a token; tokens sent anyway are checked
+	AccessAnonymous Access = "allow-anonymous"
+)
+
+// denyUnprotected is set to 1 if targets without privileges settings reject all requests
+var denyUnprotected int32
+
+//DenyUnprotected makes targets without a privileges block and without a default policy reject all requests with 403
+func DenyUnprotected(deny bool) {
+	var v int32
+	if deny {
+		v = 1
+	}
+	atomic.StoreInt32(&denyUnprotected, v)
+}
+
+//policy returns the effective default policy of the target
+func (t *TargetConfig) policy() Policy {
+	if t.DefaultPolicy != "" {
+		return t.DefaultPolicy
+	}
+	if t.Privileges == nil && atomic.LoadInt32(&denyUnprotected) == 1 {
+		return PolicyDeny
+	}
+	return PolicyAllow
+}
@@ -3,56 +3,165 @@ package proxy
 import (
 	"fmt"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
 	"regexp"
+	"sync"
+	"sync/atomic"
 
 	"github.com/gin-gonic/gin"
-	"github.com/koding/websocketproxy"
+	"github.com/mklimuk/goerr"
 )
 
 //NewPool is a pooled proxy target constructor
-func NewPool(t *TargetConfig) Pool {
+func NewPool(t *TargetConfig) (Pool, error) {
 	p := &pool{
 		TargetConfig: *t,
-		rp:           make(map[string]http.Handler),
 	}
-	return Pool(p)
+	p.members.Store(&memberSet{byID: make(map[string]*member)})
+	var err error
+	if p.balancer, err = newBalancer(t.Strategy()); err != nil {
+		return nil, err
+	}
+	if p.routes, err = newRoutes(t.Privileges); err != nil {
+		return nil, err
+	}
+	if p.rewriter, err = newRewriter(t.Rewrite); err != nil {
+		return nil, err
+	}
+	return Pool(p), nil
 }
 
 type pool struct {
 	TargetConfig
-	rp map[string]http.Handler
+	// members holds the current *memberSet; it is replaced, never modified, by Add and Remove
+	members  atomic.Value
+	mu       sync.Mutex
+	balancer balancer
+}
+
+//memberSet is an immutable snapshot of pool members
+type memberSet struct {
+	byID  map[string]*member
+	order []*member
 }
 
 func (t *pool) Handler() func(ctx *gin.Context) {
 	return func(ctx *gin.Context) {
 		path := ctx.Param("path")
-		var id string
-		id, path = extractID(path)
-
-		var rp http.Handler
-		var ok bool
-		if rp, ok = t.rp[id]; !ok {
-			ctx.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("target %s not found", id)})
+		set := t.current()
+		if t.balancer == nil {
+			var id string
+			id, path = extractID(path)
+			var m *member
+			var ok bool
+			if m, ok = set.byID[id]; !ok {
+				ctx.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("target %s not found", id)})
+				return
+			}
+			if !m.health.healthy() {
+				ctx.JSON(http.StatusServiceUnavailable, gin.H{"error": fmt.Sprintf("target %s is down", id)})
+				return
+			}
+			checkAuthAndServe(t, path, m, m.breaker, ctx)
+			return
+		}
+		var m *member
+		if m = t.balancer.next(set.available()); m == nil {
+			ctx.JSON(http.StatusServiceUnavailable, gin.H{"error": fmt.Sprintf("no members available in pool %s", t.ID())})
 			return
 		}
-		checkAuthAndServe(t, path, rp, ctx)
+		checkAuthAndServe(t, path, m, m.breaker, ctx)
+	}
+}
+
+func (t *pool) Add(ID string, uri *url.URL, weight int) {
+	m := newUpstream(&t.TargetConfig, ID, uri, weight)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.replace(ID, m)
+	m.health.start()
+}
+
+func (t *pool) Remove(ID string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.current().byID[ID]; !ok {
+		return goerr.NewError("Pool member not found", goerr.NotFound)
+	}
+	t.replace(ID, nil)
+	return nil
+}
+
+//Close removes all members of the pool draining their requests and closing websocket connections
+func (t *pool) Close() {
+	t.removeAll(true)
+}
+
+//Retire removes all members of the pool letting their requests and websocket connections complete
+func (t *pool) Retire() {
+	t.removeAll(false)
+}
+
+func (t *pool) removeAll(closeConns bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, m := range t.current().order {
+		go m.drain(t.ID(), drainTimeout, closeConns)
+	}
+	t.members.Store(&memberSet{byID: make(map[string]*member)})
+}
+
+//replace swaps the member registered under ID with m (or just removes it when m is nil); callers must hold t.mu
+func (t *pool) replace(ID string, m *member) {
+	current := t.current()
+	next := &memberSet{byID: make(map[string]*member, len(current.byID)+1), order: make([]*member, 0, len(current.order)+1)}
+	for _, existing := range current.order {
+		if existing.id == ID {
+			// requests already routed to the old member are allowed to finish
+			go existing.drain(t.ID(), drainTimeout, true)
+			continue
+		}
+		next.byID[existing.id] = existing
+		next.order = append(next.order, existing)
 	}
+	if m != nil {
+		next.byID[ID] = m
+		next.order = append(next.order, m)
+	}
+	t.members.Store(next)
+}
+
+func (t *pool) current() *memberSet {
+	return t.members.Load().(*memberSet)
+}
+
+func (t *pool) Health() []MemberHealth {
+	set := t.current()
+	res := make([]MemberHealth, 0, len(set.order))
+	for _, m := range set.order {
+		res = append(res, m.status())
+	}
+	return res
 }
 
-func (t *pool) Add(ID string, uri *url.URL) {
-	if t.Protocol() == ProtocolHTTP {
-		t.rp[ID] = httputil.NewSingleHostReverseProxy(uri)
-	} else {
-		proxy := websocketproxy.NewProxy(uri)
-		proxy.Upgrader = upgrader
-		t.rp[ID] = proxy
+func (t *pool) Members() []MemberInfo {
+	set := t.current()
+	res := make([]MemberInfo, 0, len(set.order))
+	for _, m := range set.order {
+		res = append(res, m.info())
 	}
+	return res
 }
 
-func (t *pool) Remove(ID string) {
-	delete(t.rp, ID)
+//available returns members that may receive traffic
+func (s *memberSet) available() []*member {
+	res := make([]*member, 0, len(s.order))
+	for _, m := range s.order {
+		if m.health.healthy() && m.breaker.available() {
+			res = append(res, m)
+		}
+	}
+	return res
 }
 
 var extract = regexp.MustCompile(`\/`)
@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type PoolTestSuite struct {
+	suite.Suite
+	router  *gin.Engine
+	keeper  GatekeeperMock
+	serv    *httptest.Server
+	members []*httptest.Server
+}
+
+func (suite *PoolTestSuite) SetupSuite() {
+	log.SetLevel(log.DebugLevel)
+	suite.keeper = GatekeeperMock{}
+	suite.keeper.On("CheckAccess", "", Requirement{}, false).Return(&Identity{Token: ""}, nil)
+	suite.router = gin.New()
+	suite.serv = httptest.NewServer(suite.router)
+	for i := 1; i <= 2; i++ {
+		r := gin.New()
+		r.GET("/*rest", memberHandler(fmt.Sprintf("m%d", i)))
+		suite.members = append(suite.members, httptest.NewServer(r))
+	}
+	suite.addPool("addressed", "")
+	suite.addPool("balanced", StrategyRoundRobin)
+	suite.addPool("empty", StrategyRoundRobin)
+}
+
+func (suite *PoolTestSuite) addPool(ID string, s Strategy) Pool {
+	c := &TargetConfig{Privileges: &Privileges{}, TID: ID, TargetProtocol: ProtocolHTTP, TargetType: TypePool, Balancing: s}
+	c.keeper = &suite.keeper
+	p, _ := NewPool(c)
+	if ID != "empty" {
+		for i, m := range suite.members {
+			u, _ := url.Parse(m.URL)
+			p.Add(fmt.Sprintf("m%d", i+1), u, 0)
+		}
+	}
+	suite.router.GET(fmt.Sprintf("/%s/*path", ID), p.Handler())
+	return p
+}
+
+func (suite *PoolTestSuite) TearDownSuite() {
+	suite.serv.Close()
+	for _, m := range suite.members {
+		m.Close()
+	}
+}
+
+func (suite *PoolTestSuite) TestAddressed() {
+	a := assert.New(suite.T())
+	res, err := http.Get(fmt.Sprintf("%s%s", suite.serv.URL, "/addressed/m2/test"))
+	a.NoError(err)
+	a.Equal(http.StatusOK, res.StatusCode)
+	a.Equal("m2", res.Header.Get("Member"))
+	a.Equal("/test", res.Header.Get("Path"))
+	res, err = http.Get(fmt.Sprintf("%s%s", suite.serv.URL, "/addressed/m3/test"))
+	a.NoError(err)
+	a.Equal(http.StatusNotFound, res.StatusCode)
+}
+
+func (suite *PoolTestSuite) TestBalanced() {
+	a := assert.New(suite.T())
+	seen := make(map[string]int)
+	for i := 0; i < 4; i++ {
+		res, err := http.Get(fmt.Sprintf("%s%s", suite.serv.URL, "/balanced/m2/test"))
+		a.NoError(err)
+		a.Equal(http.StatusOK, res.StatusCode)
+		a.Equal("/m2/test", res.Header.Get("Path"))
+		seen[res.Header.Get("Member")]++
+	}
+	a.Equal(2, seen["m1"])
+	a.Equal(2, seen["m2"])
+}
+
+func (suite *PoolTestSuite) TestNoMembers() {
+	a := assert.New(suite.T())
+	res, err := http.Get(fmt.Sprintf("%s%s", suite.serv.URL, "/empty/test"))
+	a.NoError(err)
+	a.Equal(http.StatusServiceUnavailable, res.StatusCode)
+}
+
+func TestPoolTestSuite(t *testing.T) {
+	suite.Run(t, new(PoolTestSuite))
+}
+
+func memberHandler(ID string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		ctx.Header("Member", ID)
+		ctx.Header("Path", ctx.Request.URL.Path)
+		ctx.AbortWithStatus(http.StatusOK)
+	}
+}
@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+//registry is a copy-on-write set of targets; reads are lock-free while writers are serialized
+type registry struct {
+	mu       sync.Mutex
+	snapshot atomic.Value
+}
+
+func newRegistry() *registry {
+	r := &registry{}
+	r.snapshot.Store(make(map[string]Target))
+	return r
+}
+
+//all returns the current snapshot which must not be modified
+func (r *registry) all() map[string]Target {
+	return r.snapshot.Load().(map[string]Target)
+}
+
+func (r *registry) get(ID string) (Target, bool) {
+	t, ok := r.all()[ID]
+	return t, ok
+}
+
+//add registers a target unless one with the same ID already exists
+func (r *registry) add(t Target) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	current := r.all()
+	if _, exists := current[t.ID()]; exists {
+		return false
+	}
+	r.swap(current, func(next map[string]Target) { next[t.ID()] = t })
+	return true
+}
+
+//put registers a target replacing an existing one which is returned
+func (r *registry) put(t Target) (Target, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	current := r.all()
+	old, exists := current[t.ID()]
+	r.swap(current, func(next map[string]Target) { next[t.ID()] = t })
+	return old, exists
+}
+
+//update runs fn on the target registered under ID, nil if there is none, while other writers are blocked.
+//A target returned by fn is registered under ID; the previous target is returned.
+func (r *registry) update(ID string, fn func(current Target) (Target, error)) (Target, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	current := r.all()
+	old := current[ID]
+	next, err := fn(old)
+	if err != nil {
+		return nil, err
+	}
+	if next != nil {
+		r.swap(current, func(m map[string]Target) { m[ID] = next })
+	}
+	return old, nil
+}
+
+//remove unregisters a target and returns it
+func (r *registry) remove(ID string) (Target, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	current := r.all()
+	t, exists := current[ID]
+	if !exists {
+		return nil, false
+	}
+	r.swap(current, func(next map[string]Target) { delete(next, ID) })
+	return t, true
+}
+
+//removeIf unregisters the target registered under ID if check, run while other writers are blocked, accepts it;
+//check is called with nil if there is no target
+func (r *registry) removeIf(ID string, check func(t Target) error) (Target, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	current := r.all()
+	t := current[ID]
+	if err := check(t); err != nil {
+		return nil, err
+	}
+	if t != nil {
+		r.swap(current, func(next map[string]Target) { delete(next, ID) })
+	}
+	return t, nil
+}
+
+func (r *registry) swap(current map[string]Target, mutate func(map[string]Target)) {
+	next := make(map[string]Target, len(current)+1)
+	for k, v := range current {
+		next[k] = v
+	}
+	mutate(next)
+	r.snapshot.Store(next)
+}
@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/mklimuk/goerr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type RegistryTestSuite struct {
+	suite.Suite
+}
+
+func (suite *RegistryTestSuite) TestSnapshots() {
+	a := assert.New(suite.T())
+	r := newRegistry()
+	t1, _ := NewPool(&TargetConfig{TID: "t1", TargetType: TypePool, TargetProtocol: ProtocolHTTP})
+	t2, _ := NewPool(&TargetConfig{TID: "t2", TargetType: TypePool, TargetProtocol: ProtocolHTTP})
+	a.True(r.add(t1))
+	a.False(r.add(t1))
+	before := r.all()
+	r.put(t2)
+	// earlier snapshots are never modified
+	a.Len(before, 1)
+	a.Len(r.all(), 2)
+	t1b, _ := NewPool(&TargetConfig{TID: "t1", TargetType: TypePool, TargetProtocol: ProtocolWebsocket})
+	old, err := r.update("t1", func(current Target) (Target, error) {
+		a.Equal(t1, current)
+		return t1b, nil
+	})
+	a.NoError(err)
+	a.Equal(t1, old)
+	_, err = r.update("t3", func(current Target) (Target, error) {
+		a.Nil(current)
+		return nil, goerr.NewError("Target not found", goerr.NotFound)
+	})
+	a.Equal(goerr.NotFound, goerr.GetType(err))
+	_, ok := r.get("t3")
+	a.False(ok)
+	removed, ok := r.remove("t1")
+	a.True(ok)
+	a.Equal(t1b, removed)
+	_, ok = r.remove("t1")
+	a.False(ok)
+	_, err = r.removeIf("t2", func(t Target) error {
+		a.Equal(t2, t)
+		return goerr.NewError("Invalid target type", InvalidType)
+	})
+	a.Equal(InvalidType, goerr.GetType(err))
+	_, ok = r.get("t2")
+	a.True(ok)
+	_, ok = r.get("t1")
+	a.False(ok)
+	got, ok := r.get("t2")
+	a.True(ok)
+	a.Equal(t2, got)
+}
+
+func TestRegistryTestSuite(t *testing.T) {
+	suite.Run(t, new(RegistryTestSuite))
+}
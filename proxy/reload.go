@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/mklimuk/goerr"
+)
+
+//Reload applies a new set of configured targets. Targets whose configuration did not change are left untouched,
+//targets created at runtime are only affected when the configuration defines a target with the same ID.
+//Nothing is applied if any of the targets is invalid.
+func (t *targetsManager) Reload(targets []*TargetConfig) error {
+	if err := t.reload(targets); err != nil {
+		return err
+	}
+	t.persist()
+	return nil
+}
+
+func (t *targetsManager) reload(targets []*TargetConfig) error {
+	t.reloadMu.Lock()
+	defer t.reloadMu.Unlock()
+	if problems := ValidateTargets(targets, "targets").Errors(); len(problems) > 0 {
+		return goerr.NewError(problems.Error(), goerr.BadRequest)
+	}
+	next := make(map[string][]byte, len(targets))
+	built := make(map[string]Target)
+	var err error
+	for _, conf := range targets {
+		var fp []byte
+		if fp, err = fingerprint(conf); err != nil {
+			closeTargets(built)
+			return goerr.NewError(fmt.Sprintf("target '%s': %s", conf.TID, err.Error()), goerr.BadRequest)
+		}
+		next[conf.TID] = fp
+		if _, exists := t.targets.get(conf.TID); exists && bytes.Equal(t.configured[conf.TID], fp) {
+			continue
+		}
+		var tg Target
+		if tg, err = t.build(conf); err != nil {
+			closeTargets(built)
+			return goerr.NewError(fmt.Sprintf("target '%s': %s", conf.TID, err.Error()), goerr.BadRequest)
+		}
+		built[conf.TID] = tg
+	}
+	clog := log.WithFields(log.Fields{"logger": "api-proxy.manager", "method": "Reload"})
+	for ID := range t.configured {
+		if _, kept := next[ID]; kept {
+			continue
+		}
+		if tg, ok := t.targets.remove(ID); ok {
+			tg.Close()
+			clog.WithField("target", ID).Info("Target removed")
+		}
+	}
+	for ID, tg := range built {
+		old, _ := t.targets.update(ID, func(current Target) (Target, error) {
+			if current != nil {
+				carryMembers(current, tg)
+			}
+			return tg, nil
+		})
+		if old != nil {
+			old.Retire()
+			clog.WithField("target", ID).Info("Target updated")
+			continue
+		}
+		clog.WithField("target", ID).Info("Target added")
+	}
+	t.configured = next
+	return nil
+}
+
+//fingerprint serializes the exported target settings so that configurations can be compared
+func fingerprint(conf *TargetConfig) ([]byte, error) {
+	return json.Marshal(conf)
+}
+
+func closeTargets(targets map[string]Target) {
+	for _, tg := range targets {
+		tg.Close()
+	}
+}
@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"net/url"
+	pathpkg "path"
+	"regexp"
+	"strings"
+)
+
+//Rewrite changes the path of requests before they are passed to the upstream. The prefix is stripped first,
+//then replacements are applied in order and the prefix is added last. Rewrites work on the escaped path, e.g. /a%20b,
+//and do not change which privileges rules apply as these match the path sent by the client.
+type Rewrite struct {
+	// StripPrefix removes a leading path, e.g. /v1 turns /v1/items into /items; other paths are not changed
+	StripPrefix string `yaml:"stripPrefix" json:"stripPrefix,omitempty"`
+	// Replace lists regular expression replacements; replacements may refer to capture groups as $1 or ${name}
+	Replace []*Replace `yaml:"replace" json:"replace,omitempty"`
+	// AddPrefix is prepended to the path, e.g. /catalog turns /items into /catalog/items
+	AddPrefix string `yaml:"addPrefix" json:"addPrefix,omitempty"`
+}
+
+//Replace replaces all matches of Regex in the path with Replacement
+type Replace struct {
+	Regex       string `yaml:"regex" json:"regex"`
+	Replacement string `yaml:"replacement" json:"replacement"`
+}
+
+//rewriter is the compiled form of the rewrite settings of a target
+type rewriter struct {
+	strip   string
+	add     string
+	regexes []*regexp.Regexp
+	replace []string
+}
+
+//newRewriter compiles rewrite settings; it returns nil if paths are passed unchanged
+func newRewriter(r *Rewrite) (*rewriter, error) {
+	if r == nil {
+		return nil, nil
+	}
+	rw := &rewriter{strip: strings.TrimSuffix(r.StripPrefix, pathSeparator), add: strings.TrimSuffix(r.AddPrefix, pathSeparator)}
+	for _, rep := range r.Replace {
+		if rep == nil {
+			continue
+		}
+		var re *regexp.Regexp
+		var err error
+		if re, err = regexp.Compile(rep.Regex); err != nil {
+			return nil, err
+		}
+		rw.regexes = append(rw.regexes, re)
+		rw.replace = append(rw.replace, rep.Replacement)
+	}
+	return rw, nil
+}
+
+//rewrite returns the upstream path of an escaped request path
+func (rw *rewriter) rewrite(path string) string {
+	if rw == nil {
+		return path
+	}
+	if rw.strip != "" && strings.HasPrefix(path, rw.strip) {
+		// only whole segments are stripped
+		if rest := path[len(rw.strip):]; rest == "" || strings.HasPrefix(rest, pathSeparator) {
+			path = rest
+		}
+	}
+	for i, re := range rw.regexes {
+		path = re.ReplaceAllString(path, rw.replace[i])
+	}
+	if !strings.HasPrefix(path, pathSeparator) {
+		path = pathSeparator + path
+	}
+	if rw.add != "" {
+		path = rw.add + path
+	}
+	return path
+}
+
+//canonicalPath cleans a decoded request path so that rules match the path the upstream resolves:
+//duplicate slashes and . or .. segments are removed, e.g. //admin becomes /admin; a trailing slash is kept
+func canonicalPath(path string) string {
+	if path == "" {
+		return path
+	}
+	clean := pathpkg.Clean(path)
+	if strings.HasSuffix(path, pathSeparator) && clean != pathSeparator {
+		clean += pathSeparator
+	}
+	return clean
+}
+
+//escapedPath returns path, the decoded end of the request path, as escaped by the client;
+//path is escaped again if it can not be found in the request
+func escapedPath(u *url.URL, path string) string {
+	fallback := (&url.URL{Path: path}).EscapedPath()
+	if path == "" || !strings.HasSuffix(u.Path, path) {
+		return fallback
+	}
+	// path starts after the slashes of the route prefix, e.g. /api/:id
+	prefix := strings.Count(u.Path[:len(u.Path)-len(path)], pathSeparator)
+	escaped := u.EscapedPath()
+	idx := -1
+	for n := 0; n <= prefix; n++ {
+		j := strings.IndexByte(escaped[idx+1:], '/')
+		if j < 0 {
+			return fallback
+		}
+		idx += j + 1
+	}
+	res := escaped[idx:]
+	if p, err := url.PathUnescape(res); err != nil || p != path {
+		return fallback
+	}
+	return res
+}
+
+//joinPath appends the path of u to the path of the upstream URL base with a single slash between them; escaped characters are kept
+func joinPath(base, u *url.URL) (path, rawPath string) {
+	suffix := u.EscapedPath()
+	if suffix == "" {
+		return base.Path, base.RawPath
+	}
+	if !strings.HasPrefix(suffix, pathSeparator) {
+		suffix = pathSeparator + suffix
+	}
+	rawPath = strings.TrimSuffix(base.EscapedPath(), pathSeparator) + suffix
+	var err error
+	if path, err = url.PathUnescape(rawPath); err != nil {
+		return base.Path + u.Path, ""
+	}
+	return path, rawPath
+}
@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type RewriteTestSuite struct {
+	suite.Suite
+}
+
+func (suite *RewriteTestSuite) TestRewrite() {
+	a := assert.New(suite.T())
+	rw, err := newRewriter(nil)
+	a.NoError(err)
+	a.Equal("/items", rw.rewrite("/items"))
+	rw, err = newRewriter(&Rewrite{StripPrefix: "/v1/", AddPrefix: "/catalog/"})
+	a.NoError(err)
+	for path, expected := range map[string]string{
+		"/v1/items":     "/catalog/items",
+		"/v1":           "/catalog/",
+		"/v1/":          "/catalog/",
+		"/v1x/items":    "/catalog/v1x/items",
+		"/items":        "/catalog/items",
+		"/v1//items":    "/catalog//items",
+		"/v1/a%2Fb%20c": "/catalog/a%2Fb%20c",
+	} {
+		a.Equal(expected, rw.rewrite(path), path)
+	}
+	rw, err = newRewriter(&Rewrite{Replace: []*Replace{
+		&Replace{Regex: `^/users/([^/]+)/avatar$`, Replacement: "/avatars/$1"},
+		&Replace{Regex: `^/orders/(?P<id>[0-9]+)`, Replacement: "/v2/orders/${id}/details"},
+		&Replace{Regex: `\.json$`, Replacement: ""},
+		&Replace{Regex: `^/legacy/`, Replacement: ""},
+	}})
+	a.NoError(err)
+	a.Equal("/avatars/12", rw.rewrite("/users/12/avatar"))
+	a.Equal("/avatars/john%20doe", rw.rewrite("/users/john%20doe/avatar"))
+	a.Equal("/v2/orders/7/details", rw.rewrite("/orders/7.json"))
+	a.Equal("/items", rw.rewrite("/legacy/items"))
+	_, err = newRewriter(&Rewrite{Replace: []*Replace{&Replace{Regex: `(`}}})
+	a.Error(err)
+}
+
+func (suite *RewriteTestSuite) TestCanonicalPath() {
+	a := assert.New(suite.T())
+	for path, expected := range map[string]string{
+		"":               "",
+		"/":              "/",
+		"/admin":         "/admin",
+		"//admin":        "/admin",
+		"/x/../admin":    "/admin",
+		"/admin/./x":     "/admin/x",
+		"/../admin":      "/admin",
+		"/admin//x/":     "/admin/x/",
+		"/admin/x/..":    "/admin",
+		"users/12":       "users/12",
+		"/a b/../c%2Fd/": "/c%2Fd/",
+	} {
+		a.Equal(expected, canonicalPath(path), path)
+	}
+}
+
+func (suite *RewriteTestSuite) TestEscapedPath() {
+	a := assert.New(suite.T())
+	for _, c := range []struct {
+		request  string
+		path     string
+		expected string
+	}{
+		{"/api/t/items", "/items", "/items"},
+		{"/api/t/files/a%2Fb", "/files/a/b", "/files/a%2Fb"},
+		{"/api/t/files/a%3Fb%25", "/files/a?b%", "/files/a%3Fb%25"},
+		{"/api/t//items//", "//items//", "//items//"},
+		{"/api/pool/m1/a%20b", "/a b", "/a%20b"},
+		// the escaping of the route prefix does not matter
+		{"/api/t%2Fx/items", "/items", "/items"},
+		{"/api/t/other", "/items", "/items"},
+	} {
+		u, err := url.Parse(c.request)
+		a.NoError(err)
+		a.Equal(c.expected, escapedPath(u, c.path), c.request)
+	}
+}
+
+func (suite *RewriteTestSuite) TestJoinPath() {
+	a := assert.New(suite.T())
+	for _, c := range []struct {
+		base     string
+		path     string
+		expected string
+	}{
+		{"http://up", "/items", "/items"},
+		{"http://up/", "/items", "/items"},
+		{"http://up/v1/catalog", "/items", "/v1/catalog/items"},
+		{"http://up/v1/catalog/", "/items", "/v1/catalog/items"},
+		{"http://up/v1", "items", "/v1/items"},
+		{"http://up/v1", "/", "/v1/"},
+		{"http://up/v1", "", "/v1"},
+		{"http://up/v1/", "//items", "/v1//items"},
+		{"http://up/a%20b", "/c%2Fd", "/a%20b/c%2Fd"},
+	} {
+		base, err := url.Parse(c.base)
+		a.NoError(err)
+		u := &url.URL{}
+		if u.Path, err = url.PathUnescape(c.path); a.NoError(err) {
+			u.RawPath = c.path
+		}
+		path, rawPath := joinPath(base, u)
+		res := &url.URL{Path: path, RawPath: rawPath}
+		a.Equal(c.expected, res.EscapedPath(), "%s + %s", c.base, c.path)
+	}
+}
+
+func TestRewriteTestSuite(t *testing.T) {
+	suite.Run(t, new(RewriteTestSuite))
+}
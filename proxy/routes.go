@@ -0,0 +1,246 @@
+package proxy
+
+import (
+	"bytes"
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strings"
+)
+
+const (
+	pathSeparator = "/"
+	paramPrefix   = ":"
+)
+
+//routes is the compiled form of path privilege rules; it is built once when a target is created and never modified.
+//Exact and prefix rules are kept in a trie of path segments, regex rules in a list ordered by specificity.
+//
+//The most specific rule applying to the request method wins:
+//  1. exact rules; at each segment a static segment wins over a :param segment
+//  2. the prefix or regex rule covering the longest part of the path; a prefix rule covers the path segments it matches,
+//     a regex rule the literal text it starts with (e.g. /admin/ for ^/admin/.*$); regex rules not anchored with ^
+//     cover nothing as they may match anywhere in the path; on equal length prefix rules win
+//  3. the default privileges of the target
+//
+//Rules with the same pattern and overlapping methods are applied in the order of the configuration.
+type routes struct {
+	root    *routeNode
+	regexes []*regexRoute
+}
+
+//routeNode is a path segment of the trie
+type routeNode struct {
+	static map[string]*routeNode
+	// param matches any non empty segment
+	param  *routeNode
+	exact  []*Path
+	prefix []*Path
+}
+
+type regexRoute struct {
+	path    *Path
+	re      *regexp.Regexp
+	literal int
+}
+
+//newRoutes compiles path privilege rules; it fails if a regex does not compile
+func newRoutes(p *Privileges) (*routes, error) {
+	r := &routes{root: &routeNode{}}
+	if p == nil {
+		return r, nil
+	}
+	for _, path := range p.Paths {
+		if path == nil {
+			continue
+		}
+		if path.Exact != "" {
+			n := r.root.insert(path.Exact)
+			n.exact = append(n.exact, path)
+		}
+		if path.Prefix != "" {
+			n := r.root.insert(strings.TrimSuffix(path.Prefix, pathSeparator))
+			n.prefix = append(n.prefix, path)
+		}
+		if path.Regex != "" {
+			var re *regexp.Regexp
+			var err error
+			if re, err = regexp.Compile(path.Regex); err != nil {
+				return nil, err
+			}
+			r.regexes = append(r.regexes, &regexRoute{path: path, re: re, literal: len(literalPrefix(path.Regex))})
+		}
+	}
+	sort.Stable(bySpecificity(r.regexes))
+	return r, nil
+}
+
+//bySpecificity orders regex rules by the length of their literal prefix, longest first
+type bySpecificity []*regexRoute
+
+func (s bySpecificity) Len() int           { return len(s) }
+func (s bySpecificity) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s bySpecificity) Less(i, j int) bool { return s[i].literal > s[j].literal }
+
+//insert returns the node of a pattern creating missing segments
+func (n *routeNode) insert(pattern string) *routeNode {
+	for _, seg := range strings.Split(pattern, pathSeparator) {
+		if isParam(seg) {
+			if n.param == nil {
+				n.param = &routeNode{}
+			}
+			n = n.param
+			continue
+		}
+		if n.static == nil {
+			n.static = make(map[string]*routeNode)
+		}
+		child, ok := n.static[seg]
+		if !ok {
+			child = &routeNode{}
+			n.static[seg] = child
+		}
+		n = child
+	}
+	return n
+}
+
+func isParam(seg string) bool {
+	return len(seg) > len(paramPrefix) && strings.HasPrefix(seg, paramPrefix)
+}
+
+//match returns the most specific rule for the path and method; nil if the target defaults apply
+func (r *routes) match(path, method string) *Path {
+	if p := r.root.matchExact(path, method); p != nil {
+		return p
+	}
+	best, covered := r.root.matchPrefix(path, len(path), method, nil, -1)
+	for _, rr := range r.regexes {
+		// regexes are ordered by specificity so none of the remaining ones can win over the prefix rule
+		if best != nil && rr.literal <= covered {
+			break
+		}
+		if rr.path.Method.matches(method) && rr.re.MatchString(path) {
+			return rr.path
+		}
+	}
+	return best
+}
+
+//nextSegment splits the first segment of path from the rest; last is set if there is no segment following
+func nextSegment(path string) (seg, rest string, last bool) {
+	if i := strings.IndexByte(path, '/'); i >= 0 {
+		return path[:i], path[i+1:], false
+	}
+	return path, "", true
+}
+
+func (n *routeNode) children(seg string) (static, param *routeNode) {
+	static = n.static[seg]
+	if seg != "" {
+		param = n.param
+	}
+	return static, param
+}
+
+func (n *routeNode) matchExact(path, method string) *Path {
+	seg, rest, last := nextSegment(path)
+	static, param := n.children(seg)
+	for _, child := range [2]*routeNode{static, param} {
+		if child == nil {
+			continue
+		}
+		var p *Path
+		if last {
+			p = firstMatching(child.exact, method)
+		} else {
+			p = child.matchExact(rest, method)
+		}
+		if p != nil {
+			return p
+		}
+	}
+	return nil
+}
+
+//matchPrefix returns the prefix rule covering the longest part of the path and the length it covers; total is the length of the whole path
+func (n *routeNode) matchPrefix(path string, total int, method string, best *Path, covered int) (*Path, int) {
+	seg, rest, last := nextSegment(path)
+	static, param := n.children(seg)
+	length := total
+	if !last {
+		length = total - len(rest) - len(pathSeparator)
+	}
+	for _, child := range [2]*routeNode{static, param} {
+		if child == nil {
+			continue
+		}
+		// on equal length the static segment found first is kept
+		if p := firstMatching(child.prefix, method); p != nil && length > covered {
+			best, covered = p, length
+		}
+		if !last {
+			best, covered = child.matchPrefix(rest, total, method, best, covered)
+		}
+	}
+	return best, covered
+}
+
+func firstMatching(paths []*Path, method string) *Path {
+	for _, p := range paths {
+		if p.Method.matches(method) {
+			return p
+		}
+	}
+	return nil
+}
+
+//literalPrefix returns the literal text following the leading ^ of an expression; it is empty if the expression is not anchored
+func literalPrefix(expr string) string {
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return ""
+	}
+	if re.Op == syntax.OpCapture {
+		re = re.Sub[0]
+	}
+	subs := []*syntax.Regexp{re}
+	if re.Op == syntax.OpConcat {
+		subs = re.Sub
+	}
+	if subs[0].Op != syntax.OpBeginText {
+		return ""
+	}
+	var b bytes.Buffer
+	for _, sub := range subs[1:] {
+		switch {
+		case sub.Op == syntax.OpLiteral && sub.Flags&syntax.FoldCase == 0:
+			b.WriteString(string(sub.Rune))
+		default:
+			return b.String()
+		}
+	}
+	return b.String()
+}
+
+//routeKeys identifies the exact and prefix patterns of a rule together with its methods; parameter names are ignored
+func (p *Path) routeKeys() []string {
+	var keys []string
+	if p.Exact != "" {
+		keys = append(keys, "exact "+normalizePattern(p.Exact)+" "+string(p.Method))
+	}
+	if p.Prefix != "" {
+		keys = append(keys, "prefix "+normalizePattern(strings.TrimSuffix(p.Prefix, pathSeparator))+" "+string(p.Method))
+	}
+	return keys
+}
+
+func normalizePattern(pattern string) string {
+	segs := strings.Split(pattern, pathSeparator)
+	for i, seg := range segs {
+		if isParam(seg) {
+			segs[i] = paramPrefix
+		}
+	}
+	return strings.Join(segs, pathSeparator)
+}
@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type RoutesTestSuite struct {
+	suite.Suite
+}
+
+func (suite *RoutesTestSuite) TestPrecedence() {
+	a := assert.New(suite.T())
+	p := &Privileges{Paths: []*Path{
+		&Path{Prefix: "/", Method: MethodAny, Privileges: 1},
+		&Path{Regex: `^/catalog/.*$`, Method: MethodAny, Privileges: 2},
+		&Path{Prefix: "/catalog/templates", Method: MethodAny, Privileges: 3},
+		&Path{Exact: "/catalog/templates/:id", Method: MethodAny, Privileges: 4},
+		&Path{Exact: "/catalog/templates/default", Method: http.MethodGet, Privileges: 5},
+		&Path{Regex: `^/catalog/templates/[^/]+/versions$`, Method: MethodAny, Privileges: 6},
+		&Path{Prefix: "/catalog/:section/admin/", Method: MethodAny, Privileges: 7},
+		&Path{Regex: `/internal`, Method: MethodAny, Privileges: 8},
+	}}
+	r, err := newRoutes(p)
+	a.NoError(err)
+	for _, c := range []struct {
+		path       string
+		method     string
+		privileges int
+	}{
+		{"/", "GET", 1},
+		{"/users", "GET", 1},
+		{"/catalog", "GET", 1},
+		{"/catalog/", "GET", 2},
+		{"/catalog/items", "GET", 2},
+		{"/catalog/templates", "GET", 3},
+		{"/catalog/templatesx", "GET", 2},
+		{"/catalog/templates/12", "GET", 4},
+		{"/catalog/templates/default", "GET", 5},
+		{"/catalog/templates/default", "POST", 4},
+		{"/catalog/templates/12/versions", "GET", 6},
+		{"/catalog/templates/12/files", "GET", 3},
+		{"/catalog/items/admin", "GET", 7},
+		{"/catalog/items/admin/users", "GET", 7},
+		// unanchored regexes are the least specific rules
+		{"/internal", "GET", 1},
+		{"/users/internal", "GET", 1},
+	} {
+		m := r.match(c.path, c.method)
+		if a.NotNil(m, "%s %s", c.method, c.path) {
+			a.Equal(c.privileges, m.Privileges, "%s %s", c.method, c.path)
+		}
+	}
+}
+
+func (suite *RoutesTestSuite) TestParams() {
+	a := assert.New(suite.T())
+	p := &Privileges{Paths: []*Path{
+		&Path{Exact: "/users/:id", Method: http.MethodGet, Privileges: 1},
+		&Path{Exact: "/users/:id/roles/:role", Method: http.MethodDelete, Privileges: 2},
+		&Path{Exact: "/users/me", Method: http.MethodPost, Privileges: 3},
+		&Path{Exact: "/orgs/:org/users/:id", Method: MethodAny, Privileges: 4},
+		&Path{Exact: "/orgs/main/:rest", Method: MethodAny, Privileges: 5},
+	}}
+	r, err := newRoutes(p)
+	a.NoError(err)
+	a.Equal(1, r.match("/users/12", "GET").Privileges)
+	// static segments only win when a rule applies to the method
+	a.Equal(1, r.match("/users/me", "GET").Privileges)
+	a.Equal(3, r.match("/users/me", "POST").Privileges)
+	a.Equal(2, r.match("/users/12/roles/admin", "DELETE").Privileges)
+	a.Nil(r.match("/users/12/roles/admin", "GET"))
+	a.Nil(r.match("/users/", "GET"))
+	a.Nil(r.match("/users/12/", "GET"))
+	a.Nil(r.match("/users", "GET"))
+	// the static branch is left when it does not lead to a match
+	a.Equal(4, r.match("/orgs/main/users/7", "GET").Privileges)
+	a.Equal(5, r.match("/orgs/main/users", "GET").Privileges)
+}
+
+func (suite *RoutesTestSuite) TestMethods() {
+	a := assert.New(suite.T())
+	p := &Privileges{Paths: []*Path{
+		&Path{Prefix: "/api", Method: "!GET", Privileges: 1},
+		&Path{Prefix: "/api/public", Method: http.MethodPost, Privileges: 2},
+		&Path{Regex: `^/api/public/reports/`, Method: http.MethodGet, Privileges: 3},
+		&Path{Exact: "/api/public", Method: http.MethodGet},
+		&Path{Exact: "/api/public", Method: MethodAny, Privileges: 4},
+	}}
+	r, err := newRoutes(p)
+	a.NoError(err)
+	a.Equal(1, r.match("/api/public/x", "PUT").Privileges)
+	a.Equal(2, r.match("/api/public/x", "POST").Privileges)
+	a.Nil(r.match("/api/public/x", "GET"))
+	a.Equal(3, r.match("/api/public/reports/1", "GET").Privileges)
+	a.Equal(2, r.match("/api/public/reports/1", "POST").Privileges)
+	// rules with the same pattern apply in order
+	a.Equal(0, r.match("/api/public", "GET").Privileges)
+	a.Equal(4, r.match("/api/public", "POST").Privileges)
+}
+
+func (suite *RoutesTestSuite) TestUnanchoredRegex() {
+	a := assert.New(suite.T())
+	p := &Privileges{Paths: []*Path{
+		&Path{Regex: `/reports/private`, Method: MethodAny, Privileges: 1},
+		&Path{Regex: `^/a/`, Method: MethodAny, Access: AccessDeny},
+		&Path{Prefix: "/b", Method: MethodAny, Privileges: 2},
+	}}
+	r, err := newRoutes(p)
+	a.NoError(err)
+	// the unanchored regex matches in the middle of the path but is less specific than the anchored one
+	a.Equal(AccessDeny, r.match("/a/reports/private", "GET").Access)
+	a.Equal(2, r.match("/b/reports/private", "GET").Privileges)
+	a.Equal(1, r.match("/c/reports/private", "GET").Privileges)
+}
+
+func (suite *RoutesTestSuite) TestInvalidRegex() {
+	a := assert.New(suite.T())
+	_, err := newRoutes(&Privileges{Paths: []*Path{&Path{Regex: `\/catalog\/templates\/[^\/\s*$`}}})
+	a.Error(err)
+	r, err := newRoutes(nil)
+	a.NoError(err)
+	a.Nil(r.match("/", "GET"))
+}
+
+func (suite *RoutesTestSuite) TestLiteralPrefix() {
+	a := assert.New(suite.T())
+	a.Equal("/catalog/templates/", literalPrefix(`^/catalog/templates/[^/]+$`))
+	a.Equal("", literalPrefix(`\/catalog\/templates\/[^\/\s]*$`))
+	a.Equal("/a", literalPrefix(`^/a^/b`))
+	a.Equal("", literalPrefix(`(?m)^/users`))
+	a.Equal("/users", literalPrefix(`(^/users)`))
+	a.Equal("", literalPrefix(`.*\.json$`))
+	a.Equal("", literalPrefix(`(?i)^/admin`))
+	a.Equal("", literalPrefix(`^(/a|/b)`))
+	a.Equal("", literalPrefix(`[`))
+}
+
+func (suite *RoutesTestSuite) TestRouteKeys() {
+	a := assert.New(suite.T())
+	a.Equal([]string{"exact /users/: GET,POST", "prefix /users GET,POST"}, (&Path{Exact: "/users/:id", Prefix: "/users/", Method: "GET,POST"}).routeKeys())
+	a.Equal(
+		(&Path{Exact: "/users/:id", Method: "GET"}).routeKeys(),
+		(&Path{Exact: "/users/:uid", Method: "GET"}).routeKeys())
+	a.Empty((&Path{Regex: "^/users"}).routeKeys())
+}
+
+//benchmarkRoutes matches against n exact, n prefix and n parameter rules and a fixed number of regexes
+func benchmarkRoutes(b *testing.B, n int) {
+	p := &Privileges{}
+	for i := 0; i < n; i++ {
+		p.Paths = append(p.Paths,
+			&Path{Exact: fmt.Sprintf("/service%d/items", i), Method: http.MethodGet, Privileges: 1},
+			&Path{Prefix: fmt.Sprintf("/service%d/admin", i), Method: MethodAny, Privileges: 2},
+			&Path{Exact: fmt.Sprintf("/service%d/items/:id", i), Method: "!GET", Privileges: 3},
+		)
+	}
+	p.Paths = append(p.Paths,
+		&Path{Regex: `^/reports/[0-9]+$`, Method: http.MethodGet, Privileges: 4},
+		&Path{Regex: `\.json$`, Method: http.MethodGet, Privileges: 5},
+	)
+	r, err := newRoutes(p)
+	if err != nil {
+		b.Fatal(err)
+	}
+	paths := []string{
+		fmt.Sprintf("/service%d/items", n/2),
+		fmt.Sprintf("/service%d/admin/users/12", n-1),
+		fmt.Sprintf("/service%d/items/42", n/3),
+		"/reports/2017",
+		"/unknown/path",
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.match(paths[i%len(paths)], http.MethodGet)
+	}
+}
+
+func BenchmarkRoutes(b *testing.B) {
+	for _, n := range []int{10, 100, 1000, 10000} {
+		b.Run(fmt.Sprintf("rules=%d", 3*n), func(b *testing.B) { benchmarkRoutes(b, n) })
+	}
+}
+
+func TestRoutesTestSuite(t *testing.T) {
+	suite.Run(t, new(RoutesTestSuite))
+}
@@ -1,12 +1,11 @@
 package proxy
 
 import (
+	"fmt"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
 
 	"github.com/gin-gonic/gin"
-	"github.com/koding/websocketproxy"
 )
 
 //NewSingle is a single HTTP proxy target constructor
@@ -18,24 +17,43 @@ func NewSingle(t *TargetConfig) (Target, error) {
 	if s.uri, err = url.Parse(t.URL); err != nil || s.uri == nil {
 		return nil, err
 	}
-	if t.TargetProtocol == ProtocolHTTP {
-		s.rp = httputil.NewSingleHostReverseProxy(s.URI())
-	} else {
-		proxy := websocketproxy.NewProxy(s.URI())
-		proxy.Upgrader = upgrader
-		s.rp = proxy
+	if s.routes, err = newRoutes(t.Privileges); err != nil {
+		return nil, err
+	}
+	if s.rewriter, err = newRewriter(t.Rewrite); err != nil {
+		return nil, err
 	}
+	s.upstream = newUpstream(t, t.TID, s.uri, defaultWeight)
+	s.upstream.health.start()
 	return Target(s), nil
 }
 
 type single struct {
 	TargetConfig
-	rp http.Handler
+	upstream *member
 }
 
 func (t *single) Handler() func(ctx *gin.Context) {
 	return func(ctx *gin.Context) {
+		if !t.upstream.health.healthy() {
+			ctx.JSON(http.StatusServiceUnavailable, gin.H{"error": fmt.Sprintf("target %s is down", t.ID())})
+			return
+		}
 		path := ctx.Param("path")
-		checkAuthAndServe(t, path, t.rp, ctx)
+		checkAuthAndServe(t, path, t.upstream, t.upstream.breaker, ctx)
 	}
 }
+
+func (t *single) Health() []MemberHealth {
+	return []MemberHealth{t.upstream.status()}
+}
+
+//Close lets in-flight requests complete in the background and closes websocket connections
+func (t *single) Close() {
+	go t.upstream.drain(t.ID(), drainTimeout, true)
+}
+
+//Retire lets in-flight requests and websocket connections complete in the background
+func (t *single) Retire() {
+	go t.upstream.drain(t.ID(), drainTimeout, false)
+}
@@ -4,11 +4,13 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
 	"github.com/mklimuk/goerr"
 
 	"github.com/stretchr/testify/assert"
@@ -47,7 +49,7 @@ func (suite *SingleTestSuite) TearDownSuite() {
 
 func (suite *SingleTestSuite) TestDefaultPath() {
 	a := assert.New(suite.T())
-	suite.keeper.On("CheckAccess", "", 0, true).Return("", nil).Once()
+	suite.keeper.On("CheckAccess", "", Requirement{}, true).Return(&Identity{Token: ""}, nil).Once()
 	res, err := http.Get(fmt.Sprintf("%s%s", suite.serv.URL, "/api/test/catalog"))
 	a.NoError(err)
 	a.Equal(http.StatusOK, res.StatusCode)
@@ -55,7 +57,7 @@ func (suite *SingleTestSuite) TestDefaultPath() {
 
 func (suite *SingleTestSuite) TestNoHeader() {
 	a := assert.New(suite.T())
-	suite.keeper.On("CheckAccess", "", 5, true).Return("", goerr.NewError("unauthorized", goerr.Unauthorized)).Once()
+	suite.keeper.On("CheckAccess", "", Requirement{Privileges: 5}, true).Return(&Identity{Token: ""}, goerr.NewError("unauthorized", goerr.Unauthorized)).Once()
 	res, err := http.Get(fmt.Sprintf("%s%s", suite.serv.URL, "/api/test/catalog/templates"))
 	a.NoError(err)
 	a.Equal(http.StatusUnauthorized, res.StatusCode)
@@ -66,10 +68,259 @@ func (suite *SingleTestSuite) TestNoPrivileges() {
 	client := &http.Client{Timeout: 10 * time.Second}
 	req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("%s%s", suite.serv.URL, "/api/test/catalog/templates"), nil)
 	req.Header.Set("Authorization", "testToken")
-	suite.keeper.On("CheckAccess", "testToken", 5, true).Return("testTokenRes", goerr.NewError("unauthorized", goerr.Unauthorized)).Once()
+	suite.keeper.On("CheckAccess", "testToken", Requirement{Privileges: 5}, true).Return(&Identity{Token: "testTokenRes"}, goerr.NewError("Too low privileges", Forbidden)).Once()
 	res, err := client.Do(req)
 	a.NoError(err)
+	a.Equal(http.StatusForbidden, res.StatusCode)
+}
+
+func (suite *SingleTestSuite) TestRewrite() {
+	a := assert.New(suite.T())
+	var received *http.Request
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+	}))
+	defer upstream.Close()
+	k := &GatekeeperMock{}
+	c := &TargetConfig{TID: "catalog", URL: upstream.URL + "/v1/catalog/", TargetProtocol: ProtocolHTTP, TargetType: TypeSingle,
+		Privileges: &Privileges{Paths: []*Path{&Path{Prefix: "/legacy", Method: MethodAny, Privileges: 3}}},
+		Rewrite:    &Rewrite{StripPrefix: "/legacy", Replace: []*Replace{&Replace{Regex: `^/templates/([^/]+)$`, Replacement: "/items/$1/template"}}}}
+	c.keeper = k
+	s, err := NewSingle(c)
+	a.NoError(err)
+	router := gin.New()
+	router.GET("/api/catalog/*path", s.Handler())
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+	k.On("CheckAccess", "", Requirement{}, false).Return(&Identity{}, nil)
+	for _, r := range []struct {
+		request  string
+		expected string
+	}{
+		{"/api/catalog/items?page=2", "/v1/catalog/items?page=2"},
+		{"/api/catalog/", "/v1/catalog/"},
+		{"/api/catalog/templates/a%2Fb", "/v1/catalog/items/a%2Fb/template"},
+		{"/api/catalog/files/a%3Fb%25%20c?q=1", "/v1/catalog/files/a%3Fb%25%20c?q=1"},
+		{"/api/catalog//items", "/v1/catalog/items"},
+		{"/api/catalog/a/../items/", "/v1/catalog/items/"},
+	} {
+		res, err := http.Get(srv.URL + r.request)
+		a.NoError(err)
+		a.Equal(http.StatusOK, res.StatusCode, r.request)
+		a.Equal(r.expected, received.RequestURI, r.request)
+	}
+	// privileges apply to the path sent by the client
+	k.On("CheckAccess", "", Requirement{Privileges: 3}, false).Return(&Identity{}, nil).Once()
+	res, err := http.Get(srv.URL + "/api/catalog/legacy/items")
+	a.NoError(err)
+	a.Equal(http.StatusOK, res.StatusCode)
+	a.Equal("/v1/catalog/items", received.RequestURI)
+	k.AssertExpectations(suite.T())
+}
+
+func (suite *SingleTestSuite) TestPolicy() {
+	a := assert.New(suite.T())
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	k := &GatekeeperMock{}
+	router := gin.New()
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+	c := &TargetConfig{TID: "policy", URL: upstream.URL, TargetProtocol: ProtocolHTTP, TargetType: TypeSingle, DefaultPolicy: PolicyDeny, Privileges: &Privileges{Paths: []*Path{
+		&Path{Prefix: "/internal", Method: MethodAny, Access: AccessDeny},
+		&Path{Exact: "/health", Method: http.MethodGet, Access: AccessAnonymous},
+		&Path{Prefix: "/", Method: http.MethodGet, Privileges: 1},
+	}}}
+	c.keeper = k
+	s, _ := NewSingle(c)
+	router.GET("/api/policy/*path", s.Handler())
+	router.POST("/api/policy/*path", s.Handler())
+	c = &TargetConfig{TID: "open", URL: upstream.URL, TargetProtocol: ProtocolHTTP, TargetType: TypeSingle}
+	c.keeper = k
+	open, _ := NewSingle(c)
+	router.GET("/api/open/*path", open.Handler())
+	get := func(path, token string) int {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		res, err := http.DefaultClient.Do(req)
+		a.NoError(err)
+		return res.StatusCode
+	}
+	// denied paths are rejected without checking credentials
+	a.Equal(http.StatusForbidden, get("/api/policy/internal/metrics", "admin"))
+	// non canonical paths can not bypass deny rules
+	a.Equal(http.StatusForbidden, get("/api/policy//internal", "admin"))
+	a.Equal(http.StatusForbidden, get("/api/policy/x/../internal", "admin"))
+	a.Equal(http.StatusForbidden, get("/api/policy/internal/./metrics", "admin"))
+	res, err := http.Post(srv.URL+"/api/policy/users", "application/json", strings.NewReader("{}"))
+	a.NoError(err)
+	a.Equal(http.StatusForbidden, res.StatusCode)
+	k.On("CheckAccess", "", Requirement{}, false).Return(&Identity{}, nil).Once()
+	a.Equal(http.StatusOK, get("/api/policy/health", ""))
+	k.On("CheckAccess", "", Requirement{Privileges: 1}, false).Return(nil, goerr.NewError("Authorization token required but not present", goerr.Unauthorized)).Once()
+	a.Equal(http.StatusUnauthorized, get("/api/policy/users", ""))
+	k.On("CheckAccess", "guest", Requirement{Privileges: 1}, false).Return(&Identity{Token: "guest"}, goerr.NewError("Too low privileges", Forbidden)).Once()
+	a.Equal(http.StatusForbidden, get("/api/policy/users", "guest"))
+	k.On("CheckAccess", "", Requirement{}, false).Return(&Identity{}, nil).Once()
+	a.Equal(http.StatusOK, get("/api/open/users", ""))
+	DenyUnprotected(true)
+	defer DenyUnprotected(false)
+	a.Equal(http.StatusForbidden, get("/api/open/users", ""))
+	k.AssertExpectations(suite.T())
+}
+
+func (suite *SingleTestSuite) TestAuthUnavailable() {
+	a := assert.New(suite.T())
+	req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("%s%s", suite.serv.URL, "/api/test/catalog/templates"), nil)
+	req.Header.Set("Authorization", "unavailable")
+	suite.keeper.On("CheckAccess", "unavailable", Requirement{Privileges: 5}, true).Return(&Identity{Token: "unavailable"}, goerr.NewError("Auth service unavailable", AuthUnavailable)).Once()
+	res, err := http.DefaultClient.Do(req)
+	a.NoError(err)
+	a.Equal(http.StatusServiceUnavailable, res.StatusCode)
+}
+
+func (suite *SingleTestSuite) TestIdentityHeaders() {
+	a := assert.New(suite.T())
+	var received http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header
+	}))
+	defer upstream.Close()
+	k := &GatekeeperMock{}
+	c := &TargetConfig{TID: "identity", URL: upstream.URL, TargetProtocol: ProtocolHTTP, TargetType: TypeSingle, Forward: &IdentityHeaders{StripAuthorization: true}}
+	c.keeper = k
+	s, _ := NewSingle(c)
+	router := gin.New()
+	router.GET("/api/:id/*path", s.Handler())
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+	req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("%s%s", srv.URL, "/api/identity/users"), nil)
+	req.Header.Set("Authorization", "testToken")
+	req.Header.Set(HeaderUser, "admin")
+	k.On("CheckAccess", "testToken", Requirement{}, false).Return(&Identity{Token: "testToken", Username: "john", Permissions: 3}, nil).Once()
+	res, err := http.DefaultClient.Do(req)
+	a.NoError(err)
+	a.Equal(http.StatusOK, res.StatusCode)
+	a.Equal("john", received.Get(HeaderUser))
+	a.Equal("3", received.Get(HeaderPermissions))
+	a.Empty(received.Get("Authorization"))
+}
+
+func (suite *SingleTestSuite) TestAPIKey() {
+	a := assert.New(suite.T())
+	var received *http.Request
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+	}))
+	defer upstream.Close()
+	k := &GatekeeperMock{}
+	c := &TargetConfig{TID: "keys", URL: upstream.URL, TargetProtocol: ProtocolHTTP, TargetType: TypeSingle, APIKey: &APIKeyAuth{Query: "api_key"}}
+	c.keeper = k
+	s, _ := NewSingle(c)
+	router := gin.New()
+	router.GET("/api/:id/*path", s.Handler())
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+	url := fmt.Sprintf("%s%s", srv.URL, "/api/keys/reports?api_key=secret&from=2017")
+	k.On("CheckKey", "secret", "keys", Requirement{}).Return(&Identity{Username: "cron"}, nil).Once()
+	res, err := http.Get(url)
+	a.NoError(err)
+	a.Equal(http.StatusOK, res.StatusCode)
+	a.Empty(res.Header.Get("Token"))
+	a.Equal("/reports", received.URL.Path)
+	a.Equal("from=2017", received.URL.RawQuery)
+	k.On("CheckKey", "secret", "keys", Requirement{}).Return(nil, goerr.NewError("Invalid API key", goerr.Unauthorized)).Once()
+	res, err = http.Get(url)
+	a.NoError(err)
+	a.Equal(http.StatusUnauthorized, res.StatusCode)
+	// requests without a key are checked with the token
+	k.On("CheckAccess", "testToken", Requirement{}, false).Return(&Identity{Token: "testToken"}, nil).Once()
+	req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("%s%s", srv.URL, "/api/keys/reports"), nil)
+	req.Header.Set("Authorization", "Bearer testToken")
+	res, err = http.DefaultClient.Do(req)
+	a.NoError(err)
+	a.Equal(http.StatusOK, res.StatusCode)
+	k.AssertExpectations(suite.T())
+}
+
+func (suite *SingleTestSuite) TestWebsocketToken() {
+	a := assert.New(suite.T())
+	var received http.Header
+	var query string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header
+		query = r.URL.RawQuery
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conn.Close()
+	}))
+	defer upstream.Close()
+	k := &GatekeeperMock{}
+	c := &TargetConfig{TID: "ws", URL: strings.Replace(upstream.URL, "http", "ws", 1), TargetProtocol: ProtocolWebsocket, TargetType: TypeSingle,
+		Privileges: &Privileges{Default: 1}, Token: &TokenSources{}}
+	c.keeper = k
+	s, _ := NewSingle(c)
+	router := gin.New()
+	router.GET("/ws/:id/*path", s.Handler())
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+	url := strings.Replace(srv.URL, "http", "ws", 1) + "/ws/ws/events"
+
+	k.On("CheckAccess", "secret", Requirement{Privileges: 1}, false).Return(&Identity{Token: "secret"}, nil).Twice()
+	dialer := &websocket.Dialer{Subprotocols: []string{"access_token", "secret"}}
+	conn, res, err := dialer.Dial(url, nil)
+	a.NoError(err)
+	a.Equal("access_token", res.Header.Get(protocolHeader))
+	a.Empty(received.Get(protocolHeader))
+	conn.Close()
+
+	conn, _, err = websocket.DefaultDialer.Dial(url+"?token=secret&since=1", nil)
+	a.NoError(err)
+	a.Equal("since=1", query)
+	conn.Close()
+
+	k.On("CheckAccess", "", Requirement{Privileges: 1}, false).Return(nil, goerr.NewError("Authorization token required but not present", goerr.Unauthorized)).Once()
+	_, res, err = websocket.DefaultDialer.Dial(url, nil)
+	a.Error(err)
 	a.Equal(http.StatusUnauthorized, res.StatusCode)
+	k.AssertExpectations(suite.T())
+}
+
+func (suite *SingleTestSuite) TestWebsocketReauthorize() {
+	a := assert.New(suite.T())
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.ReadMessage()
+	}))
+	defer upstream.Close()
+	k := &GatekeeperMock{}
+	c := &TargetConfig{TID: "ws", URL: strings.Replace(upstream.URL, "http", "ws", 1), TargetProtocol: ProtocolWebsocket, TargetType: TypeSingle,
+		Reauthorize: &Reauthorization{Interval: "20ms"}}
+	c.keeper = k
+	s, _ := NewSingle(c)
+	router := gin.New()
+	router.GET("/ws/:id/*path", s.Handler())
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	k.On("CheckAccess", "revoked", Requirement{}, false).Return(&Identity{Token: "revoked"}, nil).Once()
+	k.On("CheckAccess", "revoked", Requirement{}, false).Return(nil, goerr.NewError("Got invalid status code from auth service", goerr.Unauthorized)).Once()
+	header := http.Header{}
+	header.Set("Authorization", "Bearer revoked")
+	conn, _, err := websocket.DefaultDialer.Dial(strings.Replace(srv.URL, "http", "ws", 1)+"/ws/ws/events", header)
+	a.NoError(err)
+	defer conn.Close()
+	_, _, err = conn.ReadMessage()
+	a.True(websocket.IsCloseError(err, CloseUnauthorized))
+	k.AssertExpectations(suite.T())
 }
 
 func (suite *SingleTestSuite) TestProxy() {
@@ -77,13 +328,13 @@ func (suite *SingleTestSuite) TestProxy() {
 	client := &http.Client{Timeout: 10 * time.Second}
 	req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("%s%s", suite.serv.URL, "/api/test/catalog/templates"), nil)
 	req.Header.Set("Authorization", "testToken")
-	suite.keeper.On("CheckAccess", "testToken", 5, true).Return("testTokenRes", nil).Once()
+	suite.keeper.On("CheckAccess", "testToken", Requirement{Privileges: 5}, true).Return(&Identity{Token: "testTokenRes"}, nil).Once()
 	res, err := client.Do(req)
 	a.NoError(err)
 	a.Equal(http.StatusOK, res.StatusCode)
 	req, _ = http.NewRequest(http.MethodPost, fmt.Sprintf("%s%s", suite.serv.URL, "/api/test/catalog/templates/template1"), nil)
 	req.Header.Set("Authorization", "testToken")
-	suite.keeper.On("CheckAccess", "testToken", 10, true).Return("testTokenRes", nil).Once()
+	suite.keeper.On("CheckAccess", "testToken", Requirement{Privileges: 10}, true).Return(&Identity{Token: "testTokenRes"}, nil).Once()
 	res, err = client.Do(req)
 	a.Equal("testTokenRes", res.Header.Get("Token"))
 	a.NoError(err)
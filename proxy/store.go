@@ -0,0 +1,180 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+//StateStore persists targets and pool members registered at runtime.
+//
+//When state is restored the following precedence rules apply:
+//   - targets defined in the configuration file always win over persisted runtime targets with the same ID,
+//   - persisted members are restored into any pool that exists after merging, including pools from the configuration file,
+//   - members of pools that no longer exist are dropped,
+//   - runtime changes of targets defined in the configuration file (replacement, deletion) are not persisted.
+type StateStore interface {
+	Load() (*State, error)
+	Save(state *State) error
+}
+
+// State is a snapshot of runtime registrations
+type State struct {
+	Targets []*TargetConfig              `json:"targets"`
+	Members map[string][]PersistedMember `json:"members"`
+}
+
+// PersistedMember is a pool member saved in the state store
+type PersistedMember struct {
+	ID     string `json:"id"`
+	URL    string `json:"url"`
+	Weight int    `json:"weight"`
+}
+
+//NewFileStore creates a state store keeping state as a JSON document in a file
+func NewFileStore(path string) StateStore {
+	return StateStore(&fileStore{path: path})
+}
+
+type fileStore struct {
+	path string
+}
+
+func (f *fileStore) Load() (*State, error) {
+	var b []byte
+	var err error
+	if b, err = ioutil.ReadFile(f.path); err != nil {
+		if os.IsNotExist(err) {
+			return &State{}, nil
+		}
+		return nil, err
+	}
+	s := new(State)
+	if err = json.Unmarshal(b, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+//Save writes the state to a temporary file which then replaces the previous one so that the state is never partially written
+func (f *fileStore) Save(state *State) error {
+	var b []byte
+	var err error
+	if b, err = json.MarshalIndent(state, "", "  "); err != nil {
+		return err
+	}
+	var tmp *os.File
+	if tmp, err = ioutil.TempFile(filepath.Dir(f.path), ".state"); err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
+
+//NewPersistentTargetsManager is the TargetsManager constructor restoring and persisting runtime registrations in store
+func NewPersistentTargetsManager(targets []*TargetConfig, keeper Gatekeeper, store StateStore) TargetsManager {
+	t := NewTargetsManager(targets, keeper).(*targetsManager)
+	t.restore(store)
+	t.store = store
+	return TargetsManager(t)
+}
+
+func (t *targetsManager) restore(store StateStore) {
+	clog := log.WithFields(log.Fields{"logger": "api-proxy.manager", "method": "restore"})
+	var s *State
+	var err error
+	if s, err = store.Load(); err != nil {
+		clog.WithError(err).Error("Could not load persisted state, starting with configured targets only")
+		return
+	}
+	for _, conf := range s.Targets {
+		if _, configured := t.configured[conf.TID]; configured {
+			clog.WithField("target", conf.TID).Warn("Persisted target is overridden by the configuration file")
+			continue
+		}
+		var tg Target
+		if tg, err = t.build(conf); err != nil {
+			clog.WithField("target", conf.TID).WithError(err).Error("Could not restore persisted target")
+			continue
+		}
+		t.targets.put(tg)
+	}
+	for poolID, members := range s.Members {
+		var p Pool
+		if p, err = t.getPool(poolID); err != nil {
+			clog.WithField("target", poolID).Warn("Dropping persisted members of a missing pool")
+			continue
+		}
+		for _, m := range members {
+			var u *url.URL
+			if u, err = url.Parse(m.URL); err != nil {
+				clog.WithFields(log.Fields{"target": poolID, "member": m.ID}).WithError(err).Error("Could not restore persisted member")
+				continue
+			}
+			p.Add(m.ID, u, m.Weight)
+		}
+	}
+}
+
+//persist saves runtime registrations; failures are logged as the in-memory state has already changed
+func (t *targetsManager) persist() {
+	if t.store == nil {
+		return
+	}
+	t.persistMu.Lock()
+	defer t.persistMu.Unlock()
+	s := t.state()
+	if err := t.store.Save(s); err != nil {
+		log.WithFields(log.Fields{"logger": "api-proxy.manager", "method": "persist"}).
+			WithError(err).Error("Could not persist runtime state")
+	}
+}
+
+func (t *targetsManager) state() *State {
+	t.reloadMu.Lock()
+	configured := t.configured
+	t.reloadMu.Unlock()
+	targets := t.targets.all()
+	s := &State{Targets: []*TargetConfig{}, Members: make(map[string][]PersistedMember)}
+	for ID, tg := range targets {
+		if _, ok := configured[ID]; !ok {
+			conf := tg.Config()
+			s.Targets = append(s.Targets, &conf)
+		}
+		p, isPool := tg.(Pool)
+		if !isPool {
+			continue
+		}
+		var members []PersistedMember
+		for _, m := range p.Members() {
+			members = append(members, PersistedMember{ID: m.ID, URL: m.URL, Weight: m.Weight})
+		}
+		if len(members) > 0 {
+			s.Members[ID] = members
+		}
+	}
+	sort.Sort(configsByID(s.Targets))
+	return s
+}
+
+type configsByID []*TargetConfig
+
+func (b configsByID) Len() int           { return len(b) }
+func (b configsByID) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b configsByID) Less(i, j int) bool { return b[i].TID < b[j].TID }
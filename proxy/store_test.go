@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type StoreTestSuite struct {
+	suite.Suite
+	dir string
+}
+
+func (suite *StoreTestSuite) SetupSuite() {
+	log.SetLevel(log.DebugLevel)
+}
+
+func (suite *StoreTestSuite) SetupTest() {
+	suite.dir, _ = ioutil.TempDir("", "api-proxy")
+}
+
+func (suite *StoreTestSuite) TearDownTest() {
+	os.RemoveAll(suite.dir)
+}
+
+func (suite *StoreTestSuite) TestFileStore() {
+	a := assert.New(suite.T())
+	path := filepath.Join(suite.dir, "state.json")
+	s := NewFileStore(path)
+	state, err := s.Load()
+	a.NoError(err)
+	a.Empty(state.Targets)
+	state = &State{
+		Targets: []*TargetConfig{&TargetConfig{TID: "p1", TargetType: TypePool, TargetProtocol: ProtocolHTTP, Balancing: StrategyRandom}},
+		Members: map[string][]PersistedMember{"p1": []PersistedMember{PersistedMember{ID: "m1", URL: "http://m1.com", Weight: 2}}},
+	}
+	a.NoError(s.Save(state))
+	state, err = s.Load()
+	a.NoError(err)
+	a.Len(state.Targets, 1)
+	a.Equal(StrategyRandom, state.Targets[0].Balancing)
+	a.Equal(2, state.Members["p1"][0].Weight)
+	files, _ := ioutil.ReadDir(suite.dir)
+	a.Len(files, 1)
+	a.NoError(ioutil.WriteFile(path, []byte("{"), 0644))
+	_, err = s.Load()
+	a.Error(err)
+	a.Error(NewFileStore(filepath.Join(suite.dir, "missing", "state.json")).Save(state))
+}
+
+func (suite *StoreTestSuite) TestPersistence() {
+	a := assert.New(suite.T())
+	k := &GatekeeperMock{}
+	store := NewFileStore(filepath.Join(suite.dir, "state.json"))
+	configured := func() []*TargetConfig {
+		return []*TargetConfig{
+			&TargetConfig{TargetType: TypePool, TargetProtocol: ProtocolHTTP, TID: "yaml-pool"},
+			&TargetConfig{TargetType: TypeSingle, TargetProtocol: ProtocolHTTP, TID: "yaml-single", URL: "http://ys.com"},
+		}
+	}
+	m := NewPersistentTargetsManager(configured(), k, store)
+	a.NoError(m.CreatePool(&TargetConfig{TargetType: TypePool, TargetProtocol: ProtocolHTTP, TID: "runtime-pool", Balancing: StrategyRoundRobin}))
+	a.NoError(m.AddToPool("runtime-pool", "m1", "http://m1.com", 0))
+	a.NoError(m.AddToPool("runtime-pool", "m2", "http://m2.com", 0))
+	a.NoError(m.RemoveFromPool("runtime-pool", "m2"))
+	a.NoError(m.AddToPool("yaml-pool", "y1", "http://y1.com", 3))
+	a.NoError(m.CreateTarget(&TargetConfig{TargetType: TypeSingle, TargetProtocol: ProtocolHTTP, TID: "runtime-single", URL: "http://rs.com"}))
+	a.NoError(m.CreateTarget(&TargetConfig{TargetType: TypeSingle, TargetProtocol: ProtocolHTTP, TID: "deleted", URL: "http://d.com"}))
+	a.NoError(m.DeleteTarget("deleted"))
+	a.NoError(m.DeleteTarget("yaml-single"))
+
+	// restart
+	m = NewPersistentTargetsManager(configured(), k, store)
+	registry := m.(*targetsManager).targets
+	a.Len(registry.all(), 4)
+	_, ok := registry.get("yaml-single")
+	a.True(ok)
+	_, ok = registry.get("deleted")
+	a.False(ok)
+	p, err := m.(*targetsManager).getPool("runtime-pool")
+	a.NoError(err)
+	a.Equal(StrategyRoundRobin, p.Strategy())
+	a.Len(p.Members(), 1)
+	a.Equal("m1", p.Members()[0].ID)
+	p, _ = m.(*targetsManager).getPool("yaml-pool")
+	a.Len(p.Members(), 1)
+	a.Equal(3, p.Members()[0].Weight)
+
+	// configuration file wins over persisted targets with the same ID
+	withConflict := append(configured(), &TargetConfig{TargetType: TypeSingle, TargetProtocol: ProtocolHTTP, TID: "runtime-pool", URL: "http://conflict.com"})
+	m = NewPersistentTargetsManager(withConflict, k, store)
+	tg, _ := m.(*targetsManager).targets.get("runtime-pool")
+	a.Equal(TypeSingle, tg.Type())
+	state := m.(*targetsManager).state()
+	a.Len(state.Targets, 1)
+	a.Equal("runtime-single", state.Targets[0].TID)
+}
+
+func TestStoreTestSuite(t *testing.T) {
+	suite.Run(t, new(StoreTestSuite))
+}
@@ -3,11 +3,12 @@ package proxy
 import (
 	"net/http"
 	"net/url"
-	"regexp"
+	"sync"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
+	"github.com/mklimuk/goerr"
 )
 
 //TargetType enumerates supported target types
@@ -44,42 +45,93 @@ type Target interface {
 	Handler() func(ctx *gin.Context)
 	URI() *url.URL
 	UpdateToken() bool
+	IdentityHeaders() *IdentityHeaders
+	APIKeyAuth() *APIKeyAuth
+	TokenSources() *TokenSources
+	TokenDelivery() *TokenDelivery
+	Reauthorization() *Reauthorization
 	Keeper() Gatekeeper
 	PrivilegesForPath(path, method string) int
+	RequirementForPath(path, method string) Requirement
+	RuleForPath(path, method string) (*Path, Requirement)
+	RewritePath(path string) string
+	Health() []MemberHealth
+	Config() TargetConfig
+	// Close stops the target when it is deleted; in-flight requests complete in the background, websocket connections are closed
+	Close()
+	// Retire stops the target when it is replaced; in-flight requests and websocket connections complete in the background
+	Retire()
 }
 
 //Pool defines additional methods supported by a pool of endpoints
 type Pool interface {
 	Target
-	Add(ID string, uri *url.URL)
-	Remove(ID string)
+	Add(ID string, uri *url.URL, weight int)
+	Remove(ID string) error
+	Strategy() Strategy
+	Members() []MemberInfo
 }
 
 // TargetConfig wraps proxy target configuration
 type TargetConfig struct {
-	TID            string       `yaml:"id" json:"id"`
-	TargetType     TargetType   `yaml:"type" json:"type"`
-	URL            string       `yaml:"url" json:"url"`
-	UpdatesToken   bool         `yaml:"updatesToken" json:"updatesToken"`
-	TargetProtocol ProtocolType `yaml:"protocol" json:"targetProtocol"`
-	Privileges     *Privileges  `yaml:"privileges" json:"privileges"`
+	TID            string           `yaml:"id" json:"id"`
+	TargetType     TargetType       `yaml:"type" json:"type"`
+	URL            string           `yaml:"url" json:"url"`
+	UpdatesToken   bool             `yaml:"updatesToken" json:"updatesToken"`
+	TargetProtocol ProtocolType     `yaml:"protocol" json:"targetProtocol"`
+	Privileges     *Privileges      `yaml:"privileges" json:"privileges"`
+	PermissionMode PermissionMode   `yaml:"permissionMode" json:"permissionMode,omitempty"`
+	DefaultPolicy  Policy           `yaml:"defaultPolicy" json:"defaultPolicy,omitempty"`
+	Forward        *IdentityHeaders `yaml:"forwardIdentity" json:"forwardIdentity,omitempty"`
+	APIKey         *APIKeyAuth      `yaml:"apiKey" json:"apiKey,omitempty"`
+	Token          *TokenSources    `yaml:"token" json:"token,omitempty"`
+	Delivery       *TokenDelivery   `yaml:"tokenDelivery" json:"tokenDelivery,omitempty"`
+	Reauthorize    *Reauthorization `yaml:"reauthorize" json:"reauthorize,omitempty"`
+	Rewrite        *Rewrite         `yaml:"rewrite" json:"rewrite,omitempty"`
+	Balancing      Strategy         `yaml:"strategy" json:"strategy"`
+	HealthCheck    *HealthCheck     `yaml:"healthCheck" json:"healthCheck"`
+	CircuitBreaker *CircuitBreaker  `yaml:"circuitBreaker" json:"circuitBreaker"`
 	keeper         Gatekeeper
 	uri            *url.URL
+	routes         *routes
+	rewriter       *rewriter
 }
 
-// Privileges regroups specific path privileges for a given endpoint
+// Privileges regroups specific path privileges for a given endpoint. Roles and Scopes are required in addition to the Default level on paths without specific settings.
+// When several paths apply to a request the most specific one wins: exact paths, then the prefix or regex covering the longest part of the path.
 type Privileges struct {
-	Default int     `yaml:"default"`
-	Paths   []*Path `yaml:"paths"`
+	Default int     `yaml:"default" json:"default"`
+	Roles   *Match  `yaml:"roles" json:"roles,omitempty"`
+	Scopes  *Match  `yaml:"scopes" json:"scopes,omitempty"`
+	Paths   []*Path `yaml:"paths" json:"paths"`
 }
 
-// Path defines path privileges
+// Path defines path privileges. Exact and Prefix paths may contain parameters matching any segment, e.g. /users/:id;
+// a Prefix matches the path itself and all paths below it.
 type Path struct {
-	Exact       string `yaml:"exact"`
-	Regex       string `yaml:"regex"`
-	Method      string `yaml:"method"`
-	Privileges  int    `yaml:"privileges"`
-	parsedRegex *regexp.Regexp
+	Exact      string  `yaml:"exact" json:"exact,omitempty"`
+	Prefix     string  `yaml:"prefix" json:"prefix,omitempty"`
+	Regex      string  `yaml:"regex" json:"regex,omitempty"`
+	Method     Methods `yaml:"method" json:"method"`
+	Access     Access  `yaml:"access" json:"access,omitempty"`
+	Privileges int     `yaml:"privileges" json:"privileges"`
+	Bits       string  `yaml:"bits" json:"bits,omitempty"`
+	Roles      *Match  `yaml:"roles" json:"roles,omitempty"`
+	Scopes     *Match  `yaml:"scopes" json:"scopes,omitempty"`
+}
+
+func (p *Path) requirement(mode PermissionMode) Requirement {
+	switch p.Access {
+	case AccessDeny:
+		return Requirement{Deny: true}
+	case AccessAnonymous:
+		return Requirement{}
+	}
+	r := Requirement{Privileges: p.Privileges, Mode: mode, Roles: p.Roles, Scopes: p.Scopes}
+	if mode == PermissionBitmask {
+		r.Bits = p.Bits
+	}
+	return r
 }
 
 // ID returns proxy target's unique ID
@@ -97,6 +149,31 @@ func (t *TargetConfig) UpdateToken() bool {
 	return t.UpdatesToken
 }
 
+// IdentityHeaders returns headers carrying the authenticated identity to the target; nil if the identity is not forwarded
+func (t *TargetConfig) IdentityHeaders() *IdentityHeaders {
+	return t.Forward
+}
+
+// APIKeyAuth returns where API keys are read from; nil if the target does not accept API keys
+func (t *TargetConfig) APIKeyAuth() *APIKeyAuth {
+	return t.APIKey
+}
+
+// TokenSources returns where the target reads tokens from; nil if only the Authorization header is used
+func (t *TargetConfig) TokenSources() *TokenSources {
+	return t.Token
+}
+
+// TokenDelivery returns how refreshed tokens are returned to clients; nil if they are sent in the Token header
+func (t *TargetConfig) TokenDelivery() *TokenDelivery {
+	return t.Delivery
+}
+
+// Reauthorization returns how open websocket sessions are checked; nil if they are only authorized at upgrade
+func (t *TargetConfig) Reauthorization() *Reauthorization {
+	return t.Reauthorize
+}
+
 // URI returns proxy target's URI
 func (t *TargetConfig) URI() *url.URL {
 	return t.uri
@@ -107,65 +184,193 @@ func (t *TargetConfig) Protocol() ProtocolType {
 	return t.TargetProtocol
 }
 
+// Strategy returns pool's load balancing strategy. Pools without an explicit strategy are addressed by member ID.
+func (t *TargetConfig) Strategy() Strategy {
+	if t.Balancing == "" {
+		return StrategyAddressed
+	}
+	return t.Balancing
+}
+
+// Config returns a copy of proxy target's configuration
+func (t *TargetConfig) Config() TargetConfig {
+	return *t
+}
+
 // Keeper returns proxy target's gatekeeper
 func (t *TargetConfig) Keeper() Gatekeeper {
 	return t.keeper
 }
 
-// PrivilegesForPath returns privileges for a given path. If there is no specific settings, default target privileges are returned.
+// PrivilegesForPath returns the privilege level required for a given path. If there is no specific settings, default target privileges are returned.
+// Targets without privileges settings do not require any privileges.
 func (t *TargetConfig) PrivilegesForPath(path, method string) int {
-	for _, p := range (*t.Privileges).Paths {
-		if p.Method == method {
-			if p.Exact == path {
-				return p.Privileges
-			}
-			var match bool
-			var err error
-			if match, err = t.matchRegex(p, path); err != nil {
-				log.WithFields(log.Fields{"target": t.ID(), "path": p.Regex}).
-					WithError(err).Error("Error parsing regex for path")
-				return maxPrivileges
-			}
-			if match {
-				return p.Privileges
-			}
+	return t.RequirementForPath(path, method).Privileges
+}
+
+// RequirementForPath returns the privilege level, roles and scopes required for a given path.
+// Paths no rule applies to are denied if the default policy of the target is deny.
+func (t *TargetConfig) RequirementForPath(path, method string) Requirement {
+	_, r := t.RuleForPath(path, method)
+	return r
+}
+
+// RuleForPath returns the privileges rule applying to a given path and its requirement; the rule is nil if the target defaults apply.
+func (t *TargetConfig) RuleForPath(path, method string) (*Path, Requirement) {
+	deny := t.policy() == PolicyDeny
+	if t.Privileges == nil {
+		return nil, Requirement{Deny: deny}
+	}
+	r := t.routes
+	if r == nil {
+		// targets which were not created by a constructor compile their rules on each call
+		var err error
+		if r, err = newRoutes(t.Privileges); err != nil {
+			log.WithFields(log.Fields{"logger": "api-proxy.target", "target": t.ID()}).
+				WithError(err).Error("Error compiling path privileges")
+			return nil, Requirement{Privileges: maxPrivileges, Mode: t.PermissionMode}
 		}
 	}
-	return t.Privileges.Default
+	if p := r.match(path, method); p != nil {
+		return p, p.requirement(t.PermissionMode)
+	}
+	if deny {
+		return nil, Requirement{Deny: true}
+	}
+	return nil, Requirement{Privileges: t.Privileges.Default, Mode: t.PermissionMode, Roles: t.Privileges.Roles, Scopes: t.Privileges.Scopes}
 }
 
-func (t *TargetConfig) matchRegex(path *Path, toCheck string) (bool, error) {
-	if path.Regex == "" {
-		return false, nil
-	}
-	if path.parsedRegex == nil {
+// RewritePath returns the path passed to the upstream for an escaped request path
+func (t *TargetConfig) RewritePath(path string) string {
+	r := t.rewriter
+	if r == nil && t.Rewrite != nil {
+		// targets which were not created by a constructor compile their rules on each call
 		var err error
-		if path.parsedRegex, err = regexp.Compile(path.Regex); err != nil {
-			return false, err
+		if r, err = newRewriter(t.Rewrite); err != nil {
+			log.WithFields(log.Fields{"logger": "api-proxy.target", "target": t.ID()}).
+				WithError(err).Error("Error compiling path rewrites")
+			return path
 		}
 	}
-	return path.parsedRegex.MatchString(toCheck), nil
+	return r.rewrite(path)
+}
+
+//decision is the outcome of authorizing a request to a target
+type decision struct {
+	rule        *Path
+	requirement Requirement
+	id          *Identity
+	err         error
+}
+
+//authorize checks the credentials of a request to a target; the API key takes precedence over the token.
+//Proxied requests and explanations are both decided here.
+func authorize(t Target, path, method, token, key string, update bool) *decision {
+	d := &decision{}
+	d.rule, d.requirement = t.RuleForPath(path, method)
+	switch {
+	case d.requirement.Deny:
+		d.err = goerr.NewError("path is not accessible through the proxy", Forbidden)
+	case key != "":
+		d.id, d.err = t.Keeper().CheckKey(key, t.ID(), d.requirement)
+	default:
+		d.id, d.err = t.Keeper().CheckAccess(token, d.requirement, update)
+	}
+	return d
 }
 
-func checkAuthAndServe(t Target, path string, rp http.Handler, ctx *gin.Context) {
-	condition := t.PrivilegesForPath(path, ctx.Request.Method)
+//rejection returns the status and body of the response rejecting the request
+func (d *decision) rejection() (int, gin.H) {
+	switch {
+	case d.requirement.Deny:
+		return http.StatusForbidden, gin.H{"error": "Access denied", "details": d.err.Error()}
+	case goerr.GetType(d.err) == AuthUnavailable:
+		return http.StatusServiceUnavailable, gin.H{"error": "Authorization service unavailable", "details": d.err.Error()}
+	case goerr.GetType(d.err) == Forbidden:
+		return http.StatusForbidden, gin.H{"error": "Insufficient privileges", "details": d.err.Error()}
+	}
+	return http.StatusUnauthorized, gin.H{"error": "Invalid access token", "details": d.err.Error()}
+}
 
+func checkAuthAndServe(t Target, path string, rp http.Handler, b *breaker, ctx *gin.Context) {
+	// the circuit is checked first so that requests to a failing upstream do not wait for the authorization
+	var generation uint64
+	var allowed bool
+	if generation, allowed = b.acquire(); !allowed {
+		ctx.JSON(http.StatusServiceUnavailable, gin.H{"error": "Target temporarily unavailable", "details": "circuit breaker is open"})
+		return
+	}
+	proxied := false
+	defer func() {
+		if !proxied {
+			b.release(generation)
+		}
+	}()
 	// if the API is protected we should perform necessary checks
-	h := ctx.Request.Header.Get("authorization")
 	var token string
-	var err error
-	if token, err = t.Keeper().CheckAccess(extractToken(h), condition, t.UpdateToken()); err != nil {
-		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid access token", "details": err.Error()})
+	var source TokenSource
+	keys := t.APIKeyAuth()
+	sources := t.TokenSources()
+	key := keys.extract(ctx.Request)
+	if key == "" {
+		token, source = sources.extract(ctx.Request)
+	}
+	// rules are matched against the canonical path which is also the one proxied so that e.g. //admin can not bypass a rule for /admin
+	clean := canonicalPath(path)
+	d := authorize(t, clean, ctx.Request.Method, token, key, t.UpdateToken())
+	if d.err != nil {
+		ctx.JSON(d.rejection())
 		return
 	}
-	if t.UpdateToken() {
-		ctx.Writer.Header().Add("Token", token)
+	id, condition := d.id, d.requirement
+	var err error
+	w := http.ResponseWriter(ctx.Writer)
+	finish := func() {}
+	refreshed := t.UpdateToken() && id.Token != ""
+	if t.Protocol() == ProtocolWebsocket {
+		if refreshed {
+			t.TokenDelivery().deliver(ctx.Writer.Header(), id)
+		}
+		if id.Token != "" || key != "" {
+			ctx.Request = withSession(ctx.Request, newSessionAuth(t, condition, id, key, refreshed))
+		}
+	} else if refreshed {
+		w, finish = t.TokenDelivery().writer(ctx.Writer, id)
+	}
+	keys.strip(ctx.Request)
+	ctx.Request = sources.strip(ctx.Request, source)
+	ctx.Request = t.IdentityHeaders().apply(ctx.Request, id)
+	// rewrite request URL keeping the query and, unless the path was cleaned, its escaping
+	escaped := (&url.URL{Path: clean}).EscapedPath()
+	if clean == path {
+		escaped = escapedPath(ctx.Request.URL, path)
 	}
-	// rewrite request URL/URL
-	ctx.Request.RequestURI = path
-	if ctx.Request.URL, err = url.Parse(ctx.Request.RequestURI); err != nil {
+	upstream := &url.URL{RawPath: t.RewritePath(escaped), RawQuery: ctx.Request.URL.RawQuery}
+	if upstream.Path, err = url.PathUnescape(upstream.RawPath); err != nil {
 		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Could not parse target path", "description": err.Error()})
 		return
 	}
-	rp.ServeHTTP(ctx.Writer, ctx.Request)
+	ctx.Request.URL = upstream
+	ctx.Request.RequestURI = upstream.RequestURI()
+	proxied = true
+	var once sync.Once
+	report := func(success bool) {
+		once.Do(func() { b.done(generation, success) })
+	}
+	if t.Protocol() == ProtocolWebsocket {
+		// websocket sessions report the upstream handshake so that a long session does not hold a half-open probe slot
+		ctx.Request = withHandshake(ctx.Request, report)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			// the reverse proxy aborts the response with a panic if the upstream fails while the body is copied;
+			// the aborted response is not finished
+			report(false)
+			panic(r)
+		}
+		finish()
+		// transport errors are reported by the reverse proxies as 502
+		report(ctx.Writer.Status() < http.StatusInternalServerError)
+	}()
+	rp.ServeHTTP(w, ctx.Request)
 }
@@ -49,33 +49,71 @@ func (suite *TargetTestSuite) TestPrivilegesForPath() {
 	a.Equal(10, s.PrivilegesForPath("/catalog/templates/test123", "POST"))
 	a.Equal(1, s.PrivilegesForPath("/catalog/templates/test123", "PUT"))
 	a.Equal(1, s.PrivilegesForPath("/different", "DELETE"))
+	// rules are compiled when the target is created
 	c.Privileges.Paths = append(c.Privileges.Paths, &Path{Regex: `\/audio\/file\/[^\*$`, Privileges: 7, Method: http.MethodGet})
 	a.Equal(5, s.PrivilegesForPath("/catalog/templates", "GET"))
-	a.Equal(100, s.PrivilegesForPath("/audio/file/23001", "GET"))
+	a.Equal(1, s.PrivilegesForPath("/audio/file/23001", "GET"))
+	s, err = NewSingle(c)
+	a.Error(err)
+	a.Nil(s)
+	a.Equal(100, c.PrivilegesForPath("/audio/file/23001", "GET"))
 }
 
-func (suite *TargetTestSuite) TestPathMatching() {
+func (suite *TargetTestSuite) TestRequirementForPath() {
 	a := assert.New(suite.T())
-	p := &Path{Regex: `\/catalog\/templates\/[^\/\s]*$`}
-	t := TargetConfig{}
-	m, err := t.matchRegex(p, "/catalog/templates")
-	a.NoError(err)
-	a.False(m)
-	m, err = t.matchRegex(p, "/catalog/templates/test")
-	a.NoError(err)
-	a.True(m)
-	// invalid
-	p.Regex = `\/catalog\/templates\/[^\/\s*$`
-	p.parsedRegex = nil
-	m, err = t.matchRegex(p, "/catalog/templates/test")
-	a.Error(err)
-	a.False(m)
-	p.Regex = ``
-	p.parsedRegex = nil
-	m, err = t.matchRegex(p, "/catalog/templates/test")
+	admins := &Match{AnyOf: []string{"admin"}}
+	p := []*Path{
+		&Path{Exact: `/users`, Method: http.MethodGet, Scopes: &Match{AllOf: []string{"users:read"}}},
+		&Path{Regex: `^/users/[^/]+$`, Method: http.MethodDelete, Privileges: 3, Roles: admins},
+	}
+	c := &TargetConfig{Privileges: &Privileges{Default: 1, Roles: &Match{AnyOf: []string{"user"}}, Paths: p}, TID: "users", URL: "http://test.com", TargetProtocol: ProtocolHTTP, TargetType: TypeSingle}
+	s, err := NewSingle(c)
 	a.NoError(err)
-	a.False(m)
+	a.Equal(Requirement{Scopes: &Match{AllOf: []string{"users:read"}}}, s.RequirementForPath("/users", "GET"))
+	a.Equal(Requirement{Privileges: 3, Roles: admins}, s.RequirementForPath("/users/12", "DELETE"))
+	a.Equal(3, s.PrivilegesForPath("/users/12", "DELETE"))
+	a.Equal(Requirement{Privileges: 1, Roles: &Match{AnyOf: []string{"user"}}}, s.RequirementForPath("/users/12", "GET"))
+	a.True((&TargetConfig{TID: "open"}).RequirementForPath("/users", "GET").Anonymous())
+	c = &TargetConfig{PermissionMode: PermissionBitmask, Privileges: &Privileges{Default: 1, Paths: []*Path{&Path{Exact: "/users", Method: http.MethodPost, Privileges: 6, Bits: BitsAny}}}}
+	a.Equal(Requirement{Privileges: 6, Mode: PermissionBitmask, Bits: BitsAny}, c.RequirementForPath("/users", "POST"))
+	a.Equal(Requirement{Privileges: 1, Mode: PermissionBitmask}, c.RequirementForPath("/users", "GET"))
+	c.PermissionMode = ""
+	a.Equal(Requirement{Privileges: 6}, c.RequirementForPath("/users", "POST"))
+	c = &TargetConfig{Privileges: &Privileges{Default: 1, Paths: []*Path{
+		&Path{Exact: "/users", Method: NewMethods("POST", "PUT", "PATCH", "DELETE"), Privileges: 5},
+		&Path{Regex: "^/reports", Method: "!GET", Privileges: 8},
+		&Path{Exact: "/health", Method: MethodAny},
+	}}}
+	for _, m := range []string{"POST", "PUT", "PATCH", "DELETE"} {
+		a.Equal(5, c.PrivilegesForPath("/users", m))
+	}
+	a.Equal(1, c.PrivilegesForPath("/users", "GET"))
+	a.Equal(1, c.PrivilegesForPath("/reports/daily", "GET"))
+	a.Equal(8, c.PrivilegesForPath("/reports/daily", "POST"))
+	a.Equal(0, c.PrivilegesForPath("/health", "HEAD"))
+}
 
+func (suite *TargetTestSuite) TestPolicy() {
+	a := assert.New(suite.T())
+	c := &TargetConfig{TID: "open"}
+	a.Equal(Requirement{}, c.RequirementForPath("/users", "GET"))
+	DenyUnprotected(true)
+	defer DenyUnprotected(false)
+	a.Equal(Requirement{Deny: true}, c.RequirementForPath("/users", "GET"))
+	c.DefaultPolicy = PolicyAllow
+	a.Equal(Requirement{}, c.RequirementForPath("/users", "GET"))
+	c = &TargetConfig{DefaultPolicy: PolicyDeny, Privileges: &Privileges{Default: 1, Paths: []*Path{
+		&Path{Prefix: "/users", Method: MethodAny, Privileges: 2},
+		&Path{Exact: "/users/:id/password", Method: MethodAny, Privileges: 5, Access: AccessDeny},
+		&Path{Exact: "/users/me", Method: http.MethodGet, Privileges: 5, Access: AccessAnonymous},
+	}}}
+	a.Equal(Requirement{Privileges: 2}, c.RequirementForPath("/users/12", "GET"))
+	a.Equal(Requirement{Deny: true}, c.RequirementForPath("/users/12/password", "PUT"))
+	a.Equal(Requirement{}, c.RequirementForPath("/users/me", "GET"))
+	a.Equal(Requirement{Deny: true}, c.RequirementForPath("/groups", "GET"))
+	// targets with privileges are not affected by the global setting
+	c.DefaultPolicy = ""
+	a.Equal(Requirement{Privileges: 1}, c.RequirementForPath("/groups", "GET"))
 }
 
 func TestTargetTestSuite(t *testing.T) {
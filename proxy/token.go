@@ -0,0 +1,196 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+//TokenSource is a part of the request a token can be read from
+type TokenSource string
+
+// token sources
+const (
+	// SourceHeader reads the token from the Authorization header
+	SourceHeader TokenSource = "header"
+	// SourceCookie reads the token from a cookie; browsers send cookies with WebSocket upgrades
+	SourceCookie TokenSource = "cookie"
+	// SourceQuery reads the token from a query parameter which is removed before the request is forwarded
+	SourceQuery TokenSource = "query"
+	// SourceProtocol reads the token from the Sec-WebSocket-Protocol header where it follows the marker protocol
+	SourceProtocol TokenSource = "protocol"
+)
+
+const (
+	defaultTokenCookie   = "token"
+	defaultTokenProtocol = "access_token"
+	protocolHeader       = "Sec-Websocket-Protocol"
+)
+
+var defaultTokenQuery = []string{"token", "access_token"}
+
+//tokenProtocolKey holds the marker protocol of requests authorized with a token sent as a WebSocket subprotocol
+const tokenProtocolKey contextKey = "tokenProtocol"
+
+//TokenSources configures where a target reads tokens from. Sources are checked in the order given, the first one carrying a token wins.
+//Targets without these settings only read the Authorization header.
+type TokenSources struct {
+	// Order lists sources by precedence; header, cookie, query and protocol are checked in this order if empty
+	Order []TokenSource `yaml:"order" json:"order,omitempty"`
+	// Cookie is the name of the token cookie, token by default
+	Cookie string `yaml:"cookie" json:"cookie,omitempty"`
+	// Query lists names of token query parameters, token and access_token by default
+	Query []string `yaml:"query" json:"query,omitempty"`
+	// Protocol is the subprotocol preceding the token in Sec-WebSocket-Protocol, access_token by default
+	Protocol string `yaml:"protocol" json:"protocol,omitempty"`
+}
+
+func (s *TokenSources) order() []TokenSource {
+	if s == nil {
+		return []TokenSource{SourceHeader}
+	}
+	if len(s.Order) == 0 {
+		return []TokenSource{SourceHeader, SourceCookie, SourceQuery, SourceProtocol}
+	}
+	return s.Order
+}
+
+func (s *TokenSources) enabled(source TokenSource) bool {
+	for _, o := range s.order() {
+		if o == source {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *TokenSources) cookie() string {
+	if s.Cookie == "" {
+		return defaultTokenCookie
+	}
+	return s.Cookie
+}
+
+func (s *TokenSources) query() []string {
+	if len(s.Query) == 0 {
+		return defaultTokenQuery
+	}
+	return s.Query
+}
+
+func (s *TokenSources) protocol() string {
+	if s.Protocol == "" {
+		return defaultTokenProtocol
+	}
+	return s.Protocol
+}
+
+//extract returns the token sent with the request and its source; the token is empty if none of the sources carries one
+func (s *TokenSources) extract(r *http.Request) (string, TokenSource) {
+	for _, source := range s.order() {
+		var token string
+		switch source {
+		case SourceHeader:
+			token = extractToken(r.Header.Get("Authorization"))
+		case SourceCookie:
+			if c, err := r.Cookie(s.cookie()); err == nil {
+				token = c.Value
+			}
+		case SourceQuery:
+			q := r.URL.Query()
+			for _, name := range s.query() {
+				if token = q.Get(name); token != "" {
+					break
+				}
+			}
+		case SourceProtocol:
+			token, _ = splitProtocols(r, s.protocol())
+		}
+		if token != "" {
+			return token, source
+		}
+	}
+	return "", ""
+}
+
+//strip removes token query parameters and a token sent as a subprotocol from the request; the returned request
+//remembers the marker protocol so that it can be answered in the WebSocket handshake instead of the token
+func (s *TokenSources) strip(r *http.Request, source TokenSource) *http.Request {
+	if s == nil {
+		return r
+	}
+	if s.enabled(SourceQuery) {
+		q := r.URL.Query()
+		stripped := false
+		for _, name := range s.query() {
+			if _, present := q[name]; present {
+				q.Del(name)
+				stripped = true
+			}
+		}
+		if stripped {
+			r.URL.RawQuery = q.Encode()
+		}
+	}
+	if source != SourceProtocol {
+		return r
+	}
+	_, rest := splitProtocols(r, s.protocol())
+	// the marker is kept for the handshake with the client and removed from the upstream handshake
+	r.Header.Del(protocolHeader)
+	r.Header.Set(protocolHeader, strings.Join(append([]string{s.protocol()}, rest...), ", "))
+	return r.WithContext(context.WithValue(r.Context(), tokenProtocolKey, s.protocol()))
+}
+
+//splitProtocols returns the token following the marker protocol and all other requested protocols
+func splitProtocols(r *http.Request, marker string) (string, []string) {
+	var protocols []string
+	for _, h := range r.Header[protocolHeader] {
+		for _, p := range strings.Split(h, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				protocols = append(protocols, p)
+			}
+		}
+	}
+	var token string
+	var rest []string
+	for i := 0; i < len(protocols); i++ {
+		if protocols[i] == marker && token == "" && i+1 < len(protocols) {
+			token = protocols[i+1]
+			i++
+			continue
+		}
+		rest = append(rest, protocols[i])
+	}
+	return token, rest
+}
+
+//tokenProtocol returns the marker protocol if the request was authorized with a token sent as a subprotocol
+func tokenProtocol(r *http.Request) string {
+	p, _ := r.Context().Value(tokenProtocolKey).(string)
+	return p
+}
+
+//clientProtocols returns protocols requested by the client besides the token marker
+func clientProtocols(r *http.Request) []string {
+	_, rest := splitProtocols(r, "")
+	marker := tokenProtocol(r)
+	res := rest[:0]
+	for _, p := range rest {
+		if p != marker {
+			res = append(res, p)
+		}
+	}
+	return res
+}
+
+//forwardProtocols removes the token marker from protocols requested from the websocket upstream
+func forwardProtocols(in *http.Request, out http.Header) {
+	if tokenProtocol(in) == "" {
+		return
+	}
+	out.Del(protocolHeader)
+	if rest := clientProtocols(in); len(rest) > 0 {
+		out.Set(protocolHeader, strings.Join(rest, ", "))
+	}
+}
@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type TokenTestSuite struct {
+	suite.Suite
+}
+
+func (suite *TokenTestSuite) TestDefaults() {
+	a := assert.New(suite.T())
+	r, _ := http.NewRequest(http.MethodGet, "http://test.com/ws?token=fromQuery", nil)
+	r.AddCookie(&http.Cookie{Name: "token", Value: "fromCookie"})
+	var headerOnly *TokenSources
+	token, source := headerOnly.extract(r)
+	a.Empty(token)
+	a.Empty(source)
+	r.Header.Set("Authorization", "Bearer fromHeader")
+	token, source = headerOnly.extract(r)
+	a.Equal("fromHeader", token)
+	a.Equal(SourceHeader, source)
+	a.Equal(r, headerOnly.strip(r, source))
+	a.Equal("token=fromQuery", r.URL.RawQuery)
+
+	all := &TokenSources{}
+	token, source = all.extract(r)
+	a.Equal("fromHeader", token)
+	r.Header.Del("Authorization")
+	token, source = all.extract(r)
+	a.Equal("fromCookie", token)
+	a.Equal(SourceCookie, source)
+}
+
+func (suite *TokenTestSuite) TestPrecedence() {
+	a := assert.New(suite.T())
+	r, _ := http.NewRequest(http.MethodGet, "http://test.com/ws?access_token=fromQuery&page=1", nil)
+	r.AddCookie(&http.Cookie{Name: "session", Value: "fromCookie"})
+	r.Header.Set("Authorization", "Bearer fromHeader")
+	s := &TokenSources{Order: []TokenSource{SourceQuery, SourceCookie}, Cookie: "session"}
+	token, source := s.extract(r)
+	a.Equal("fromQuery", token)
+	a.Equal(SourceQuery, source)
+	r = s.strip(r, source)
+	a.Equal("page=1", r.URL.RawQuery)
+	token, source = s.extract(r)
+	a.Equal("fromCookie", token)
+	a.Equal(SourceCookie, source)
+	s.Order = []TokenSource{SourceCookie, SourceQuery}
+	s.Query = []string{"jwt"}
+	r.URL.RawQuery = "jwt=fromQuery"
+	token, _ = s.extract(r)
+	a.Equal("fromCookie", token)
+	s.strip(r, SourceCookie)
+	a.Empty(r.URL.RawQuery)
+}
+
+func (suite *TokenTestSuite) TestProtocol() {
+	a := assert.New(suite.T())
+	r, _ := http.NewRequest(http.MethodGet, "http://test.com/ws", nil)
+	r.Header.Set(protocolHeader, "graphql-ws, access_token, secret")
+	s := &TokenSources{Order: []TokenSource{SourceProtocol}}
+	token, source := s.extract(r)
+	a.Equal("secret", token)
+	a.Equal(SourceProtocol, source)
+	r = s.strip(r, source)
+	a.Equal("access_token, graphql-ws", r.Header.Get(protocolHeader))
+	a.Equal("access_token", tokenProtocol(r))
+	a.Equal([]string{"graphql-ws"}, clientProtocols(r))
+	out := http.Header{}
+	out.Set(protocolHeader, r.Header.Get(protocolHeader))
+	forwardProtocols(r, out)
+	a.Equal("graphql-ws", out.Get(protocolHeader))
+
+	r, _ = http.NewRequest(http.MethodGet, "http://test.com/ws", nil)
+	r.Header.Add(protocolHeader, "bearer")
+	r.Header.Add(protocolHeader, "secret")
+	s.Protocol = "bearer"
+	token, source = s.extract(r)
+	a.Equal("secret", token)
+	r = s.strip(r, source)
+	a.Empty(clientProtocols(r))
+	out = http.Header{}
+	out.Set(protocolHeader, "bearer")
+	forwardProtocols(r, out)
+	a.Empty(out.Get(protocolHeader))
+	// marker without a token
+	r.Header.Set(protocolHeader, "bearer")
+	token, _ = s.extract(r)
+	a.Empty(token)
+}
+
+func TestTokenTestSuite(t *testing.T) {
+	suite.Run(t, new(TokenTestSuite))
+}
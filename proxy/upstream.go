@@ -0,0 +1,212 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	dialTimeout       = 30 * time.Second
+	handshakeTimeout  = 45 * time.Second
+	drainTimeout      = 30 * time.Second
+	drainPollInterval = 100 * time.Millisecond
+)
+
+var errUpstreamClosed = errors.New("upstream has been removed")
+
+const defaultWeight = 1
+
+//member is a single upstream of a target
+type member struct {
+	id      string
+	uri     *url.URL
+	weight  int
+	rp      http.Handler
+	health  *healthChecker
+	breaker *breaker
+	conns   *connTracker
+	// number of requests currently being served by the member and served in total
+	active   int64
+	requests uint64
+}
+
+// MemberInfo describes a pool member
+type MemberInfo struct {
+	ID       string       `json:"id"`
+	URL      string       `json:"url"`
+	Weight   int          `json:"weight"`
+	Health   MemberHealth `json:"health"`
+	Active   int64        `json:"activeRequests"`
+	Requests uint64       `json:"totalRequests"`
+}
+
+func newMember(ID string, uri *url.URL, weight int, rp http.Handler) *member {
+	if weight <= 0 {
+		weight = defaultWeight
+	}
+	return &member{id: ID, uri: uri, weight: weight, rp: rp}
+}
+
+//newUpstream creates a member proxying to uri with health checking and circuit breaking configured as in conf
+func newUpstream(conf *TargetConfig, ID string, uri *url.URL, weight int) *member {
+	conns := newConnTracker()
+	m := newMember(ID, uri, weight, newUpstreamProxy(conf.Protocol(), uri, conns))
+	m.conns = conns
+	m.health = newHealthChecker(conf.ID(), ID, uri, conf.HealthCheck)
+	m.breaker = newBreaker(conf.ID(), ID, conf.CircuitBreaker)
+	return m
+}
+
+func (m *member) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	atomic.AddUint64(&m.requests, 1)
+	atomic.AddInt64(&m.active, 1)
+	defer atomic.AddInt64(&m.active, -1)
+	m.rp.ServeHTTP(res, req)
+}
+
+func (m *member) status() MemberHealth {
+	h := unchecked(m.id, m.uri)
+	if m.health != nil {
+		h = m.health.status()
+	}
+	h.Circuit = m.breaker.current()
+	return h
+}
+
+func (m *member) info() MemberInfo {
+	i := MemberInfo{
+		ID:       m.id,
+		Weight:   m.weight,
+		Health:   m.status(),
+		Active:   m.activeRequests(),
+		Requests: atomic.LoadUint64(&m.requests),
+	}
+	if m.uri != nil {
+		i.URL = m.uri.String()
+	}
+	return i
+}
+
+func (m *member) activeRequests() int64 {
+	return atomic.LoadInt64(&m.active)
+}
+
+//drain stops health checks and waits for in-flight requests of a removed upstream; websocket connections are closed
+//if closeConns is set, otherwise they are left open until either side ends them
+func (m *member) drain(target string, timeout time.Duration, closeConns bool) {
+	m.health.close()
+	closed := 0
+	if m.conns != nil && closeConns {
+		closed = m.conns.closeAll()
+	}
+	deadline := time.Now().Add(timeout)
+	for m.activeRequests() > 0 && time.Now().Before(deadline) {
+		time.Sleep(drainPollInterval)
+	}
+	clog := log.WithFields(log.Fields{"logger": "api-proxy.upstream", "target": target, "member": m.id, "websockets": closed})
+	if active := m.activeRequests(); active > 0 {
+		clog.WithField("active", active).Warn("Upstream removed before all requests completed")
+		return
+	}
+	clog.Info("Upstream drained")
+}
+
+//newUpstreamProxy creates a reverse proxy for the given upstream; websocket connections are registered with conns
+func newUpstreamProxy(protocol ProtocolType, uri *url.URL, conns *connTracker) http.Handler {
+	if protocol == ProtocolHTTP {
+		return newHTTPProxy(uri)
+	}
+	return newWebsocketProxy(uri, conns)
+}
+
+//newHTTPProxy creates a reverse proxy appending request paths to the path of uri without losing escaped characters
+func newHTTPProxy(uri *url.URL) http.Handler {
+	rp := httputil.NewSingleHostReverseProxy(uri)
+	director := rp.Director
+	rp.Director = func(req *http.Request) {
+		path, rawPath := joinPath(uri, req.URL)
+		director(req)
+		req.URL.Path, req.URL.RawPath = path, rawPath
+	}
+	return rp
+}
+
+//connTracker keeps track of open upstream connections so that they can be closed when the upstream is removed
+type connTracker struct {
+	mu     sync.Mutex
+	conns  map[*trackedConn]struct{}
+	closed bool
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{conns: make(map[*trackedConn]struct{})}
+}
+
+func (c *connTracker) dial(network, addr string) (net.Conn, error) {
+	conn, err := net.DialTimeout(network, addr, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		conn.Close()
+		return nil, errUpstreamClosed
+	}
+	t := &trackedConn{Conn: conn, tracker: c}
+	c.conns[t] = struct{}{}
+	return t, nil
+}
+
+func (c *connTracker) release(t *trackedConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.conns, t)
+}
+
+func (c *connTracker) open() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.conns)
+}
+
+//removed tells whether the connections were closed because the upstream was removed
+func (c *connTracker) removed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+//closeAll closes all tracked connections and rejects new ones; the websocket proxy then terminates the client side
+func (c *connTracker) closeAll() int {
+	c.mu.Lock()
+	c.closed = true
+	conns := make([]*trackedConn, 0, len(c.conns))
+	for t := range c.conns {
+		conns = append(conns, t)
+	}
+	c.mu.Unlock()
+	for _, t := range conns {
+		t.Close()
+	}
+	return len(conns)
+}
+
+type trackedConn struct {
+	net.Conn
+	tracker *connTracker
+	once    sync.Once
+}
+
+func (t *trackedConn) Close() error {
+	t.once.Do(func() { t.tracker.release(t) })
+	return t.Conn.Close()
+}
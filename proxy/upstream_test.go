@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"net"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type UpstreamTestSuite struct {
+	suite.Suite
+	listener net.Listener
+}
+
+func (suite *UpstreamTestSuite) SetupSuite() {
+	suite.listener, _ = net.Listen("tcp", "127.0.0.1:0")
+	go func() {
+		for {
+			conn, err := suite.listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				buf := make([]byte, 16)
+				for {
+					if _, err := conn.Read(buf); err != nil {
+						conn.Close()
+						return
+					}
+				}
+			}()
+		}
+	}()
+}
+
+func (suite *UpstreamTestSuite) TearDownSuite() {
+	suite.listener.Close()
+}
+
+func (suite *UpstreamTestSuite) TestConnTracker() {
+	a := assert.New(suite.T())
+	c := newConnTracker()
+	c1, err := c.dial("tcp", suite.listener.Addr().String())
+	a.NoError(err)
+	c2, err := c.dial("tcp", suite.listener.Addr().String())
+	a.NoError(err)
+	a.Equal(2, c.open())
+	c2.Close()
+	a.Equal(1, c.open())
+	a.Equal(1, c.closeAll())
+	a.Equal(0, c.open())
+	_, err = c1.Write([]byte("test"))
+	a.Error(err)
+	_, err = c.dial("tcp", suite.listener.Addr().String())
+	a.Equal(errUpstreamClosed, err)
+}
+
+func (suite *UpstreamTestSuite) TestDrain() {
+	a := assert.New(suite.T())
+	u, _ := url.Parse("ws://" + suite.listener.Addr().String())
+	m := newMember("m1", u, 0, &fakeHandler{})
+	m.conns = newConnTracker()
+	conn, err := m.conns.dial("tcp", suite.listener.Addr().String())
+	a.NoError(err)
+	atomic.AddInt64(&m.active, 1)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		atomic.AddInt64(&m.active, -1)
+	}()
+	start := time.Now()
+	m.drain("p", time.Second, true)
+	a.True(time.Since(start) < time.Second)
+	a.Equal(0, m.conns.open())
+	_, err = conn.Write([]byte("test"))
+	a.Error(err)
+	// requests that never finish do not block removal forever
+	atomic.AddInt64(&m.active, 1)
+	start = time.Now()
+	m.drain("p", 200*time.Millisecond, true)
+	a.True(time.Since(start) >= 200*time.Millisecond)
+}
+
+func (suite *UpstreamTestSuite) TestDrainKeepingConnections() {
+	a := assert.New(suite.T())
+	u, _ := url.Parse("ws://" + suite.listener.Addr().String())
+	m := newMember("m1", u, 0, &fakeHandler{})
+	m.conns = newConnTracker()
+	conn, err := m.conns.dial("tcp", suite.listener.Addr().String())
+	a.NoError(err)
+	m.drain("p", time.Second, false)
+	a.Equal(1, m.conns.open())
+	_, err = conn.Write([]byte("test"))
+	a.NoError(err)
+	conn.Close()
+}
+
+func TestUpstreamTestSuite(t *testing.T) {
+	suite.Run(t, new(UpstreamTestSuite))
+}
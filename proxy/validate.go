@@ -0,0 +1,536 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Problem describes a single configuration issue
+type Problem struct {
+	Target string `json:"target,omitempty"`
+	// Field is the YAML path of the offending setting, e.g. targets[1].privileges.paths[0].regex
+	Field   string `json:"field"`
+	Message string `json:"message"`
+	Warning bool   `json:"warning,omitempty"`
+}
+
+func (p Problem) String() string {
+	level := "error"
+	if p.Warning {
+		level = "warning"
+	}
+	if p.Target == "" {
+		return fmt.Sprintf("%s: %s: %s", level, p.Field, p.Message)
+	}
+	return fmt.Sprintf("%s: %s (target '%s'): %s", level, p.Field, p.Target, p.Message)
+}
+
+// Problems is a list of configuration issues
+type Problems []Problem
+
+func (p Problems) Error() string {
+	var b bytes.Buffer
+	for i, problem := range p {
+		if i > 0 {
+			b.WriteString("; ")
+		}
+		b.WriteString(problem.String())
+	}
+	return b.String()
+}
+
+// Errors returns problems that make the configuration unusable
+func (p Problems) Errors() Problems {
+	return p.filter(false)
+}
+
+// Warnings returns problems that do not prevent the configuration from being used
+func (p Problems) Warnings() Problems {
+	return p.filter(true)
+}
+
+func (p Problems) filter(warnings bool) Problems {
+	var res Problems
+	for _, problem := range p {
+		if problem.Warning == warnings {
+			res = append(res, problem)
+		}
+	}
+	return res
+}
+
+// ValidateTargets checks a set of target configurations; prefix is the YAML path of the targets list
+func ValidateTargets(targets []*TargetConfig, prefix string) Problems {
+	var res Problems
+	seen := make(map[string]int)
+	for i, t := range targets {
+		path := fmt.Sprintf("%s[%d]", prefix, i)
+		if t == nil {
+			res = append(res, Problem{Field: path, Message: "empty target definition"})
+			continue
+		}
+		res = append(res, ValidateTarget(t, path)...)
+		if t.TID == "" {
+			continue
+		}
+		if first, duplicate := seen[t.TID]; duplicate {
+			res = append(res, Problem{Target: t.TID, Field: path + ".id", Message: fmt.Sprintf("duplicate id, already used by %s[%d]", prefix, first)})
+			continue
+		}
+		seen[t.TID] = i
+	}
+	return res
+}
+
+// ValidateTarget checks a single target configuration; prefix is the YAML path of the target
+func ValidateTarget(t *TargetConfig, prefix string) Problems {
+	v := &validator{target: t.TID, prefix: prefix}
+	if t.TID == "" {
+		v.fail("id", "id is required")
+	}
+	switch t.TargetType {
+	case TypeSingle, TypePool:
+	case "":
+		v.fail("type", "type is required")
+	default:
+		v.fail("type", fmt.Sprintf("unknown type '%s', expected '%s' or '%s'", t.TargetType, TypeSingle, TypePool))
+	}
+	switch t.TargetProtocol {
+	case ProtocolHTTP, ProtocolWebsocket:
+	case "":
+		v.fail("protocol", "protocol is required")
+	default:
+		v.fail("protocol", fmt.Sprintf("unknown protocol '%s', expected '%s' or '%s'", t.TargetProtocol, ProtocolHTTP, ProtocolWebsocket))
+	}
+	if t.TargetType == TypeSingle {
+		v.url(t.URL)
+	}
+	if _, err := newBalancer(t.Balancing); err != nil {
+		v.fail("strategy", err.Error())
+	} else if t.Balancing != "" && t.TargetType == TypeSingle {
+		v.warn("strategy", "load balancing strategy is ignored for single targets")
+	}
+	switch t.PermissionMode {
+	case "", PermissionLevel, PermissionBitmask:
+	default:
+		v.fail("permissionMode", fmt.Sprintf("unknown permission mode '%s', expected '%s' or '%s'", t.PermissionMode, PermissionLevel, PermissionBitmask))
+	}
+	switch t.DefaultPolicy {
+	case "", PolicyAllow, PolicyDeny:
+	default:
+		v.fail("defaultPolicy", fmt.Sprintf("unknown policy '%s', expected '%s' or '%s'", t.DefaultPolicy, PolicyAllow, PolicyDeny))
+	}
+	v.privileges(t.Privileges, t.PermissionMode, t.DefaultPolicy)
+	if h := t.Forward; h != nil {
+		v.header("forwardIdentity.user", h.User)
+		v.header("forwardIdentity.name", h.Name)
+		v.header("forwardIdentity.permissions", h.Permissions)
+		v.header("forwardIdentity.roles", h.Roles)
+		v.header("forwardIdentity.scopes", h.Scopes)
+	}
+	if k := t.APIKey; k != nil {
+		v.header("apiKey.header", k.Header)
+		if strings.ContainsAny(k.Query, "&=#? ") {
+			v.fail("apiKey.query", fmt.Sprintf("invalid query parameter name '%s'", k.Query))
+		}
+	}
+	if s := t.Token; s != nil {
+		seen := make(map[TokenSource]bool)
+		for i, source := range s.Order {
+			field := fmt.Sprintf("token.order[%d]", i)
+			switch source {
+			case SourceHeader, SourceCookie, SourceQuery:
+			case SourceProtocol:
+				if t.TargetProtocol == ProtocolHTTP {
+					v.warn(field, "protocol source is only used by websocket targets")
+				}
+			default:
+				v.fail(field, fmt.Sprintf("unknown token source '%s', expected one of %s, %s, %s or %s", source, SourceHeader, SourceCookie, SourceQuery, SourceProtocol))
+			}
+			if seen[source] {
+				v.fail(field, fmt.Sprintf("token source '%s' listed more than once", source))
+			}
+			seen[source] = true
+		}
+		if strings.ContainsAny(s.Cookie, "=;, \t") {
+			v.fail("token.cookie", fmt.Sprintf("invalid cookie name '%s'", s.Cookie))
+		}
+		for i, name := range s.Query {
+			if name == "" || strings.ContainsAny(name, "&=#? ") {
+				v.fail(fmt.Sprintf("token.query[%d]", i), fmt.Sprintf("invalid query parameter name '%s'", name))
+			}
+		}
+		if strings.ContainsAny(s.Protocol, ", \t") {
+			v.fail("token.protocol", fmt.Sprintf("invalid protocol name '%s'", s.Protocol))
+		}
+	}
+	if d := t.Delivery; d != nil {
+		switch d.Mode {
+		case "", DeliverHeader, DeliverCookie:
+		case DeliverEnvelope:
+			if t.TargetProtocol == ProtocolWebsocket {
+				v.warn("tokenDelivery.mode", "websocket handshakes have no body, the token header is used instead")
+			}
+		default:
+			v.fail("tokenDelivery.mode", fmt.Sprintf("unknown mode '%s', expected one of %s, %s or %s", d.Mode, DeliverHeader, DeliverCookie, DeliverEnvelope))
+		}
+		if d.Mode != "" && !t.UpdatesToken {
+			v.warn("tokenDelivery.mode", "tokens are only delivered by targets with updatesToken set")
+		}
+		v.header("tokenDelivery.header", d.Header)
+		if c := d.Cookie; c != nil {
+			if strings.ContainsAny(c.Name, "=;, \t") {
+				v.fail("tokenDelivery.cookie.name", fmt.Sprintf("invalid cookie name '%s'", c.Name))
+			}
+			switch c.SameSite {
+			case "", "Strict", "Lax", "None":
+			default:
+				v.fail("tokenDelivery.cookie.sameSite", fmt.Sprintf("unknown same site mode '%s', expected Strict, Lax or None", c.SameSite))
+			}
+			if c.Insecure {
+				v.warn("tokenDelivery.cookie.insecure", "token cookie is sent over plain HTTP")
+			}
+		}
+		switch d.Expiry {
+		case "", ExpiryIgnore, ExpiryPush, ExpiryReject:
+			if d.Expiry != "" && t.TargetProtocol == ProtocolHTTP {
+				v.warn("tokenDelivery.expiry", "expiry only applies to websocket targets")
+			}
+		default:
+			v.fail("tokenDelivery.expiry", fmt.Sprintf("unknown expiry policy '%s', expected one of %s, %s or %s", d.Expiry, ExpiryIgnore, ExpiryPush, ExpiryReject))
+		}
+		v.duration("tokenDelivery.refreshBefore", d.RefreshBefore)
+	}
+	if r := t.Rewrite; r != nil {
+		if r.StripPrefix != "" && !strings.HasPrefix(r.StripPrefix, pathSeparator) {
+			v.fail("rewrite.stripPrefix", "prefix must start with '/'")
+		}
+		if r.AddPrefix != "" && !strings.HasPrefix(r.AddPrefix, pathSeparator) {
+			v.fail("rewrite.addPrefix", "prefix must start with '/'")
+		}
+		for i, rep := range r.Replace {
+			field := fmt.Sprintf("rewrite.replace[%d]", i)
+			if rep == nil || rep.Regex == "" {
+				v.fail(field+".regex", "regex is required")
+				continue
+			}
+			if _, err := regexp.Compile(rep.Regex); err != nil {
+				v.fail(field+".regex", fmt.Sprintf("invalid regular expression: %s", err.Error()))
+			}
+		}
+	}
+	if r := t.Reauthorize; r != nil {
+		v.duration("reauthorize.interval", r.Interval)
+		if t.TargetProtocol == ProtocolHTTP {
+			v.warn("reauthorize", "reauthorization only applies to websocket targets")
+		}
+	}
+	if h := t.HealthCheck; h != nil {
+		if h.Path != "" && !strings.HasPrefix(h.Path, "/") {
+			v.fail("healthCheck.path", "probe path must start with '/'")
+		}
+		v.duration("healthCheck.interval", h.Interval)
+		v.duration("healthCheck.timeout", h.Timeout)
+		v.positive("healthCheck.healthyThreshold", h.HealthyThreshold)
+		v.positive("healthCheck.unhealthyThreshold", h.UnhealthyThreshold)
+	}
+	if c := t.CircuitBreaker; c != nil {
+		v.positive("circuitBreaker.threshold", c.Threshold)
+		v.duration("circuitBreaker.openDuration", c.OpenDuration)
+		v.positive("circuitBreaker.halfOpenProbes", c.HalfOpenProbes)
+	}
+	return v.problems
+}
+
+// ValidateTokenCache checks the token cache configuration; prefix is the YAML path of the setting
+func ValidateTokenCache(c *TokenCache, prefix string) Problems {
+	if c == nil {
+		return nil
+	}
+	v := &validator{prefix: prefix}
+	v.duration("ttl", c.TTL)
+	v.positive("maxEntries", c.MaxEntries)
+	return v.problems
+}
+
+// ValidateAPIKeys checks API keys defined in the configuration; prefix is the YAML path of the keys list
+func ValidateAPIKeys(keys []*APIKey, prefix string) Problems {
+	v := &validator{}
+	seen := make(map[string]int)
+	for i, k := range keys {
+		v.prefix = fmt.Sprintf("%s[%d]", prefix, i)
+		if k == nil {
+			v.problems = append(v.problems, Problem{Field: v.prefix, Message: "empty key definition"})
+			continue
+		}
+		if k.ID == "" {
+			v.fail("id", "id is required")
+		} else if first, duplicate := seen[k.ID]; duplicate {
+			v.fail("id", fmt.Sprintf("duplicate id, already used by %s[%d]", prefix, first))
+		} else {
+			seen[k.ID] = i
+		}
+		if !validHash(k.Hash) {
+			v.fail("hash", "hash must be a hex encoded SHA-256 hash of the key")
+		}
+		if k.Permissions < 0 {
+			v.fail("permissions", "value must not be negative")
+		}
+	}
+	return v.problems
+}
+
+// ValidateAuth checks the gatekeeper configuration; prefix is the YAML path of the setting
+func ValidateAuth(a *AuthConfig, prefix string) Problems {
+	if a == nil {
+		return nil
+	}
+	v := &validator{prefix: prefix}
+	if a.URL != "" {
+		v.url(a.URL)
+	}
+	if a.CheckPath != "" && !strings.HasPrefix(a.CheckPath, "/") {
+		v.fail("checkPath", "check path must start with '/'")
+	}
+	v.duration("timeout", a.Timeout)
+	if r := a.Retry; r != nil {
+		v.positive("retry.attempts", r.Attempts)
+		v.duration("retry.backoff", r.Backoff)
+		v.duration("retry.maxBackoff", r.MaxBackoff)
+	}
+	if t := a.TLS; t != nil {
+		if (t.CertFile == "") != (t.KeyFile == "") {
+			v.fail("tls", "certFile and keyFile must be set together")
+		}
+		if t.InsecureSkipVerify {
+			v.warn("tls.insecureSkipVerify", "auth service certificate is not verified")
+		}
+	}
+	switch a.Mode {
+	case "", AuthModeRemote:
+		if a.JWT != nil {
+			v.warn("jwt", "jwt settings are ignored in remote mode")
+		}
+	case AuthModeJWT:
+		if a.JWT == nil {
+			v.fail("jwt", "jwt settings are required in jwt mode")
+			break
+		}
+		if a.JWT.Secret == "" && a.JWT.SecretFile == "" && len(a.JWT.KeyFiles) == 0 && a.JWT.JWKS == "" {
+			v.fail("jwt", "one of secret, secretFile, keyFiles or jwks is required")
+		}
+		if a.JWT.Secret != "" && a.JWT.SecretFile != "" {
+			v.fail("jwt.secretFile", "secret and secretFile are mutually exclusive")
+		}
+		v.duration("jwt.leeway", a.JWT.Leeway)
+	default:
+		v.fail("mode", fmt.Sprintf("unknown mode '%s', expected '%s' or '%s'", a.Mode, AuthModeRemote, AuthModeJWT))
+	}
+	return v.problems
+}
+
+type validator struct {
+	target   string
+	prefix   string
+	problems Problems
+}
+
+func (v *validator) field(name string) string {
+	if v.prefix == "" {
+		return name
+	}
+	return v.prefix + "." + name
+}
+
+func (v *validator) fail(field, message string) {
+	v.problems = append(v.problems, Problem{Target: v.target, Field: v.field(field), Message: message})
+}
+
+func (v *validator) warn(field, message string) {
+	v.problems = append(v.problems, Problem{Target: v.target, Field: v.field(field), Message: message, Warning: true})
+}
+
+func (v *validator) url(raw string) {
+	if raw == "" {
+		v.fail("url", "url is required for single targets")
+		return
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		v.fail("url", fmt.Sprintf("invalid url: %s", err.Error()))
+		return
+	}
+	if u.Scheme == "" || u.Host == "" {
+		v.fail("url", fmt.Sprintf("url '%s' must be absolute", raw))
+	}
+}
+
+func (v *validator) duration(field, value string) {
+	if value == "" {
+		return
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		v.fail(field, fmt.Sprintf("invalid duration '%s'", value))
+		return
+	}
+	if d <= 0 {
+		v.fail(field, "duration must be positive")
+	}
+}
+
+func (v *validator) positive(field string, value int) {
+	if value < 0 {
+		v.fail(field, "value must not be negative")
+	}
+}
+
+func (v *validator) privileges(p *Privileges, mode PermissionMode, policy Policy) {
+	if p == nil {
+		switch policy {
+		case PolicyDeny:
+			v.warn("privileges", "no privileges defined, target rejects all requests")
+		case PolicyAllow:
+			v.warn("privileges", "no privileges defined, target is accessible without a token")
+		default:
+			v.warn("privileges", "no privileges defined, target is accessible without a token unless denyUnprotected is set")
+		}
+		return
+	}
+	if p.Default < 0 {
+		v.fail("privileges.default", "value must not be negative")
+	}
+	if policy == PolicyDeny && (p.Default > 0 || !p.Roles.empty() || !p.Scopes.empty()) {
+		v.warn("privileges.default", "default privileges, roles and scopes are ignored with the deny policy")
+	}
+	v.match("privileges.roles", p.Roles)
+	v.match("privileges.scopes", p.Scopes)
+	// seen holds indexes of rules by pattern and method to find rules shadowed by an earlier one
+	seen := make(map[string]int)
+	for i, path := range p.Paths {
+		field := fmt.Sprintf("privileges.paths[%d]", i)
+		if path == nil {
+			v.fail(field, "empty path definition")
+			continue
+		}
+		if path.Exact == "" && path.Prefix == "" && path.Regex == "" {
+			v.fail(field, "one of exact, prefix or regex is required")
+		}
+		v.pattern(field+".exact", path.Exact)
+		v.pattern(field+".prefix", path.Prefix)
+		if path.Regex != "" {
+			if _, err := regexp.Compile(path.Regex); err != nil {
+				v.fail(field+".regex", fmt.Sprintf("invalid regular expression: %s", err.Error()))
+			}
+		}
+		v.methods(field+".method", path.Method)
+		switch path.Access {
+		case "":
+		case AccessDeny, AccessAnonymous:
+			if path.Privileges > 0 || path.Bits != "" || !path.Roles.empty() || !path.Scopes.empty() {
+				v.warn(field+".access", fmt.Sprintf("privileges, bits, roles and scopes are ignored by %s rules", path.Access))
+			}
+		default:
+			v.fail(field+".access", fmt.Sprintf("unknown access '%s', expected '%s' or '%s'", path.Access, AccessDeny, AccessAnonymous))
+		}
+		if path.Privileges < 0 {
+			v.fail(field+".privileges", "value must not be negative")
+		}
+		switch path.Bits {
+		case "":
+		case BitsAll, BitsAny:
+			if mode != PermissionBitmask {
+				v.warn(field+".bits", "bits are ignored unless permissionMode is bitmask")
+			}
+		default:
+			v.fail(field+".bits", fmt.Sprintf("unknown bits matching '%s', expected '%s' or '%s'", path.Bits, BitsAll, BitsAny))
+		}
+		v.match(field+".roles", path.Roles)
+		v.match(field+".scopes", path.Scopes)
+		for _, key := range path.routeKeys() {
+			if first, exists := seen[key]; exists {
+				v.warn(field, fmt.Sprintf("same path and method as privileges.paths[%d], the rule never applies", first))
+				continue
+			}
+			seen[key] = i
+		}
+	}
+}
+
+//pattern checks an exact or prefix path; parameters need a name
+func (v *validator) pattern(field, pattern string) {
+	if pattern == "" {
+		return
+	}
+	if !strings.HasPrefix(pattern, pathSeparator) {
+		v.warn(field, "path does not start with /, it never matches")
+	}
+	for _, seg := range strings.Split(pattern, pathSeparator) {
+		if seg == paramPrefix {
+			v.fail(field, "path parameter requires a name")
+		}
+	}
+}
+
+func (v *validator) methods(field string, m Methods) {
+	if m == "" {
+		v.fail(field, "method is required")
+		return
+	}
+	wildcard, positive, negative := false, false, false
+	for _, item := range m.items() {
+		name := strings.TrimPrefix(item, methodExcept)
+		switch {
+		case item == MethodAny || item == MethodAnyAlias:
+			wildcard = true
+			continue
+		case name != item:
+			negative = true
+		default:
+			positive = true
+		}
+		if name == "" || name == MethodAny || name == MethodAnyAlias || strings.IndexFunc(name, func(r rune) bool { return r < 'A' || r > 'Z' }) >= 0 {
+			v.fail(field, fmt.Sprintf("invalid method '%s'", item))
+		}
+	}
+	if negative && positive {
+		v.warn(field, "excluded methods are redundant when methods are listed")
+	} else if wildcard && positive {
+		v.warn(field, "wildcard matches all methods, listed methods are redundant")
+	}
+}
+
+func (v *validator) match(field string, m *Match) {
+	if m == nil {
+		return
+	}
+	if len(m.AnyOf) == 0 && len(m.AllOf) == 0 {
+		v.warn(field, "neither anyOf nor allOf is set, nothing is required")
+	}
+	for i, name := range m.AnyOf {
+		if strings.TrimSpace(name) == "" {
+			v.fail(fmt.Sprintf("%s.anyOf[%d]", field, i), "name must not be empty")
+		}
+	}
+	for i, name := range m.AllOf {
+		if strings.TrimSpace(name) == "" {
+			v.fail(fmt.Sprintf("%s.allOf[%d]", field, i), "name must not be empty")
+		}
+	}
+}
+
+func (v *validator) header(field, name string) {
+	if name == "" || name == disabledHeader {
+		return
+	}
+	if strings.IndexFunc(name, func(r rune) bool { return r <= ' ' || r >= 0x7f || strings.ContainsRune("()<>@,;:\\\"/[]?={}", r) }) >= 0 {
+		v.fail(field, fmt.Sprintf("invalid header name '%s'", name))
+	}
+	if strings.EqualFold(name, "Authorization") {
+		v.fail(field, "the Authorization header is reserved for bearer tokens")
+	}
+}
@@ -0,0 +1,299 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type ValidateTestSuite struct {
+	suite.Suite
+}
+
+func (suite *ValidateTestSuite) TestValidTarget() {
+	a := assert.New(suite.T())
+	t := &TargetConfig{
+		TID:            "t1",
+		TargetType:     TypeSingle,
+		TargetProtocol: ProtocolHTTP,
+		URL:            "http://t1:8080",
+		Privileges:     &Privileges{Paths: []*Path{&Path{Exact: "/test", Method: "GET", Privileges: 3}}},
+		HealthCheck:    &HealthCheck{Path: "/health", Interval: "5s"},
+		CircuitBreaker: &CircuitBreaker{OpenDuration: "1m"},
+	}
+	a.Empty(ValidateTarget(t, "targets[0]"))
+	t.Privileges = nil
+	problems := ValidateTarget(t, "targets[0]")
+	a.Len(problems, 1)
+	a.Len(problems.Errors(), 0)
+	a.Equal("targets[0].privileges", problems.Warnings()[0].Field)
+}
+
+func (suite *ValidateTestSuite) TestInvalidTarget() {
+	a := assert.New(suite.T())
+	t := &TargetConfig{
+		TargetType: TypeSingle,
+		URL:        "t1:8080/path",
+		Balancing:  "sticky",
+		Privileges: &Privileges{Default: -1, Paths: []*Path{
+			&Path{Method: "GET"},
+			&Path{Regex: `\/audio\/file\/[^\*$`},
+			nil,
+		}},
+		HealthCheck:    &HealthCheck{Path: "health", Interval: "often", Timeout: "-1s", UnhealthyThreshold: -2},
+		CircuitBreaker: &CircuitBreaker{Threshold: -1, OpenDuration: "1 minute"},
+	}
+	problems := ValidateTarget(t, "")
+	fields := make([]string, 0, len(problems))
+	for _, p := range problems {
+		a.False(p.Warning)
+		fields = append(fields, p.Field)
+	}
+	a.Equal([]string{
+		"id",
+		"protocol",
+		"url",
+		"strategy",
+		"privileges.default",
+		"privileges.paths[0]",
+		"privileges.paths[1].regex",
+		"privileges.paths[1].method",
+		"privileges.paths[2]",
+		"healthCheck.path",
+		"healthCheck.interval",
+		"healthCheck.timeout",
+		"healthCheck.unhealthyThreshold",
+		"circuitBreaker.threshold",
+		"circuitBreaker.openDuration",
+	}, fields)
+	a.Contains(problems.Error(), "error: url: url 't1:8080/path' must be absolute")
+	problems = ValidateTarget(&TargetConfig{TID: "t2", TargetType: "cluster", TargetProtocol: "FTP", Privileges: &Privileges{}}, "")
+	a.Len(problems, 2)
+	a.Equal("error: type (target 't2'): unknown type 'cluster', expected 'single' or 'pool'", problems[0].String())
+}
+
+func (suite *ValidateTestSuite) TestDuplicates() {
+	a := assert.New(suite.T())
+	targets := []*TargetConfig{
+		&TargetConfig{TID: "t1", TargetType: TypePool, TargetProtocol: ProtocolHTTP, Privileges: &Privileges{}},
+		nil,
+		&TargetConfig{TID: "t1", TargetType: TypePool, TargetProtocol: ProtocolWebsocket, Privileges: &Privileges{}},
+	}
+	problems := ValidateTargets(targets, "targets")
+	a.Len(problems, 2)
+	a.Equal("targets[1]", problems[0].Field)
+	a.Equal("targets[2].id", problems[1].Field)
+	a.Equal("duplicate id, already used by targets[0]", problems[1].Message)
+}
+
+func (suite *ValidateTestSuite) TestNilPrivileges() {
+	a := assert.New(suite.T())
+	t := &TargetConfig{TID: "t1", TargetType: TypeSingle, TargetProtocol: ProtocolHTTP, URL: "http://t1"}
+	a.Equal(0, t.PrivilegesForPath("/test", "GET"))
+}
+
+func (suite *ValidateTestSuite) TestRolesAndScopes() {
+	a := assert.New(suite.T())
+	t := &TargetConfig{TID: "t1", TargetType: TypeSingle, TargetProtocol: ProtocolHTTP, URL: "http://t1", Privileges: &Privileges{
+		Roles: &Match{},
+		Paths: []*Path{&Path{Exact: "/a", Method: "GET", Roles: &Match{AnyOf: []string{"admin", " "}}, Scopes: &Match{AllOf: []string{""}}}},
+	}}
+	p := ValidateTarget(t, "targets[0]")
+	a.Len(p.Warnings(), 1)
+	a.Equal("targets[0].privileges.roles", p.Warnings()[0].Field)
+	a.Len(p.Errors(), 2)
+	a.Equal("targets[0].privileges.paths[0].roles.anyOf[1]", p.Errors()[0].Field)
+	a.Equal("targets[0].privileges.paths[0].scopes.allOf[0]", p.Errors()[1].Field)
+}
+
+func (suite *ValidateTestSuite) TestPermissionMode() {
+	a := assert.New(suite.T())
+	t := &TargetConfig{TID: "t1", TargetType: TypeSingle, TargetProtocol: ProtocolHTTP, URL: "http://t1", PermissionMode: "flags", Privileges: &Privileges{
+		Paths: []*Path{&Path{Exact: "/a", Method: "GET", Bits: BitsAny}, &Path{Exact: "/b", Method: "GET", Bits: "some"}},
+	}}
+	p := ValidateTarget(t, "")
+	a.Len(p.Errors(), 2)
+	a.Equal("permissionMode", p.Errors()[0].Field)
+	a.Equal("privileges.paths[1].bits", p.Errors()[1].Field)
+	a.Len(p.Warnings(), 1)
+	t.PermissionMode = PermissionBitmask
+	t.Privileges.Paths[1].Bits = BitsAll
+	a.Empty(ValidateTarget(t, ""))
+}
+
+func (suite *ValidateTestSuite) TestIdentityHeaders() {
+	a := assert.New(suite.T())
+	t := &TargetConfig{TID: "t1", TargetType: TypeSingle, TargetProtocol: ProtocolHTTP, URL: "http://t1", Privileges: &Privileges{},
+		Forward: &IdentityHeaders{User: "X User", Name: "-", Roles: "authorization", Scopes: "X-Scope:"}}
+	p := ValidateTarget(t, "")
+	a.Len(p.Errors(), 3)
+	a.Equal("forwardIdentity.user", p.Errors()[0].Field)
+	t.Forward = &IdentityHeaders{User: "X-Remote-User"}
+	a.Empty(ValidateTarget(t, ""))
+}
+
+func (suite *ValidateTestSuite) TestAPIKeys() {
+	a := assert.New(suite.T())
+	t := &TargetConfig{TID: "t1", TargetType: TypeSingle, TargetProtocol: ProtocolHTTP, URL: "http://t1", Privileges: &Privileges{},
+		APIKey: &APIKeyAuth{Header: "Authorization", Query: "key&x"}}
+	p := ValidateTarget(t, "")
+	a.Len(p.Errors(), 2)
+	t.APIKey = &APIKeyAuth{}
+	a.Empty(ValidateTarget(t, ""))
+	p = ValidateAPIKeys([]*APIKey{
+		&APIKey{ID: "cron", Hash: HashAPIKey("k1")},
+		&APIKey{ID: "cron", Hash: HashAPIKey("k2")},
+		&APIKey{Hash: "abc", Permissions: -1},
+		nil,
+	}, "apiKeys")
+	a.Len(p.Errors(), 5)
+	a.Equal("apiKeys[1].id", p[0].Field)
+	a.Equal("apiKeys[3]", p[4].Field)
+}
+
+func (suite *ValidateTestSuite) TestTokenSources() {
+	a := assert.New(suite.T())
+	t := &TargetConfig{TID: "t1", TargetType: TypeSingle, TargetProtocol: ProtocolHTTP, URL: "http://t1", Privileges: &Privileges{},
+		Token: &TokenSources{Order: []TokenSource{SourceCookie, "body", SourceCookie, SourceProtocol}, Cookie: "a;b", Query: []string{""}, Protocol: "access token"}}
+	p := ValidateTarget(t, "")
+	a.Len(p.Errors(), 5)
+	a.Len(p.Warnings(), 1)
+	a.Equal("token.order[3]", p.Warnings()[0].Field)
+	t.Token = &TokenSources{Order: []TokenSource{SourceQuery, SourceHeader}, Query: []string{"jwt"}}
+	a.Empty(ValidateTarget(t, ""))
+}
+
+func (suite *ValidateTestSuite) TestTokenDelivery() {
+	a := assert.New(suite.T())
+	t := &TargetConfig{TID: "t1", TargetType: TypeSingle, TargetProtocol: ProtocolHTTP, URL: "http://t1", Privileges: &Privileges{},
+		Delivery: &TokenDelivery{Mode: "body", Header: "X Token", Cookie: &DeliveryCookie{SameSite: "strict", Insecure: true}, Expiry: ExpiryPush, RefreshBefore: "soon"}}
+	p := ValidateTarget(t, "")
+	a.Len(p.Errors(), 4)
+	a.Len(p.Warnings(), 3)
+	t.UpdatesToken = true
+	t.Delivery = &TokenDelivery{Mode: DeliverCookie, Cookie: &DeliveryCookie{Name: "session", SameSite: "Lax"}}
+	a.Empty(ValidateTarget(t, ""))
+	t.TargetProtocol = ProtocolWebsocket
+	t.Delivery = &TokenDelivery{Mode: DeliverEnvelope, Expiry: ExpiryReject}
+	p = ValidateTarget(t, "")
+	a.Len(p.Warnings(), 1)
+	a.Equal("tokenDelivery.mode", p.Warnings()[0].Field)
+}
+
+func (suite *ValidateTestSuite) TestReauthorize() {
+	a := assert.New(suite.T())
+	t := &TargetConfig{TID: "t1", TargetType: TypeSingle, TargetProtocol: ProtocolHTTP, URL: "http://t1", Privileges: &Privileges{},
+		Reauthorize: &Reauthorization{Interval: "often"}}
+	p := ValidateTarget(t, "")
+	a.Len(p.Errors(), 1)
+	a.Len(p.Warnings(), 1)
+	t.TargetProtocol = ProtocolWebsocket
+	t.Reauthorize = &Reauthorization{Interval: "1m", AtExpiry: true}
+	a.Empty(ValidateTarget(t, ""))
+}
+
+func (suite *ValidateTestSuite) TestRewrite() {
+	a := assert.New(suite.T())
+	t := &TargetConfig{TID: "t1", TargetType: TypeSingle, TargetProtocol: ProtocolHTTP, URL: "http://t1/v1", Privileges: &Privileges{},
+		Rewrite: &Rewrite{StripPrefix: "legacy", AddPrefix: "/v2", Replace: []*Replace{
+			&Replace{Regex: `^/users/([0-9]+)$`, Replacement: "/accounts/$1"},
+			&Replace{Regex: `(`},
+			&Replace{Replacement: "/x"},
+		}}}
+	p := ValidateTarget(t, "")
+	a.Len(p.Errors(), 3)
+	a.Equal("rewrite.stripPrefix", p.Errors()[0].Field)
+	a.Equal("rewrite.replace[1].regex", p.Errors()[1].Field)
+	a.Equal("rewrite.replace[2].regex", p.Errors()[2].Field)
+}
+
+func (suite *ValidateTestSuite) TestPolicy() {
+	a := assert.New(suite.T())
+	t := &TargetConfig{TID: "t1", TargetType: TypeSingle, TargetProtocol: ProtocolHTTP, URL: "http://t1", DefaultPolicy: "block"}
+	p := ValidateTarget(t, "")
+	a.Len(p.Errors(), 1)
+	a.Equal("defaultPolicy", p.Errors()[0].Field)
+	t.DefaultPolicy = PolicyDeny
+	p = ValidateTarget(t, "")
+	a.Empty(p.Errors())
+	a.Equal("no privileges defined, target rejects all requests", p.Warnings()[0].Message)
+	t.Privileges = &Privileges{Default: 1, Paths: []*Path{
+		&Path{Prefix: "/internal", Method: MethodAny, Access: AccessDeny},
+		&Path{Exact: "/health", Method: "GET", Access: AccessAnonymous, Privileges: 3},
+		&Path{Exact: "/status", Method: "GET", Access: "public"},
+	}}
+	p = ValidateTarget(t, "")
+	a.Len(p.Errors(), 1)
+	a.Equal("privileges.paths[2].access", p.Errors()[0].Field)
+	a.Len(p.Warnings(), 2)
+	a.Equal("privileges.default", p.Warnings()[0].Field)
+	a.Equal("privileges.paths[1].access", p.Warnings()[1].Field)
+}
+
+func (suite *ValidateTestSuite) TestPatterns() {
+	a := assert.New(suite.T())
+	t := &TargetConfig{TID: "t1", TargetType: TypeSingle, TargetProtocol: ProtocolHTTP, URL: "http://t1", Privileges: &Privileges{Paths: []*Path{
+		&Path{Exact: "/users/:id", Method: "GET"},
+		&Path{Prefix: "/users/:/roles", Method: "GET"},
+		&Path{Exact: "users", Method: "GET"},
+		&Path{Exact: "/users/:uid", Method: "GET"},
+		&Path{Exact: "/users/:uid", Method: "POST"},
+		&Path{Prefix: "/users/", Method: "GET"},
+		&Path{Prefix: "/users", Method: "GET"},
+		&Path{Method: "GET"},
+	}}}
+	p := ValidateTarget(t, "")
+	a.Len(p.Errors(), 2)
+	a.Equal("privileges.paths[1].prefix", p.Errors()[0].Field)
+	a.Equal("privileges.paths[7]", p.Errors()[1].Field)
+	a.Len(p.Warnings(), 3)
+	a.Equal("privileges.paths[2].exact", p.Warnings()[0].Field)
+	a.Equal("privileges.paths[3]", p.Warnings()[1].Field)
+	a.Equal("privileges.paths[6]", p.Warnings()[2].Field)
+}
+
+func (suite *ValidateTestSuite) TestMethods() {
+	a := assert.New(suite.T())
+	t := &TargetConfig{TID: "t1", TargetType: TypeSingle, TargetProtocol: ProtocolHTTP, URL: "http://t1", Privileges: &Privileges{Paths: []*Path{
+		&Path{Exact: "/a", Method: "get"},
+		&Path{Exact: "/b", Method: "POST,!"},
+		&Path{Exact: "/c", Method: "POST,!GET"},
+		&Path{Exact: "/d", Method: "*,GET"},
+		&Path{Exact: "/e", Method: "!*"},
+		&Path{Exact: "/f", Method: NewMethods("*", "!OPTIONS")},
+	}}}
+	p := ValidateTarget(t, "")
+	a.Len(p.Errors(), 3)
+	a.Equal("privileges.paths[0].method", p.Errors()[0].Field)
+	a.Equal("privileges.paths[1].method", p.Errors()[1].Field)
+	a.Equal("privileges.paths[4].method", p.Errors()[2].Field)
+	a.Len(p.Warnings(), 3)
+	a.Equal("privileges.paths[2].method", p.Warnings()[1].Field)
+	a.Equal("privileges.paths[3].method", p.Warnings()[2].Field)
+}
+
+func (suite *ValidateTestSuite) TestAuth() {
+	a := assert.New(suite.T())
+	a.Empty(ValidateAuth(nil, "auth"))
+	a.Empty(ValidateAuth(&AuthConfig{Mode: AuthModeJWT, JWT: &JWTConfig{Secret: "s", Leeway: "5s"}}, "auth"))
+	p := ValidateAuth(&AuthConfig{Mode: "ldap"}, "auth")
+	a.Len(p.Errors(), 1)
+	a.Equal("auth.mode", p[0].Field)
+	p = ValidateAuth(&AuthConfig{Mode: AuthModeJWT}, "auth")
+	a.Equal("auth.jwt", p.Errors()[0].Field)
+	p = ValidateAuth(&AuthConfig{Mode: AuthModeJWT, JWT: &JWTConfig{}}, "auth")
+	a.Equal("auth.jwt", p.Errors()[0].Field)
+	p = ValidateAuth(&AuthConfig{Mode: AuthModeJWT, JWT: &JWTConfig{Secret: "s", SecretFile: "f", Leeway: "soon"}}, "auth")
+	a.Len(p.Errors(), 2)
+	p = ValidateAuth(&AuthConfig{JWT: &JWTConfig{Secret: "s"}}, "auth")
+	a.Len(p.Warnings(), 1)
+	p = ValidateAuth(&AuthConfig{URL: "auth", CheckPath: "check", Timeout: "-1s", Retry: &RetryPolicy{Attempts: -1, Backoff: "x"}, TLS: &TLSConfig{CertFile: "c.pem"}}, "auth")
+	a.Len(p.Errors(), 6)
+	a.Len(ValidateAuth(&AuthConfig{URL: "https://auth", TLS: &TLSConfig{InsecureSkipVerify: true}}, "auth").Warnings(), 1)
+	a.Len(ValidateTokenCache(&TokenCache{TTL: "0s", MaxEntries: -1}, "tokenCache").Errors(), 2)
+}
+
+func TestValidateTestSuite(t *testing.T) {
+	suite.Run(t, new(ValidateTestSuite))
+}
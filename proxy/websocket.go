@@ -0,0 +1,375 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/websocket"
+)
+
+//CloseUnauthorized is the close code sent to websocket clients whose session is no longer authorized
+const CloseUnauthorized = 4401
+
+const closeTimeout = time.Second
+
+//sessionKey holds the authorization of a websocket session in the upgrade request
+const sessionKey contextKey = "session"
+
+//handshakeKey holds the function reporting whether the upstream accepted the handshake, e.g. to the circuit breaker
+const handshakeKey contextKey = "handshake"
+
+//wsProxy proxies websocket connections to a single upstream keeping the client connection under control of the proxy
+type wsProxy struct {
+	backend *url.URL
+	dialer  *websocket.Dialer
+}
+
+func newWebsocketProxy(uri *url.URL, conns *connTracker) *wsProxy {
+	return &wsProxy{backend: uri, dialer: &websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: handshakeTimeout,
+		NetDial:          conns.dial,
+	}}
+}
+
+func (p *wsProxy) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	clog := log.WithFields(log.Fields{"logger": "api-proxy.websocket", "backend": p.backend.Host, "path": req.URL.Path})
+	backend, resp, err := p.dialer.Dial(p.backendURL(req).String(), p.requestHeader(req))
+	handshakeDone(req, err == nil || (resp != nil && resp.StatusCode < http.StatusInternalServerError))
+	if err != nil {
+		clog.WithError(err).Warn("Could not connect to websocket upstream")
+		if resp != nil {
+			// the upstream refused the handshake
+			res.WriteHeader(resp.StatusCode)
+			return
+		}
+		http.Error(res, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	defer backend.Close()
+	// headers set by the proxy, e.g. refreshed tokens, are not sent by the upgrader otherwise
+	upgradeHeader := http.Header{}
+	for name, values := range res.Header() {
+		upgradeHeader[name] = values
+	}
+	if h := resp.Header.Get("Set-Cookie"); h != "" {
+		upgradeHeader.Add("Set-Cookie", h)
+	}
+	u := upgrader
+	if marker := tokenProtocol(req); marker != "" && len(clientProtocols(req)) == 0 {
+		// clients which only requested the token marker have to get it back
+		c := *upgrader
+		c.Subprotocols = []string{marker}
+		u = &c
+	} else if h := resp.Header.Get(protocolHeader); h != "" {
+		upgradeHeader.Set(protocolHeader, h)
+	}
+	var client *websocket.Conn
+	if client, err = u.Upgrade(res, req, upgradeHeader); err != nil {
+		clog.WithError(err).Info("Could not upgrade client connection")
+		return
+	}
+	defer client.Close()
+	newSession(client, backend, sessionFrom(req)).run()
+}
+
+func (p *wsProxy) backendURL(req *http.Request) *url.URL {
+	u := *p.backend
+	u.Fragment = req.URL.Fragment
+	u.Path, u.RawPath = joinPath(p.backend, req.URL)
+	u.RawQuery = req.URL.RawQuery
+	return &u
+}
+
+//requestHeader returns headers of the upstream handshake
+func (p *wsProxy) requestHeader(req *http.Request) http.Header {
+	h := http.Header{}
+	if origin := req.Header.Get("Origin"); origin != "" {
+		h.Set("Origin", origin)
+	}
+	for _, prot := range req.Header[protocolHeader] {
+		h.Add(protocolHeader, prot)
+	}
+	for _, cookie := range req.Header["Cookie"] {
+		h.Add("Cookie", cookie)
+	}
+	if req.Host != "" {
+		h.Set("Host", req.Host)
+	}
+	if clientIP, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		if prior, ok := req.Header["X-Forwarded-For"]; ok {
+			clientIP = strings.Join(prior, ", ") + ", " + clientIP
+		}
+		h.Set("X-Forwarded-For", clientIP)
+	}
+	forwardHeaders(req, h)
+	forwardProtocols(req, h)
+	return h
+}
+
+//Reauthorization configures checks of open websocket sessions; sessions failing a check are closed with code 4401.
+//Results of token checks may come from the token cache.
+type Reauthorization struct {
+	// Interval between checks of the session token or API key
+	Interval string `yaml:"interval" json:"interval,omitempty"`
+	// AtExpiry checks the token when it expires
+	AtExpiry bool `yaml:"atExpiry" json:"atExpiry,omitempty"`
+}
+
+//sessionCheck is a check of an open websocket session
+type sessionCheck int
+
+const (
+	checkNone sessionCheck = iota
+	// checkAccess checks the token or API key again
+	checkAccess
+	// checkRefresh refreshes the token before it expires
+	checkRefresh
+	// checkExpired rejects the session as its token expired
+	checkExpired
+)
+
+//sessionAuth is the authorization of a websocket session established with a token or an API key
+type sessionAuth struct {
+	target   string
+	keeper   Gatekeeper
+	req      Requirement
+	id       *Identity
+	key      string
+	delivery *TokenDelivery
+	interval time.Duration
+	atExpiry bool
+	// refreshed is set if the token was refreshed during the handshake
+	refreshed bool
+	// checked is the time of the last successful check
+	checked time.Time
+}
+
+func newSessionAuth(t Target, req Requirement, id *Identity, key string, refreshed bool) *sessionAuth {
+	a := &sessionAuth{target: t.ID(), keeper: t.Keeper(), req: req, id: id, key: key, delivery: t.TokenDelivery(), refreshed: refreshed, checked: time.Now()}
+	if r := t.Reauthorization(); r != nil {
+		a.interval = parseDuration(r.Interval, 0)
+		a.atExpiry = r.AtExpiry
+	}
+	return a
+}
+
+func withHandshake(r *http.Request, report func(success bool)) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), handshakeKey, report))
+}
+
+func handshakeDone(r *http.Request, success bool) {
+	if report, ok := r.Context().Value(handshakeKey).(func(bool)); ok {
+		report(success)
+	}
+}
+
+func withSession(r *http.Request, auth *sessionAuth) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), sessionKey, auth))
+}
+
+func sessionFrom(r *http.Request) *sessionAuth {
+	a, _ := r.Context().Value(sessionKey).(*sessionAuth)
+	return a
+}
+
+//next returns the time left until the next check of the session and its kind; checkNone if the session is not checked anymore
+func (a *sessionAuth) next(now time.Time) (time.Duration, sessionCheck) {
+	if a == nil {
+		return 0, checkNone
+	}
+	var at time.Time
+	check := checkNone
+	schedule := func(t time.Time, c sessionCheck) {
+		if check == checkNone || t.Before(at) {
+			at, check = t, c
+		}
+	}
+	if a.interval > 0 {
+		schedule(a.checked.Add(a.interval), checkAccess)
+	}
+	if exp := a.id.Expires; !exp.IsZero() {
+		// expiry checks which already took place are not repeated
+		switch a.delivery.expiry() {
+		case ExpiryPush:
+			if refresh := exp.Add(-a.delivery.refreshBefore()); a.checked.Before(refresh) {
+				schedule(refresh, checkRefresh)
+			}
+		case ExpiryReject:
+			schedule(exp, checkExpired)
+		}
+		if a.atExpiry && a.checked.Before(exp) {
+			schedule(exp, checkAccess)
+		}
+	}
+	if check == checkNone {
+		return 0, checkNone
+	}
+	return at.Sub(now), check
+}
+
+//run performs a check returning an error if the session is no longer authorized
+func (a *sessionAuth) run(check sessionCheck, now time.Time) error {
+	var id *Identity
+	var err error
+	switch check {
+	case checkExpired:
+		return fmt.Errorf("Token expired")
+	case checkRefresh:
+		id, err = a.keeper.CheckAccess(a.id.Token, a.req, true)
+	default:
+		// check results may come from the token cache so expired tokens are rejected here
+		if !a.id.Expires.IsZero() && !now.Before(a.id.Expires) {
+			return fmt.Errorf("Token expired")
+		}
+		if a.key != "" {
+			id, err = a.keeper.CheckKey(a.key, a.target, a.req)
+		} else {
+			id, err = a.keeper.CheckAccess(a.id.Token, a.req, false)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	a.id = id
+	a.checked = now
+	return nil
+}
+
+//wsConn serializes writes to a websocket connection
+type wsConn struct {
+	*websocket.Conn
+	mu sync.Mutex
+}
+
+func (c *wsConn) write(messageType int, data []byte) error {
+	if messageType == websocket.CloseMessage {
+		return c.WriteControl(messageType, data, time.Now().Add(closeTimeout))
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.WriteMessage(messageType, data)
+}
+
+//session copies messages between a client and an upstream connection while keeping the session authorized
+type session struct {
+	client  *wsConn
+	backend *wsConn
+	auth    *sessionAuth
+	done    chan struct{}
+	once    sync.Once
+}
+
+func newSession(client, backend *websocket.Conn, auth *sessionAuth) *session {
+	return &session{client: &wsConn{Conn: client}, backend: &wsConn{Conn: backend}, auth: auth, done: make(chan struct{})}
+}
+
+func (s *session) run() {
+	if s.auth != nil && s.auth.refreshed && s.auth.delivery.expiry() == ExpiryPush {
+		s.client.write(websocket.TextMessage, pushedToken(s.auth.id.Token))
+	}
+	errc := make(chan error, 2)
+	go s.pipe(s.client, s.backend, errc)
+	go s.pipe(s.backend, s.client, errc)
+	go s.authorize()
+	<-errc
+	s.close()
+}
+
+func (s *session) pipe(dst, src *wsConn, errc chan error) {
+	for {
+		mt, msg, err := src.ReadMessage()
+		if err != nil {
+			m := closeMessage(err)
+			if upstreamRemoved(src) {
+				m = websocket.FormatCloseMessage(websocket.CloseGoingAway, closeReasonRemoved)
+			}
+			dst.write(websocket.CloseMessage, m)
+			errc <- err
+			return
+		}
+		if err = dst.write(mt, msg); err != nil {
+			errc <- err
+			return
+		}
+	}
+}
+
+//close reasons sent when the other side of a session went away without a close frame
+const (
+	closeReasonLost    = "connection lost"
+	closeReasonRemoved = "upstream removed"
+)
+
+//upstreamRemoved tells whether the upstream connection was closed by the proxy as its upstream was removed
+func upstreamRemoved(c *wsConn) bool {
+	t, ok := c.UnderlyingConn().(*trackedConn)
+	return ok && t.tracker.removed()
+}
+
+//closeMessage returns the close frame passing a read error of one side of a session on to the other side.
+//Codes which must not be sent on the wire and transport errors are reported as going away; their details are not exposed.
+func closeMessage(err error) []byte {
+	e, ok := err.(*websocket.CloseError)
+	if !ok {
+		return websocket.FormatCloseMessage(websocket.CloseGoingAway, closeReasonLost)
+	}
+	switch e.Code {
+	case websocket.CloseNoStatusReceived:
+		return websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	case websocket.CloseAbnormalClosure, websocket.CloseTLSHandshake:
+		return websocket.FormatCloseMessage(websocket.CloseGoingAway, closeReasonLost)
+	}
+	return websocket.FormatCloseMessage(e.Code, e.Text)
+}
+
+//authorize keeps checking the session until it is closed
+func (s *session) authorize() {
+	for {
+		wait, check := s.auth.next(time.Now())
+		if check == checkNone {
+			return
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-s.done:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if err := s.auth.run(check, time.Now()); err != nil {
+			s.reject(err.Error())
+			return
+		}
+		if check != checkRefresh {
+			continue
+		}
+		if err := s.client.write(websocket.TextMessage, pushedToken(s.auth.id.Token)); err != nil {
+			return
+		}
+	}
+}
+
+//reject closes the session with the unauthorized code
+func (s *session) reject(reason string) {
+	log.WithFields(log.Fields{"logger": "api-proxy.websocket", "target": s.auth.target, "user": s.auth.id.Username, "reason": reason}).
+		Info("Closing unauthorized websocket session")
+	s.client.write(websocket.CloseMessage, websocket.FormatCloseMessage(CloseUnauthorized, reason))
+	s.backend.write(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+	s.close()
+}
+
+func (s *session) close() {
+	s.once.Do(func() {
+		close(s.done)
+		s.client.Close()
+		s.backend.Close()
+	})
+}
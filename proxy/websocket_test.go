@@ -0,0 +1,280 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/mklimuk/goerr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type WebsocketTestSuite struct {
+	suite.Suite
+	upstream *httptest.Server
+	received http.Header
+}
+
+func (suite *WebsocketTestSuite) SetupTest() {
+	suite.upstream = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		suite.received = r.Header
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			mt, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			conn.WriteMessage(mt, msg)
+		}
+	}))
+}
+
+func (suite *WebsocketTestSuite) TearDownTest() {
+	suite.upstream.Close()
+}
+
+//serve starts a proxy to the echo upstream with the given session authorization
+func (suite *WebsocketTestSuite) serve(auth *sessionAuth) (*httptest.Server, string) {
+	uri, _ := url.Parse(strings.Replace(suite.upstream.URL, "http", "ws", 1))
+	p := newWebsocketProxy(uri, newConnTracker())
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if auth != nil {
+			r = withSession(r, auth)
+		}
+		p.ServeHTTP(w, r)
+	}))
+	return srv, strings.Replace(srv.URL, "http", "ws", 1) + "/events?since=1"
+}
+
+func (suite *WebsocketTestSuite) TestProxy() {
+	a := assert.New(suite.T())
+	srv, url := suite.serve(nil)
+	defer srv.Close()
+	header := http.Header{}
+	header.Set("Origin", "http://app.com")
+	header.Set("X-Custom", "dropped")
+	conn, _, err := websocket.DefaultDialer.Dial(url, header)
+	a.NoError(err)
+	defer conn.Close()
+	a.NoError(conn.WriteMessage(websocket.TextMessage, []byte("ping")))
+	_, msg, err := conn.ReadMessage()
+	a.NoError(err)
+	a.Equal("ping", string(msg))
+	a.Equal("http://app.com", suite.received.Get("Origin"))
+	a.Empty(suite.received.Get("X-Custom"))
+	a.NotEmpty(suite.received.Get("X-Forwarded-For"))
+}
+
+func (suite *WebsocketTestSuite) TestPushRefreshed() {
+	a := assert.New(suite.T())
+	k := &GatekeeperMock{}
+	auth := &sessionAuth{target: "ws", keeper: k, req: Requirement{Privileges: 1}, refreshed: true,
+		id:       &Identity{Token: "first", Expires: time.Now().Add(time.Hour)},
+		delivery: &TokenDelivery{Expiry: ExpiryPush, RefreshBefore: "59m59.9s"}}
+	k.On("CheckAccess", "first", Requirement{Privileges: 1}, true).Return(&Identity{Token: "second", Expires: time.Now().Add(2 * time.Hour)}, nil).Once()
+	srv, url := suite.serve(auth)
+	defer srv.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	a.NoError(err)
+	defer conn.Close()
+	m := new(tokenMessage)
+	a.NoError(conn.ReadJSON(m))
+	a.Equal(tokenMessage{Type: "token", Token: "first"}, *m)
+	a.NoError(conn.ReadJSON(m))
+	a.Equal(tokenMessage{Type: "token", Token: "second"}, *m)
+	// messages still pass after the refresh
+	a.NoError(conn.WriteMessage(websocket.TextMessage, []byte("ping")))
+	_, msg, err := conn.ReadMessage()
+	a.NoError(err)
+	a.Equal("ping", string(msg))
+	k.AssertExpectations(suite.T())
+}
+
+func (suite *WebsocketTestSuite) TestRefreshFailure() {
+	a := assert.New(suite.T())
+	k := &GatekeeperMock{}
+	auth := &sessionAuth{target: "ws", keeper: k, req: Requirement{},
+		id:       &Identity{Token: "first", Expires: time.Now().Add(10 * time.Millisecond)},
+		delivery: &TokenDelivery{Expiry: ExpiryPush}}
+	k.On("CheckAccess", "first", Requirement{}, true).Return(nil, goerr.NewError("Token expired", goerr.Unauthorized)).Once()
+	srv, url := suite.serve(auth)
+	defer srv.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	a.NoError(err)
+	defer conn.Close()
+	_, _, err = conn.ReadMessage()
+	a.True(websocket.IsCloseError(err, CloseUnauthorized))
+	k.AssertExpectations(suite.T())
+}
+
+func (suite *WebsocketTestSuite) TestReject() {
+	a := assert.New(suite.T())
+	auth := &sessionAuth{target: "ws", keeper: &GatekeeperMock{},
+		id:       &Identity{Token: "first", Expires: time.Now().Add(50 * time.Millisecond)},
+		delivery: &TokenDelivery{Expiry: ExpiryReject}}
+	srv, url := suite.serve(auth)
+	defer srv.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	a.NoError(err)
+	defer conn.Close()
+	a.NoError(conn.WriteMessage(websocket.TextMessage, []byte("ping")))
+	_, msg, err := conn.ReadMessage()
+	a.NoError(err)
+	a.Equal("ping", string(msg))
+	_, _, err = conn.ReadMessage()
+	a.True(websocket.IsCloseError(err, CloseUnauthorized))
+	a.Contains(err.Error(), "Token expired")
+}
+
+func (suite *WebsocketTestSuite) TestReauthorize() {
+	a := assert.New(suite.T())
+	k := &GatekeeperMock{}
+	auth := &sessionAuth{target: "ws", keeper: k, req: Requirement{Privileges: 1}, id: &Identity{Token: "first"}, interval: 20 * time.Millisecond, checked: time.Now()}
+	k.On("CheckAccess", "first", Requirement{Privileges: 1}, false).Return(&Identity{Token: "first"}, nil).Once()
+	k.On("CheckAccess", "first", Requirement{Privileges: 1}, false).Return(&Identity{Token: "first"}, goerr.NewError("Too low privileges", goerr.Unauthorized)).Once()
+	srv, url := suite.serve(auth)
+	defer srv.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	a.NoError(err)
+	defer conn.Close()
+	_, _, err = conn.ReadMessage()
+	a.True(websocket.IsCloseError(err, CloseUnauthorized))
+	a.Contains(err.Error(), "Too low privileges")
+	k.AssertExpectations(suite.T())
+}
+
+func (suite *WebsocketTestSuite) TestReauthorizeKey() {
+	a := assert.New(suite.T())
+	k := &GatekeeperMock{}
+	auth := &sessionAuth{target: "ws", keeper: k, id: &Identity{Username: "cron"}, key: "secret", interval: 20 * time.Millisecond, checked: time.Now()}
+	k.On("CheckKey", "secret", "ws", Requirement{}).Return(nil, goerr.NewError("Invalid API key", goerr.Unauthorized)).Once()
+	srv, url := suite.serve(auth)
+	defer srv.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	a.NoError(err)
+	defer conn.Close()
+	_, _, err = conn.ReadMessage()
+	a.True(websocket.IsCloseError(err, CloseUnauthorized))
+	k.AssertExpectations(suite.T())
+}
+
+func (suite *WebsocketTestSuite) TestReauthorizeAtExpiry() {
+	a := assert.New(suite.T())
+	calls := 0
+	auth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		exp := float64(time.Now().Add(300*time.Millisecond).UnixNano()) / float64(time.Second)
+		json.NewEncoder(w).Encode(&checkToken{Token: "first", Claims: claims{Permissions: 1, Expires: &exp}})
+	}))
+	defer auth.Close()
+	authURL, _ := url.Parse(auth.URL)
+	// the cached check result outlives the token
+	k := newKeeper(authURL, &AuthConfig{}, http.DefaultClient, &TokenCache{TTL: "1m"})
+	id, err := k.CheckAccess("first", Requirement{Privileges: 1}, false)
+	a.NoError(err)
+	srv, url := suite.serve(&sessionAuth{target: "ws", keeper: k, req: Requirement{Privileges: 1}, id: id, atExpiry: true, checked: time.Now()})
+	defer srv.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	a.NoError(err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = conn.ReadMessage()
+	a.True(websocket.IsCloseError(err, CloseUnauthorized))
+	a.Contains(err.Error(), "Token expired")
+	a.Equal(1, calls)
+}
+
+func (suite *WebsocketTestSuite) TestSchedule() {
+	a := assert.New(suite.T())
+	now := time.Now()
+	var none *sessionAuth
+	_, check := none.next(now)
+	a.Equal(checkNone, check)
+	auth := &sessionAuth{id: &Identity{Token: "first"}, delivery: &TokenDelivery{Expiry: ExpiryReject}, checked: now}
+	_, check = auth.next(now)
+	a.Equal(checkNone, check)
+	auth.interval = time.Minute
+	wait, check := auth.next(now)
+	a.Equal(checkAccess, check)
+	a.Equal(time.Minute, wait)
+	auth.id.Expires = now.Add(30 * time.Second)
+	wait, check = auth.next(now)
+	a.Equal(checkExpired, check)
+	a.Equal(30*time.Second, wait)
+	auth.delivery = &TokenDelivery{Expiry: ExpiryPush, RefreshBefore: "10s"}
+	wait, check = auth.next(now)
+	a.Equal(checkRefresh, check)
+	a.Equal(20*time.Second, wait)
+	// the token was already refreshed but its expiry did not change
+	auth.checked = now.Add(25 * time.Second)
+	auth.atExpiry = true
+	wait, check = auth.next(now)
+	a.Equal(checkAccess, check)
+	a.Equal(30*time.Second, wait)
+	auth.checked = auth.id.Expires
+	wait, check = auth.next(now)
+	a.Equal(checkAccess, check)
+	a.Equal(90*time.Second, wait)
+	b, _ := json.Marshal(auth.id)
+	a.NotContains(string(b), "first")
+}
+
+func (suite *WebsocketTestSuite) TestUpstreamRemoved() {
+	a := assert.New(suite.T())
+	uri, _ := url.Parse(strings.Replace(suite.upstream.URL, "http", "ws", 1))
+	conns := newConnTracker()
+	srv := httptest.NewServer(newWebsocketProxy(uri, conns))
+	defer srv.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(strings.Replace(srv.URL, "http", "ws", 1), nil)
+	a.NoError(err)
+	defer conn.Close()
+	a.Equal(1, conns.closeAll())
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err = conn.ReadMessage()
+	a.True(websocket.IsCloseError(err, websocket.CloseGoingAway))
+	a.Contains(err.Error(), closeReasonRemoved)
+}
+
+func (suite *WebsocketTestSuite) TestCloseMessage() {
+	a := assert.New(suite.T())
+	for _, c := range []struct {
+		err    error
+		code   int
+		reason string
+	}{
+		{&websocket.CloseError{Code: websocket.CloseNormalClosure, Text: "bye"}, websocket.CloseNormalClosure, "bye"},
+		{&websocket.CloseError{Code: 4000, Text: "custom"}, 4000, "custom"},
+		{&websocket.CloseError{Code: websocket.CloseNoStatusReceived}, websocket.CloseNormalClosure, ""},
+		{&websocket.CloseError{Code: websocket.CloseAbnormalClosure, Text: "unexpected EOF"}, websocket.CloseGoingAway, closeReasonLost},
+		{errors.New("read tcp 10.0.0.1:8080->10.0.0.2:51234: " + strings.Repeat("x", 200)), websocket.CloseGoingAway, closeReasonLost},
+	} {
+		m := closeMessage(c.err)
+		a.True(len(m) <= 125)
+		a.Equal(c.code, int(m[0])<<8|int(m[1]), c.err.Error())
+		a.Equal(c.reason, string(m[2:]), c.err.Error())
+	}
+}
+
+func (suite *WebsocketTestSuite) TestBackendURL() {
+	a := assert.New(suite.T())
+	backend, _ := url.Parse("ws://events:8080/v1/stream/")
+	p := newWebsocketProxy(backend, newConnTracker())
+	req := httptest.NewRequest(http.MethodGet, "/api/events/feed", nil)
+	req.URL = &url.URL{Path: "/rooms/a/b", RawPath: "/rooms/a%2Fb", RawQuery: "since=1"}
+	a.Equal("ws://events:8080/v1/stream/rooms/a%2Fb?since=1", p.backendURL(req).String())
+}
+
+func TestWebsocketTestSuite(t *testing.T) {
+	suite.Run(t, new(WebsocketTestSuite))
+}